@@ -0,0 +1,298 @@
+package blocklist
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// ipRange is an inclusive range of addresses, both ends in 16 byte form so
+// IPv4 and IPv6 ranges sort together
+type ipRange struct {
+	first net.IP
+	last  net.IP
+}
+
+// List is a set of blocked ip ranges, kept sorted and merged so lookups
+// are a binary search
+type List struct {
+	mu      sync.RWMutex
+	ranges  []ipRange
+	path    string
+	blocked atomic.Int64
+}
+
+// Default is checked by every peer connection
+var Default = &List{}
+
+// parse reads a blocklist in the P2P plaintext format
+//
+//	Some organization:1.2.3.0-1.2.3.255
+//
+// or the eMule ipfilter.dat format
+//
+//	001.002.003.000 - 001.002.003.255 , 000 , Some organization
+//
+// where only entries with an access level below 128 block. Blank lines and
+// lines starting with # or // are skipped, the format is detected per line.
+func parse(reader io.Reader) ([]ipRange, error) {
+	var ranges []ipRange
+
+	scanner := bufio.NewScanner(reader)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "//") {
+			continue
+		}
+
+		var r ipRange
+		var block bool
+		var err error
+		if isDat(line) {
+			r, block, err = parseDat(line)
+		} else {
+			r, block, err = parseP2P(line)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNumber, err)
+		}
+		if block {
+			ranges = append(ranges, r)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return ranges, nil
+}
+
+// isDat tells ipfilter.dat lines apart by their numeric second field
+func isDat(line string) bool {
+	fields := strings.SplitN(line, ",", 3)
+	if len(fields) < 2 {
+		return false
+	}
+
+	_, err := strconv.Atoi(strings.TrimSpace(fields[1]))
+	return err == nil
+}
+
+func parseP2P(line string) (ipRange, bool, error) {
+	// the description may contain colons and so do IPv6 ranges, the range
+	// starts after the first one that leaves a valid range behind it
+	err := fmt.Errorf("missing ':' before the range")
+	for i := strings.Index(line, ":"); i >= 0; i = nextColon(line, i) {
+		var r ipRange
+		r, err = parseRange(line[i+1:])
+		if err == nil {
+			return r, true, nil
+		}
+	}
+
+	return ipRange{}, false, err
+}
+
+// nextColon finds the colon after the one at i, -1 when there is none
+func nextColon(line string, i int) int {
+	j := strings.Index(line[i+1:], ":")
+	if j < 0 {
+		return -1
+	}
+	return i + 1 + j
+}
+
+func parseDat(line string) (ipRange, bool, error) {
+	fields := strings.SplitN(line, ",", 3)
+	if len(fields) < 2 {
+		return ipRange{}, false, fmt.Errorf("expected range, access level and description")
+	}
+
+	level, err := strconv.Atoi(strings.TrimSpace(fields[1]))
+	if err != nil {
+		return ipRange{}, false, fmt.Errorf("invalid access level %q", fields[1])
+	}
+
+	r, err := parseRange(fields[0])
+	return r, level < 128, err
+}
+
+func parseRange(s string) (ipRange, error) {
+	ends := strings.SplitN(s, "-", 2)
+	if len(ends) != 2 {
+		return ipRange{}, fmt.Errorf("invalid range %q", s)
+	}
+
+	first, last := parseIP(ends[0]), parseIP(ends[1])
+	if first == nil || last == nil {
+		return ipRange{}, fmt.Errorf("invalid range %q", s)
+	}
+	if bytes.Compare(first, last) > 0 {
+		first, last = last, first
+	}
+
+	return ipRange{first, last}, nil
+}
+
+// parseIP also accepts the zero padded octets of ipfilter.dat
+func parseIP(s string) net.IP {
+	s = strings.TrimSpace(s)
+
+	if ip := net.ParseIP(s); ip != nil {
+		return ip.To16()
+	}
+
+	octets := strings.Split(s, ".")
+	if len(octets) != 4 {
+		return nil
+	}
+
+	ip := make(net.IP, 4)
+	for i, octet := range octets {
+		n, err := strconv.Atoi(octet)
+		if err != nil || n < 0 || n > 255 {
+			return nil
+		}
+		ip[i] = byte(n)
+	}
+
+	return ip.To16()
+}
+
+// merge sorts the ranges and joins the ones that overlap or touch
+func merge(ranges []ipRange) []ipRange {
+	sort.Slice(ranges, func(i, j int) bool {
+		return bytes.Compare(ranges[i].first, ranges[j].first) < 0
+	})
+
+	merged := []ipRange{}
+	for _, r := range ranges {
+		if n := len(merged); n > 0 && bytes.Compare(r.first, next(merged[n-1].last)) <= 0 {
+			if bytes.Compare(r.last, merged[n-1].last) > 0 {
+				merged[n-1].last = r.last
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+
+	return merged
+}
+
+// next returns the address after ip, or ip itself when it is the last one
+func next(ip net.IP) net.IP {
+	n := make(net.IP, len(ip))
+	copy(n, ip)
+	for i := len(n) - 1; i >= 0; i-- {
+		n[i]++
+		if n[i] != 0 {
+			return n
+		}
+	}
+	return ip
+}
+
+// Load replaces the list with the ranges read from reader
+func (list *List) Load(reader io.Reader) error {
+	ranges, err := parse(reader)
+	if err != nil {
+		return err
+	}
+
+	merged := merge(ranges)
+
+	list.mu.Lock()
+	list.ranges = merged
+	list.mu.Unlock()
+
+	return nil
+}
+
+// LoadFile replaces the list with the ranges of a file and remembers the
+// path for Reload
+func (list *List) LoadFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err := list.Load(file); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+
+	list.mu.Lock()
+	list.path = path
+	list.mu.Unlock()
+
+	return nil
+}
+
+// Reload reads the last loaded file again
+func (list *List) Reload() error {
+	list.mu.RLock()
+	path := list.path
+	list.mu.RUnlock()
+
+	if path == "" {
+		return fmt.Errorf("no blocklist file loaded")
+	}
+
+	return list.LoadFile(path)
+}
+
+// Contains tells if ip falls in one of the ranges
+func (list *List) Contains(ip net.IP) bool {
+	ip = ip.To16()
+	if ip == nil {
+		return false
+	}
+
+	list.mu.RLock()
+	defer list.mu.RUnlock()
+
+	// first range that ends at or after ip
+	i := sort.Search(len(list.ranges), func(i int) bool {
+		return bytes.Compare(list.ranges[i].last, ip) >= 0
+	})
+
+	return i < len(list.ranges) && bytes.Compare(list.ranges[i].first, ip) <= 0
+}
+
+// Check is Contains for connections, it counts the ones it blocks
+func (list *List) Check(ip net.IP) bool {
+	if !list.Contains(ip) {
+		return false
+	}
+
+	list.blocked.Add(1)
+	return true
+}
+
+func (list *List) Path() string {
+	list.mu.RLock()
+	defer list.mu.RUnlock()
+	return list.path
+}
+
+// Len is the number of ranges after merging
+func (list *List) Len() int {
+	list.mu.RLock()
+	defer list.mu.RUnlock()
+	return len(list.ranges)
+}
+
+// Blocked is the number of connections blocked so far
+func (list *List) Blocked() int64 {
+	return list.blocked.Load()
+}
@@ -0,0 +1,95 @@
+package blocklist
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestP2P(t *testing.T) {
+	list := &List{}
+	err := list.Load(strings.NewReader(`# a comment
+// another one
+
+Some organization:1.2.3.0-1.2.3.255
+Colons: in: the description:10.0.0.5-10.0.0.1
+IPv6 range:2001:db8::-2001:db8::ffff
+Touching:1.2.4.0-1.2.4.10
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 1.2.3.0-1.2.3.255 and 1.2.4.0-1.2.4.10 touch and merge
+	if list.Len() != 3 {
+		t.Errorf("%d ranges, want 3", list.Len())
+	}
+
+	tests := []struct {
+		ip      string
+		blocked bool
+	}{
+		{"1.2.3.0", true},
+		{"1.2.3.255", true},
+		{"1.2.4.10", true},
+		{"1.2.4.11", false},
+		{"1.2.2.255", false},
+		{"10.0.0.3", true},
+		{"10.0.0.6", false},
+		{"2001:db8::1", true},
+		{"2001:db8::ffff", true},
+		{"2001:db8::1:0", false},
+		{"::ffff:1.2.3.4", true},
+	}
+	for _, test := range tests {
+		if list.Contains(net.ParseIP(test.ip)) != test.blocked {
+			t.Errorf("%s: blocked %v, want %v", test.ip, !test.blocked, test.blocked)
+		}
+	}
+}
+
+func TestDat(t *testing.T) {
+	list := &List{}
+	err := list.Load(strings.NewReader(`001.002.003.000 - 001.002.003.255 , 000 , Some organization
+005.006.007.000 - 005.006.007.255 , 127 , Still blocked
+008.008.008.000 - 008.008.008.255 , 200 , Allowed
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ip      string
+		blocked bool
+	}{
+		{"1.2.3.4", true},
+		{"5.6.7.255", true},
+		{"8.8.8.8", false},
+		{"1.2.4.0", false},
+	}
+	for _, test := range tests {
+		if list.Contains(net.ParseIP(test.ip)) != test.blocked {
+			t.Errorf("%s: blocked %v, want %v", test.ip, !test.blocked, test.blocked)
+		}
+	}
+
+	if !list.Check(net.ParseIP("1.2.3.4")) || list.Check(net.ParseIP("8.8.8.8")) || list.Blocked() != 1 {
+		t.Errorf("%d connections blocked, want 1", list.Blocked())
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	for _, line := range []string{
+		"no range at all",
+		"Org:1.2.3.0",
+		"Org:1.2.3.0-1.2.3.256",
+		"Org:2001:db8::-nothing",
+		"001.002.003.000 - 001.002.003.255 , x , Bad level",
+		"1.2.3.0 - 1.2.3.300 , 000 , Bad address",
+	} {
+		err := (&List{}).Load(strings.NewReader("# first line\n" + line))
+		if err == nil || !strings.HasPrefix(err.Error(), "line 2:") {
+			t.Errorf("%q: got %v", line, err)
+		}
+	}
+}
@@ -3,10 +3,17 @@ package client
 import (
 	"bytes"
 	"fmt"
+	"github.com/johneliades/flash/blocklist"
+	"github.com/johneliades/flash/extension"
 	"github.com/johneliades/flash/handshake"
 	"github.com/johneliades/flash/message"
+	"github.com/johneliades/flash/mse"
 	"github.com/johneliades/flash/peer"
+	"github.com/johneliades/flash/proxy"
+	"github.com/johneliades/flash/utp"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -35,22 +42,77 @@ func (bf bitfield) SetPiece(index int) {
 	bf[byteIndex] |= 1 << (7 - offset)
 }
 
+// PreferUTP dials peers over uTP first and falls back to TCP when they don't
+// answer. Behind a proxy peers are always dialed over TCP. The settings
+// change it while peers are dialed.
+var PreferUTP atomic.Bool
+
 type Client struct {
 	Conn     net.Conn
-	Choked   bool
 	BitField bitfield
-	peer     peer.Peer
-	infoHash [20]byte
-	peerID   [20]byte
+	// reserved bytes of the remote handshake
+	Reserved handshake.Reserved
+	// remote extended handshake, nil if the peer hasn't sent one. Other
+	// goroutines go through SupportsExtension and ListenPeer.
+	Extensions *extension.Handshake
+	extMu      sync.Mutex
+	// pieces the peer lets us request while it chokes us
+	AllowedFast map[int]bool
+	// bytes of block data received from and sent to the peer
+	Downloaded atomic.Int64
+	Uploaded   atomic.Int64
+	// both sides of the choke state and the peer's interest in us,
+	// written by the choker and the peer's goroutine concurrently
+	amChoking      atomic.Bool
+	choked         atomic.Bool
+	peerInterested atomic.Bool
+	peer           peer.Peer
+	numPieces      int
+	infoHash       [20]byte
+	peerID         [20]byte
+	registry       *extension.Registry
+	// Blocks serves the peer's requests, which get rejected while it is nil
+	Blocks BlockReader
+	// Hashes serves the hash requests of v2 torrents the same way
+	Hashes HashReader
+	// rate limited writes go out in chunks, so whole messages are written
+	// under the lock to keep the choker's from landing in between
+	writeMu sync.Mutex
+}
+
+// BlockReader reads the blocks of the pieces we have for peers
+type BlockReader interface {
+	ReadBlock(index, begin, length int) ([]byte, error)
+}
+
+// HashReader reads the hashes of the Merkle trees of v2 torrents for
+// peers, along with the proof that they belong in the tree
+type HashReader interface {
+	ReadHashes(req message.HashRange) ([][32]byte, error)
 }
 
-func New(peer peer.Peer, peerID, infoHash [20]byte) (*Client, error) {
-	conn, ok := net.DialTimeout("tcp", peer.String(false), 3*time.Second)
+// maxRequestLength is the largest block we serve, bigger requests are
+// refused as most clients do
+const maxRequestLength = 16384
+
+// New connects to a peer of the torrent, v2 torrents tell the peer that
+// we speak BitTorrent v2 and hybrids join both swarms under infoHash. The
+// peer learns of the pieces in have right after the handshake.
+func New(peer peer.Peer, peerID, infoHash [20]byte, numPieces int, have []int, v2 bool,
+	registry *extension.Registry) (*Client, error) {
+	if blocklist.Default.Check(peer.IP()) {
+		return &Client{}, fmt.Errorf("%s is blocked by the ip filter", peer.String(true))
+	}
+
+	conn, ok := dial(peer, infoHash)
 	if ok != nil {
 		return &Client{}, ok
 	}
 
 	req := handshake.New(infoHash, peerID)
+	if v2 {
+		req.Reserved.SetBit(handshake.V2Bit)
+	}
 
 	_, ok = conn.Write(req.Serialize())
 	if ok != nil {
@@ -66,49 +128,440 @@ func New(peer peer.Peer, peerID, infoHash [20]byte) (*Client, error) {
 	}
 
 	if !bytes.Equal(res.InfoHash[:], infoHash[:]) {
+		conn.Close()
 		return nil, fmt.Errorf("Expected infohash %x but got %x", res.InfoHash, infoHash)
 	}
 
-	conn.SetDeadline(time.Now().Add(3 * time.Second))
-	defer conn.SetDeadline(time.Time{})
+	c, ok := start(conn, peer, res, peerID, numPieces, have, registry)
+	if ok != nil {
+		conn.Close()
+		return &Client{}, ok
+	}
+
+	return c, nil
+}
+
+// dial connects to a peer and encrypts the connection as the policy asks,
+// falling back to plaintext on a fresh connection when allowed
+func dial(peer peer.Peer, infoHash [20]byte) (net.Conn, error) {
+	policy := mse.Policy(mse.CurrentPolicy.Load())
+	conn, err := connect(peer)
+	if err != nil || policy == mse.Disable {
+		return conn, err
+	}
+
+	provide := mse.CryptoRC4
+	if policy == mse.Prefer {
+		provide |= mse.CryptoPlaintext
+	}
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	encrypted, err := mse.Initiate(conn, infoHash, provide)
+	conn.SetDeadline(time.Time{})
+	if err == nil {
+		return encrypted, nil
+	}
+
+	conn.Close()
+	if policy == mse.Require {
+		return nil, err
+	}
+
+	return connect(peer)
+}
 
-	msg, ok := message.Read(conn)
+// connect opens a connection to a peer over the preferred transport
+func connect(peer peer.Peer) (net.Conn, error) {
+	socket := utp.Default()
+	if PreferUTP.Load() && socket != nil && !proxy.Enabled() {
+		conn, err := socket.Dial(peer.String(false), 3*time.Second)
+		if err == nil {
+			return conn, nil
+		}
+	}
+
+	return proxy.Dial("tcp", peer.String(false), 3*time.Second)
+}
+
+// Accept sets up a connection a peer opened to us, once its handshake has
+// been read and matched to one of our torrents
+func Accept(conn net.Conn, peer peer.Peer, res *handshake.Handshake, peerID [20]byte,
+	numPieces int, have []int, v2 bool, registry *extension.Registry) (*Client, error) {
+
+	req := handshake.New(res.InfoHash, peerID)
+	if v2 {
+		req.Reserved.SetBit(handshake.V2Bit)
+	}
+
+	_, ok := conn.Write(req.Serialize())
 	if ok != nil {
 		return &Client{}, ok
 	}
 
-	if msg.ID != message.BitField {
-		return nil, fmt.Errorf("Expected bitField's id but got: %d", msg.ID)
+	return start(conn, peer, res, peerID, numPieces, have, registry)
+}
+
+// start exchanges the messages that follow the handshake on either kind of connection
+func start(conn net.Conn, peer peer.Peer, res *handshake.Handshake, peerID [20]byte,
+	numPieces int, have []int, registry *extension.Registry) (*Client, error) {
+
+	c := &Client{
+		Conn:        conn,
+		Reserved:    res.Reserved,
+		AllowedFast: map[int]bool{},
+		peer:        peer,
+		numPieces:   numPieces,
+		infoHash:    res.InfoHash,
+		peerID:      peerID,
+		registry:    registry,
+	}
+
+	c.amChoking.Store(true)
+	c.choked.Store(true)
+
+	// what we have goes first, the Fast Extension allows Have All and Have
+	// None nowhere else
+	ok := c.sendPieces(have)
+	if ok != nil {
+		return &Client{}, ok
+	}
+
+	if registry != nil && res.Reserved.SupportsExtensions() {
+		ok = c.sendExtendedHandshake()
+		if ok != nil {
+			return &Client{}, ok
+		}
 	}
 
-	return &Client{
-		Conn:     conn,
-		Choked:   true,
-		BitField: msg.Payload,
-		peer:     peer,
-		infoHash: infoHash,
-		peerID:   peerID,
-	}, nil
+	// The bitfield is optional, peers that have nothing or send lazy
+	// bitfields skip it or follow it up with haves, so we start empty and
+	// process whatever arrives first
+	c.BitField = make(bitfield, (numPieces+7)/8)
+
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+
+	for {
+		msg, ok := message.Read(conn)
+		if ok != nil {
+			if netErr, isNet := ok.(net.Error); isNet && netErr.Timeout() {
+				break
+			}
+			return &Client{}, ok
+		}
+
+		if msg == nil { // keep-alive
+			continue
+		}
+
+		ok = c.Handle(msg)
+		if ok != nil {
+			return &Client{}, ok
+		}
+
+		// the extended handshake may arrive before the bitfield
+		if msg.ID != message.Extended {
+			break
+		}
+	}
+
+	return c, nil
 }
 
-func (c *Client) SendRequest(index, begin, length int) error {
-	_, err := c.Conn.Write(message.MakeRequest(index, begin, length).Serialize())
-	return err
+// sendPieces tells the peer which pieces we have in a single message. With
+// the Fast Extension there must be one, Have All and Have None saying it
+// shortest. Other peers get a bitfield, or nothing while we have nothing.
+func (c *Client) sendPieces(have []int) error {
+	if c.SupportsFast() {
+		switch len(have) {
+		case 0:
+			return c.send(&message.Message{ID: message.HaveNone})
+		case c.numPieces:
+			return c.send(&message.Message{ID: message.HaveAll})
+		}
+	}
+	if len(have) == 0 {
+		return nil
+	}
+
+	bf := make(bitfield, (c.numPieces+7)/8)
+	for _, index := range have {
+		bf.SetPiece(index)
+	}
+	return c.send(&message.Message{ID: message.BitField, Payload: bf})
 }
 
-func (c *Client) SendInterested() error {
-	msg := message.Message{ID: message.Interested}
+// SupportsFast tells if the remote peer advertised the Fast Extension,
+// we always do
+func (c *Client) SupportsFast() bool {
+	return c.Reserved.SupportsFast()
+}
+
+// Handle updates the client's state from any message that isn't a block of data
+func (c *Client) Handle(msg *message.Message) error {
+	switch msg.ID {
+	case message.Unchoke:
+		c.choked.Store(false)
+	case message.Choke:
+		c.choked.Store(true)
+	case message.Interested:
+		c.peerInterested.Store(true)
+	case message.NotInterested:
+		c.peerInterested.Store(false)
+	case message.Have:
+		index, err := message.ParseHave(msg)
+		if err != nil {
+			return err
+		}
+		c.BitField.SetPiece(index)
+	case message.BitField:
+		if len(msg.Payload) != len(c.BitField) {
+			return fmt.Errorf("Expected bitField of %d bytes but got %d", len(c.BitField), len(msg.Payload))
+		}
+		copy(c.BitField, msg.Payload)
+	case message.HaveAll:
+		for i := 0; i < c.numPieces; i++ {
+			c.BitField.SetPiece(i)
+		}
+	case message.HaveNone:
+		for i := range c.BitField {
+			c.BitField[i] = 0
+		}
+	case message.SuggestPiece:
+		// suggestions are only advice, the work queue decides what we
+		// download next
+		if _, err := message.ParseIndex(msg); err != nil {
+			return err
+		}
+	case message.AllowedFast:
+		index, err := message.ParseIndex(msg)
+		if err != nil {
+			return err
+		}
+		if index >= 0 && index < c.numPieces {
+			c.AllowedFast[index] = true
+		}
+	case message.Request:
+		index, begin, length, err := message.ParseRequest(msg)
+		if err != nil {
+			return err
+		}
+		return c.serve(index, begin, length)
+	case message.HashRequest:
+		req, err := message.ParseHashRequest(msg)
+		if err != nil {
+			return err
+		}
+		return c.serveHashes(req)
+	case message.Hashes, message.HashReject:
+		// every hash we need comes with the torrent, we never ask for any
+	case message.Extended:
+		return c.HandleExtended(msg)
+	}
+
+	return nil
+}
+
+// Addr returns the remote peer's address
+func (c *Client) Addr() string {
+	return c.peer.String(false)
+}
+
+// InfoHash returns the info hash the connection was made under
+func (c *Client) InfoHash() [20]byte {
+	return c.infoHash
+}
+
+// SupportsExtension tells if the remote peer advertised an extension in its extended handshake
+func (c *Client) SupportsExtension(name string) bool {
+	_, ok := c.extensionID(name)
+	return ok
+}
+
+func (c *Client) extensionID(name string) (uint8, bool) {
+	c.extMu.Lock()
+	defer c.extMu.Unlock()
+
+	if c.Extensions == nil {
+		return 0, false
+	}
+	id, ok := c.Extensions.M[name]
+	return uint8(id), ok
+}
+
+// ListenPeer returns the address the peer accepts connections on. For peers
+// that connected to us that is the port of their extended handshake, not
+// the one they connected from.
+func (c *Client) ListenPeer() peer.Peer {
+	c.extMu.Lock()
+	defer c.extMu.Unlock()
+
+	if c.Extensions != nil && c.Extensions.P > 0 {
+		return *peer.New(c.peer.IP(), uint16(c.Extensions.P))
+	}
+	return c.peer
+}
+
+func (c *Client) sendExtendedHandshake() error {
+	handshake := c.registry.Handshake()
+	// the listen port is of no use to peers and only gives us away behind a proxy
+	if proxy.Enabled() {
+		handshake.P = 0
+	}
+
+	payload := handshake.Serialize()
+	return c.send(message.MakeExtended(extension.HandshakeID, payload))
+}
+
+// SendExtended sends a message for an extension using the id the remote peer assigned to it
+func (c *Client) SendExtended(name string, payload []byte) error {
+	id, ok := c.extensionID(name)
+	if !ok {
+		return fmt.Errorf("peer doesn't support extension %s", name)
+	}
+
+	return c.send(message.MakeExtended(id, payload))
+}
+
+// HandleExtended records the remote extended handshake or routes an
+// extension message to its registered handler
+func (c *Client) HandleExtended(msg *message.Message) error {
+	id, payload, err := message.ParseExtended(msg)
+	if err != nil {
+		return err
+	}
+
+	if id == extension.HandshakeID {
+		handshake, err := extension.ParseHandshake(payload)
+		if err != nil {
+			return err
+		}
+		c.extMu.Lock()
+		c.Extensions = handshake
+		c.extMu.Unlock()
+
+		if c.registry != nil {
+			return c.registry.HandleHandshake(c, handshake)
+		}
+		return nil
+	}
+
+	if c.registry == nil {
+		return nil
+	}
+
+	return c.registry.Handle(c, id, payload)
+}
+
+func (c *Client) send(msg *message.Message) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
 	_, err := c.Conn.Write(msg.Serialize())
 	return err
 }
 
-func (c *Client) SendUnchoke() error {
-	msg := message.Message{ID: message.Unchoke}
+// serve answers a request of the peer with the block, or rejects it when we
+// choke the peer or can't read the block. Peers without the Fast Extension
+// learn nothing of a rejection.
+func (c *Client) serve(index, begin, length int) error {
+	var buf []byte
+	err := fmt.Errorf("no blocks to serve")
+	if !c.amChoking.Load() && c.Blocks != nil && length > 0 && length <= maxRequestLength {
+		buf, err = c.Blocks.ReadBlock(index, begin, length)
+	}
+
+	if err != nil {
+		if c.SupportsFast() {
+			return c.send(message.MakeReject(index, begin, length))
+		}
+		return nil
+	}
+
+	err = c.send(message.MakePiece(index, begin, buf))
+	if err == nil {
+		c.Uploaded.Add(int64(len(buf)))
+	}
+	return err
+}
+
+// serveHashes answers a hash request of the peer, or rejects it when we
+// don't have the hashes
+func (c *Client) serveHashes(req message.HashRange) error {
+	var hashes [][32]byte
+	err := fmt.Errorf("no hashes to serve")
+	if c.Hashes != nil && c.Reserved.SupportsV2() {
+		hashes, err = c.Hashes.ReadHashes(req)
+	}
+
+	if err != nil {
+		return c.send(message.MakeHashReject(req))
+	}
+	return c.send(message.MakeHashes(req, hashes))
+}
+
+func (c *Client) SendRequest(index, begin, length int) error {
+	return c.send(message.MakeRequest(index, begin, length))
+}
+
+func (c *Client) SendInterested() error {
+	return c.send(&message.Message{ID: message.Interested})
+}
+
+func (c *Client) SendNotInterested() error {
+	return c.send(&message.Message{ID: message.NotInterested})
+}
+
+// SendKeepAlive keeps a connection with nothing else going on open
+func (c *Client) SendKeepAlive() error {
+	return c.send(nil)
+}
+
+// Seed tells if the peer has every piece
+func (c *Client) Seed() bool {
+	for i := 0; i < c.numPieces; i++ {
+		if !c.BitField.HasPiece(i) {
+			return false
+		}
+	}
+	return true
+}
+
+// AmChoking tells if we are choking the peer
+func (c *Client) AmChoking() bool {
+	return c.amChoking.Load()
+}
+
+// Choked tells if the peer is choking us
+func (c *Client) Choked() bool {
+	return c.choked.Load()
+}
+
+// PeerInterested tells if the peer wants to download from us
+func (c *Client) PeerInterested() bool {
+	return c.peerInterested.Load()
+}
+
+// SetChoking changes our side of the choke state and reports whether it
+// changed. The peer learns of it from SendChokeState, which may come later
+// and cross another change, so it sends whatever the state is by the time it
+// writes and the last message the peer gets is always right.
+func (c *Client) SetChoking(choking bool) bool {
+	return c.amChoking.Swap(choking) != choking
+}
+
+func (c *Client) SendChokeState() error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	msg := &message.Message{ID: message.Unchoke}
+	if c.amChoking.Load() {
+		msg.ID = message.Choke
+	}
 	_, err := c.Conn.Write(msg.Serialize())
 	return err
 }
 
 func (c *Client) SendHave(index int) error {
-	_, err := c.Conn.Write(message.MakeHave(index).Serialize())
-	return err
+	return c.send(message.MakeHave(index))
 }
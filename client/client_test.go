@@ -0,0 +1,94 @@
+package client
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/johneliades/flash/extension"
+	"github.com/johneliades/flash/handshake"
+	"github.com/johneliades/flash/message"
+	"github.com/johneliades/flash/peer"
+)
+
+// firstMessage accepts a peer that has the Fast Extension when fast and the
+// extension protocol when extended, and returns the message we open with
+// after the handshake, nil if there is none
+func firstMessage(t *testing.T, fast, extended bool, numPieces int, have []int) *message.Message {
+	t.Helper()
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+
+	res := &handshake.Handshake{}
+	if fast {
+		res.Reserved.SetBit(handshake.FastBit)
+	}
+	var registry *extension.Registry
+	if extended {
+		res.Reserved.SetBit(handshake.ExtensionBit)
+		registry = extension.NewRegistry()
+	}
+
+	first := make(chan *message.Message, 1)
+	go func() {
+		defer close(first)
+		if _, err := handshake.Read(remote); err != nil {
+			return
+		}
+		remote.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		msg, err := message.Read(remote)
+		if err == nil {
+			first <- msg
+		}
+		go io.Copy(io.Discard, remote)
+		// what we tell the peer of our own pieces ends the wait for its
+		remote.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		remote.Write((&message.Message{ID: message.HaveNone}).Serialize())
+	}()
+
+	if _, err := Accept(local, *peer.New(net.IPv4(10, 0, 0, 1), 6881), res, [20]byte{}, numPieces,
+		have, false, registry); err != nil {
+		t.Fatal(err)
+	}
+	return <-first
+}
+
+func TestFirstMessage(t *testing.T) {
+	if msg := firstMessage(t, true, false, 10, nil); msg == nil || msg.ID != message.HaveNone {
+		t.Errorf("with nothing, a fast peer got %v, want Have None", msg)
+	}
+	all := []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}
+	if msg := firstMessage(t, true, false, 10, all); msg == nil || msg.ID != message.HaveAll {
+		t.Errorf("with everything, a fast peer got %v, want Have All", msg)
+	}
+
+	// one message for all of them, not a Have for each
+	want := []byte{0b10100000, 0b01000000}
+	for _, fast := range []bool{true, false} {
+		msg := firstMessage(t, fast, false, 10, []int{0, 2, 9})
+		if msg == nil || msg.ID != message.BitField || !bytes.Equal(msg.Payload, want) {
+			t.Errorf("fast %v: got %v, want a bitfield of %08b", fast, msg, want)
+		}
+	}
+
+	if msg := firstMessage(t, false, false, 10, all); msg == nil || msg.ID != message.BitField {
+		t.Errorf("with everything, a peer without the Fast Extension got %v, want a bitfield", msg)
+	}
+	if msg := firstMessage(t, false, false, 10, nil); msg != nil {
+		t.Errorf("with nothing, a peer without the Fast Extension got %v", msg)
+	}
+
+	// the extended handshake waits for what we have
+	if msg := firstMessage(t, true, true, 10, nil); msg == nil || msg.ID != message.HaveNone {
+		t.Errorf("with nothing, a fast peer with extensions got %v, want Have None", msg)
+	}
+	if msg := firstMessage(t, false, true, 10, []int{0}); msg == nil || msg.ID != message.BitField {
+		t.Errorf("a peer with extensions got %v, want a bitfield", msg)
+	}
+	if msg := firstMessage(t, false, true, 10, nil); msg == nil || msg.ID != message.Extended {
+		t.Errorf("with nothing, a peer without the Fast Extension got %v, want the extended handshake", msg)
+	}
+}
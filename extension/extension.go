@@ -0,0 +1,187 @@
+package extension
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/marksamman/bencode"
+)
+
+// HandshakeID is the extended message id of the extended handshake
+const HandshakeID uint8 = 0
+
+// Handshake is the bencoded dictionary exchanged right after the
+// BitTorrent handshake when both sides support the extension protocol
+type Handshake struct {
+	// extension name to the extended message id the sender wants to receive it on
+	M map[string]int
+	// client name and version
+	V string
+	// local TCP listen port
+	P int
+	// number of outstanding requests the sender supports without dropping any
+	Reqq int
+	// size of the info dictionary in bytes, 0 if unknown
+	MetadataSize int
+}
+
+func (handshake *Handshake) Serialize() []byte {
+	m := map[string]interface{}{}
+	for name, id := range handshake.M {
+		m[name] = int64(id)
+	}
+
+	dict := map[string]interface{}{"m": m}
+	if handshake.V != "" {
+		dict["v"] = handshake.V
+	}
+	if handshake.P > 0 {
+		dict["p"] = int64(handshake.P)
+	}
+	if handshake.Reqq > 0 {
+		dict["reqq"] = int64(handshake.Reqq)
+	}
+	if handshake.MetadataSize > 0 {
+		dict["metadata_size"] = int64(handshake.MetadataSize)
+	}
+
+	return bencode.Encode(dict)
+}
+
+func ParseHandshake(payload []byte) (*Handshake, error) {
+	dict, err := bencode.Decode(bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+
+	handshake := &Handshake{M: map[string]int{}}
+
+	if m, ok := dict["m"].(map[string]interface{}); ok {
+		for name, id := range m {
+			if id, ok := id.(int64); ok && id > 0 && id < 256 {
+				handshake.M[name] = int(id)
+			}
+		}
+	}
+	if v, ok := dict["v"].(string); ok {
+		handshake.V = v
+	}
+	if p, ok := dict["p"].(int64); ok && p > 0 && p < 65536 {
+		handshake.P = int(p)
+	}
+	if reqq, ok := dict["reqq"].(int64); ok && reqq > 0 {
+		handshake.Reqq = int(reqq)
+	}
+	if size, ok := dict["metadata_size"].(int64); ok && size > 0 {
+		handshake.MetadataSize = int(size)
+	}
+
+	return handshake, nil
+}
+
+// Peer is the side of a connection an extension handler talks back to
+type Peer interface {
+	Addr() string
+	// InfoHash is the info hash the connection was made under
+	InfoHash() [20]byte
+	SendExtended(name string, payload []byte) error
+}
+
+// Handler implements a single extension, such as ut_metadata or ut_pex
+type Handler interface {
+	// Name is the key the extension is advertised under in the m dictionary
+	Name() string
+	// Handle is called for every message the remote peer sends us for this extension
+	Handle(p Peer, payload []byte) error
+}
+
+// HandshakeHandler is implemented by handlers that want to see the remote
+// extended handshake, for example to learn the metadata size
+type HandshakeHandler interface {
+	HandleHandshake(p Peer, handshake *Handshake) error
+}
+
+// Registry holds the extensions we support and the ids we assign them
+type Registry struct {
+	Version      string
+	Port         int
+	Reqq         int
+	MetadataSize int
+
+	mu       sync.RWMutex
+	handlers []Handler
+}
+
+func NewRegistry() *Registry {
+	return &Registry{Version: "flash"}
+}
+
+// Register adds a handler and returns the local extended message id
+// remote peers have to use to reach it
+func (registry *Registry) Register(handler Handler) uint8 {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	for i, h := range registry.handlers {
+		if h.Name() == handler.Name() {
+			registry.handlers[i] = handler
+			return uint8(i + 1)
+		}
+	}
+
+	registry.handlers = append(registry.handlers, handler)
+	return uint8(len(registry.handlers))
+}
+
+// Handshake builds the extended handshake we send to every peer
+func (registry *Registry) Handshake() *Handshake {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+
+	m := map[string]int{}
+	for i, h := range registry.handlers {
+		m[h.Name()] = i + 1
+	}
+
+	return &Handshake{
+		M:            m,
+		V:            registry.Version,
+		P:            registry.Port,
+		Reqq:         registry.Reqq,
+		MetadataSize: registry.MetadataSize,
+	}
+}
+
+// HandleHandshake passes the remote extended handshake to every handler interested in it
+func (registry *Registry) HandleHandshake(p Peer, handshake *Handshake) error {
+	registry.mu.RLock()
+	handlers := append([]Handler{}, registry.handlers...)
+	registry.mu.RUnlock()
+
+	for _, h := range handlers {
+		if hh, ok := h.(HandshakeHandler); ok {
+			if err := hh.HandleHandshake(p, handshake); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Handle routes a message sent to one of our local extended message ids
+func (registry *Registry) Handle(p Peer, id uint8, payload []byte) error {
+	registry.mu.RLock()
+	var handler Handler
+	if id > 0 && int(id) <= len(registry.handlers) {
+		handler = registry.handlers[id-1]
+	}
+	registry.mu.RUnlock()
+
+	// messages for ids we never advertised are ignored, not fatal
+	if handler == nil {
+		return nil
+	}
+
+	return handler.Handle(p, payload)
+}
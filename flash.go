@@ -4,11 +4,16 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
+	"github.com/johneliades/flash/portmap"
+	"github.com/johneliades/flash/ratelimit"
 	"github.com/johneliades/flash/routes"
+	"github.com/johneliades/flash/torrent"
 )
 
 func getOutboundInterface() (*net.Interface, error) {
@@ -63,5 +68,25 @@ func main() {
 
 	routes.RegisterRoutes(r)
 
+	go ratelimit.Schedule.Run(nil)
+
+	go func() {
+		if err := torrent.Listen(torrent.ListenPort); err != nil {
+			fmt.Println("Error:", err)
+		}
+	}()
+
+	go portmap.Default.Run(torrent.ListenPort)
+
+	// take the port mappings off the router on the way out
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+
+		portmap.Default.Close()
+		os.Exit(0)
+	}()
+
 	r.Run(":8080")
 }
\ No newline at end of file
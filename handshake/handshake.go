@@ -5,25 +5,74 @@ import (
 	"io"
 )
 
+// ExtensionBit is the reserved bit a peer sets to advertise the extension
+// protocol (BEP 10). Bits are counted from the right, starting at 0.
+const ExtensionBit = 20
+
+// FastBit is the reserved bit that advertises the Fast Extension (BEP 6)
+const FastBit = 2
+
+// V2Bit is the reserved bit of peers that speak BitTorrent v2 (BEP 52)
+const V2Bit = 4
+
+// Reserved holds the 8 reserved bytes peers use to advertise extensions
+type Reserved [8]byte
+
 type Handshake struct {
 	pstr     string
+	Reserved Reserved
 	InfoHash [20]byte
 	PeerID   [20]byte
 }
 
 func New(infoHash, peerID [20]byte) *Handshake {
-	return &Handshake{
+	handshake := &Handshake{
 		pstr:     "BitTorrent protocol",
 		InfoHash: infoHash,
 		PeerID:   peerID,
 	}
+	handshake.Reserved.SetBit(ExtensionBit)
+	handshake.Reserved.SetBit(FastBit)
+
+	return handshake
+}
+
+// SetBit sets a reserved bit, counted from the right of the 8 reserved bytes
+func (reserved *Reserved) SetBit(bit int) {
+	if bit < 0 || bit >= 64 {
+		return
+	}
+	reserved[7-bit/8] |= 1 << (bit % 8)
+}
+
+// HasBit tells if a reserved bit is set
+func (reserved Reserved) HasBit(bit int) bool {
+	if bit < 0 || bit >= 64 {
+		return false
+	}
+	return reserved[7-bit/8]>>(bit%8)&1 != 0
+}
+
+// SupportsExtensions tells if the extension protocol bit is set
+func (reserved Reserved) SupportsExtensions() bool {
+	return reserved.HasBit(ExtensionBit)
+}
+
+// SupportsFast tells if the Fast Extension bit is set
+func (reserved Reserved) SupportsFast() bool {
+	return reserved.HasBit(FastBit)
+}
+
+// SupportsV2 tells if the BitTorrent v2 bit is set
+func (reserved Reserved) SupportsV2() bool {
+	return reserved.HasBit(V2Bit)
 }
 
 func (handshake *Handshake) Serialize() []byte {
 	buf := []byte{}
 	buf = append(buf, byte(len(handshake.pstr)))
 	buf = append(buf, handshake.pstr...)
-	buf = append(buf, make([]byte, 8)...)
+	buf = append(buf, handshake.Reserved[:]...)
 	buf = append(buf, handshake.InfoHash[:]...)
 	buf = append(buf, handshake.PeerID[:]...)
 	return buf
@@ -47,12 +96,15 @@ func Read(reader io.Reader) (*Handshake, error) {
 		return &Handshake{}, ok
 	}
 
+	var reserved Reserved
 	var infoHash, peerID [20]byte
+	copy(reserved[:], handshakeResponse[pstrlen:pstrlen+8])
 	copy(infoHash[:], handshakeResponse[pstrlen+8:pstrlen+8+20])
 	copy(peerID[:], handshakeResponse[pstrlen+8+20:])
 
 	h := Handshake{
 		pstr:     string(handshakeResponse[0:pstrlen]),
+		Reserved: reserved,
 		InfoHash: infoHash,
 		PeerID:   peerID,
 	}
@@ -0,0 +1,108 @@
+package merkle
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"math"
+)
+
+// BlockSize is the size of the leaves of the trees of BitTorrent v2 (BEP 52),
+// the last block of a file is hashed as it is
+const BlockSize = 16384
+
+// BlockHashes hashes every block of buf, the leaves of its tree
+func BlockHashes(buf []byte) [][32]byte {
+	hashes := [][32]byte{}
+	for begin := 0; begin < len(buf); begin += BlockSize {
+		end := begin + BlockSize
+		if end > len(buf) {
+			end = len(buf)
+		}
+		hashes = append(hashes, sha256.Sum256(buf[begin:end]))
+	}
+	return hashes
+}
+
+func hashPair(left, right [32]byte) [32]byte {
+	var buf [64]byte
+	copy(buf[:32], left[:])
+	copy(buf[32:], right[:])
+	return sha256.Sum256(buf[:])
+}
+
+// PadHash is the root of a tree of 2^layer leaves that are all zeros, what
+// the trees are padded with past the end of a file
+func PadHash(layer int) [32]byte {
+	var hash [32]byte
+	for i := 0; i < layer; i++ {
+		hash = hashPair(hash, hash)
+	}
+	return hash
+}
+
+// NextPow2 is the smallest power of two that is n or more, or the largest
+// an int holds when n is beyond it
+func NextPow2(n int) int {
+	width := 1
+	for width < n && width <= math.MaxInt/2 {
+		width *= 2
+	}
+	return width
+}
+
+// Log2 is the layer of a tree whose nodes cover n leaves, n a power of two
+func Log2(n int) int {
+	layer := 0
+	for n > 1 {
+		n /= 2
+		layer++
+	}
+	return layer
+}
+
+// Layers builds the tree over hashes, padded to width with pad, from the
+// hashes themselves up to the root
+func Layers(hashes [][32]byte, width int, pad [32]byte) [][][32]byte {
+	layer := make([][32]byte, width)
+	copy(layer, hashes)
+	for i := len(hashes); i < width; i++ {
+		layer[i] = pad
+	}
+
+	layers := [][][32]byte{layer}
+	for len(layer) > 1 {
+		pad = hashPair(pad, pad)
+		next := make([][32]byte, (len(layer)+1)/2)
+		for i := range next {
+			right := pad
+			if 2*i+1 < len(layer) {
+				right = layer[2*i+1]
+			}
+			next[i] = hashPair(layer[2*i], right)
+		}
+		layer = next
+		layers = append(layers, layer)
+	}
+	return layers
+}
+
+// Root is the root of the tree over hashes, padded to width with pad
+func Root(hashes [][32]byte, width int, pad [32]byte) [32]byte {
+	layers := Layers(hashes, width, pad)
+	return layers[len(layers)-1][0]
+}
+
+// Proof lists the uncles of the node at index of the layer, from the bottom
+// up, at most count of them and never the root
+func Proof(layers [][][32]byte, layer, index, count int) ([][32]byte, error) {
+	if layer < 0 || layer >= len(layers) || index < 0 || index >= len(layers[layer]) {
+		return nil, fmt.Errorf("node %d of layer %d is outside the tree", index, layer)
+	}
+
+	proof := [][32]byte{}
+	for ; layer < len(layers)-1 && len(proof) < count; layer++ {
+		proof = append(proof, layers[layer][index^1])
+		index /= 2
+	}
+	return proof, nil
+}
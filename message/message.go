@@ -10,12 +10,21 @@ const (
 	Choke         uint8 = 0
 	Unchoke       uint8 = 1
 	Interested    uint8 = 2
-	notInterested uint8 = 3
+	NotInterested uint8 = 3
 	Have          uint8 = 4
 	BitField      uint8 = 5
 	Request       uint8 = 6
 	Piece         uint8 = 7
 	cancel        uint8 = 8
+	SuggestPiece  uint8 = 13
+	HaveAll       uint8 = 14
+	HaveNone      uint8 = 15
+	RejectRequest uint8 = 16
+	AllowedFast   uint8 = 17
+	Extended      uint8 = 20
+	HashRequest   uint8 = 21
+	Hashes        uint8 = 22
+	HashReject    uint8 = 23
 )
 
 type Message struct {
@@ -66,13 +75,15 @@ func Read(reader io.Reader) (*Message, error) {
 
 // ParsePiece parses a PIECE message and copies its payload into a buffer
 func ParsePiece(index int, buf []byte, msg *Message) (int, error) {
+	if msg.ID != Piece || len(msg.Payload) < 8 {
+		return 0, fmt.Errorf("ParsePiece failed")
+	}
+
 	parsedIndex := int(binary.BigEndian.Uint32(msg.Payload[0:4]))
 	begin := int(binary.BigEndian.Uint32(msg.Payload[4:8]))
 	data := msg.Payload[8:]
 
-	if msg.ID != Piece || len(msg.Payload) < 8 || parsedIndex != index ||
-		begin >= len(buf) || begin+len(data) > len(buf) {
-
+	if parsedIndex != index || begin >= len(buf) || begin+len(data) > len(buf) {
 		return 0, fmt.Errorf("ParsePiece failed")
 	}
 
@@ -89,6 +100,28 @@ func ParseHave(msg *Message) (int, error) {
 	return index, nil
 }
 
+// ParseIndex parses the piece index of a SUGGEST PIECE or ALLOWED FAST message
+func ParseIndex(msg *Message) (int, error) {
+	if (msg.ID != SuggestPiece && msg.ID != AllowedFast) || len(msg.Payload) != 4 {
+		return 0, fmt.Errorf("ParseIndex failed")
+	}
+
+	index := int(binary.BigEndian.Uint32(msg.Payload))
+	return index, nil
+}
+
+// ParseRequest parses a REQUEST or REJECT REQUEST message, they share the same layout
+func ParseRequest(msg *Message) (int, int, int, error) {
+	if (msg.ID != Request && msg.ID != RejectRequest) || len(msg.Payload) != 12 {
+		return 0, 0, 0, fmt.Errorf("ParseRequest failed")
+	}
+
+	index := int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+	begin := int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+	length := int(binary.BigEndian.Uint32(msg.Payload[8:12]))
+	return index, begin, length, nil
+}
+
 func MakeRequest(index, begin, length int) *Message {
 	payload := make([]byte, 12)
 	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
@@ -97,8 +130,119 @@ func MakeRequest(index, begin, length int) *Message {
 	return &Message{ID: Request, Payload: payload}
 }
 
+func MakeReject(index, begin, length int) *Message {
+	msg := MakeRequest(index, begin, length)
+	msg.ID = RejectRequest
+	return msg
+}
+
+// MakePiece wraps a block we send in answer to a request
+func MakePiece(index, begin int, block []byte) *Message {
+	payload := make([]byte, 8+len(block))
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	copy(payload[8:], block)
+	return &Message{ID: Piece, Payload: payload}
+}
+
 func MakeHave(index int) *Message {
 	payload := make([]byte, 4)
 	binary.BigEndian.PutUint32(payload, uint32(index))
 	return &Message{ID: Have, Payload: payload}
 }
+
+// MakeExtended wraps an extension protocol payload, id is the extended message id
+// the receiving peer assigned to the extension (0 for the extended handshake)
+func MakeExtended(id uint8, payload []byte) *Message {
+	buf := make([]byte, 1+len(payload))
+	buf[0] = id
+	copy(buf[1:], payload)
+	return &Message{ID: Extended, Payload: buf}
+}
+
+// ParseExtended splits an EXTENDED message into its extended id and payload
+func ParseExtended(msg *Message) (uint8, []byte, error) {
+	if msg.ID != Extended || len(msg.Payload) < 1 {
+		return 0, nil, fmt.Errorf("ParseExtended failed")
+	}
+
+	return msg.Payload[0], msg.Payload[1:], nil
+}
+
+// HashRange is a run of hashes of a layer of a file's Merkle tree, what
+// hash requests ask for in BitTorrent v2 (BEP 52). Layer 0 is the hashes
+// of the 16 KiB blocks.
+type HashRange struct {
+	PiecesRoot [32]byte
+	BaseLayer  int
+	Index      int
+	Length     int
+	// how many uncles of the hashes to send along, to verify them with
+	ProofLayers int
+}
+
+func (req HashRange) payload(hashes [][32]byte) []byte {
+	payload := make([]byte, 48+32*len(hashes))
+	copy(payload[0:32], req.PiecesRoot[:])
+	binary.BigEndian.PutUint32(payload[32:36], uint32(req.BaseLayer))
+	binary.BigEndian.PutUint32(payload[36:40], uint32(req.Index))
+	binary.BigEndian.PutUint32(payload[40:44], uint32(req.Length))
+	binary.BigEndian.PutUint32(payload[44:48], uint32(req.ProofLayers))
+	for i, hash := range hashes {
+		copy(payload[48+32*i:], hash[:])
+	}
+	return payload
+}
+
+func MakeHashRequest(req HashRange) *Message {
+	return &Message{ID: HashRequest, Payload: req.payload(nil)}
+}
+
+// MakeHashes answers a hash request with the hashes followed by their proof
+func MakeHashes(req HashRange, hashes [][32]byte) *Message {
+	return &Message{ID: Hashes, Payload: req.payload(hashes)}
+}
+
+func MakeHashReject(req HashRange) *Message {
+	return &Message{ID: HashReject, Payload: req.payload(nil)}
+}
+
+// ParseHashRequest parses a HASH REQUEST or HASH REJECT message, they share
+// the same layout
+func ParseHashRequest(msg *Message) (HashRange, error) {
+	if (msg.ID != HashRequest && msg.ID != HashReject) || len(msg.Payload) != 48 {
+		return HashRange{}, fmt.Errorf("ParseHashRequest failed")
+	}
+
+	req, _ := parseHashHeader(msg.Payload)
+	return req, nil
+}
+
+// ParseHashes splits a HASHES message into the request it answers and the
+// hashes with their proof
+func ParseHashes(msg *Message) (HashRange, [][32]byte, error) {
+	if msg.ID != Hashes || len(msg.Payload) < 48 || (len(msg.Payload)-48)%32 != 0 {
+		return HashRange{}, nil, fmt.Errorf("ParseHashes failed")
+	}
+
+	req, hashes := parseHashHeader(msg.Payload)
+	return req, hashes, nil
+}
+
+func parseHashHeader(payload []byte) (HashRange, [][32]byte) {
+	req := HashRange{
+		BaseLayer:   int(binary.BigEndian.Uint32(payload[32:36])),
+		Index:       int(binary.BigEndian.Uint32(payload[36:40])),
+		Length:      int(binary.BigEndian.Uint32(payload[40:44])),
+		ProofLayers: int(binary.BigEndian.Uint32(payload[44:48])),
+	}
+	copy(req.PiecesRoot[:], payload[0:32])
+
+	hashes := [][32]byte{}
+	for offset := 48; offset+32 <= len(payload); offset += 32 {
+		var hash [32]byte
+		copy(hash[:], payload[offset:offset+32])
+		hashes = append(hashes, hash)
+	}
+	return req, hashes
+}
@@ -0,0 +1,27 @@
+package message
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParsePiece(t *testing.T) {
+	buf := make([]byte, 8)
+	msg := &Message{ID: Piece, Payload: []byte{0, 0, 0, 3, 0, 0, 0, 2, 'a', 'b'}}
+	if n, err := ParsePiece(3, buf, msg); err != nil || n != 2 || !bytes.Equal(buf[2:4], []byte("ab")) {
+		t.Errorf("parsed %d bytes into %q, %v", n, buf, err)
+	}
+
+	malformed := map[string]*Message{
+		"an empty payload":     {ID: Piece},
+		"a short header":       {ID: Piece, Payload: []byte{0, 0, 0, 3, 0, 0, 0}},
+		"another message":      {ID: Have, Payload: []byte{0, 0, 0, 3}},
+		"another piece":        {ID: Piece, Payload: []byte{0, 0, 0, 4, 0, 0, 0, 0}},
+		"a block past the end": {ID: Piece, Payload: []byte{0, 0, 0, 3, 0, 0, 0, 7, 'a', 'b'}},
+	}
+	for name, msg := range malformed {
+		if _, err := ParsePiece(3, buf, msg); err == nil {
+			t.Errorf("%s parsed", name)
+		}
+	}
+}
@@ -0,0 +1,402 @@
+package mse
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+	mathrand "math/rand"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Policy decides when peer connections are encrypted
+type Policy int
+
+const (
+	// Prefer encrypts when the other side can, plaintext otherwise
+	Prefer Policy = iota
+	// Require only talks to peers that encrypt
+	Require
+	// Disable never encrypts
+	Disable
+)
+
+// CurrentPolicy is the Policy of outgoing and incoming connections alike,
+// Prefer until the settings change it while peers connect
+var CurrentPolicy atomic.Int32
+
+func (policy Policy) String() string {
+	switch policy {
+	case Require:
+		return "require"
+	case Disable:
+		return "disable"
+	default:
+		return "prefer"
+	}
+}
+
+func ParsePolicy(s string) (Policy, error) {
+	switch strings.ToLower(s) {
+	case "prefer":
+		return Prefer, nil
+	case "require":
+		return Require, nil
+	case "disable":
+		return Disable, nil
+	}
+	return Prefer, fmt.Errorf("unknown encryption policy %q", s)
+}
+
+// crypto_provide and crypto_select bits
+const (
+	CryptoPlaintext uint32 = 0x01
+	CryptoRC4       uint32 = 0x02
+)
+
+var (
+	prime, _  = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+	generator = big.NewInt(2)
+	// verification constant
+	vc = make([]byte, 8)
+)
+
+const (
+	keyLength = 96
+	maxPad    = 512
+)
+
+func keyPair() (*big.Int, []byte, error) {
+	buf := make([]byte, 20)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, nil, err
+	}
+	private := new(big.Int).SetBytes(buf)
+
+	public := new(big.Int).Exp(generator, private, prime)
+	return private, pad(public.Bytes()), nil
+}
+
+// pad left pads a key to the 96 bytes it always takes on the wire
+func pad(key []byte) []byte {
+	buf := make([]byte, keyLength)
+	copy(buf[keyLength-len(key):], key)
+	return buf
+}
+
+func secret(private *big.Int, remote []byte) []byte {
+	y := new(big.Int).SetBytes(remote)
+	return pad(new(big.Int).Exp(y, private, prime).Bytes())
+}
+
+func hash(parts ...[]byte) []byte {
+	h := sha1.New()
+	for _, part := range parts {
+		h.Write(part)
+	}
+	return h.Sum(nil)
+}
+
+func xor(a, b []byte) []byte {
+	buf := make([]byte, len(a))
+	for i := range a {
+		buf[i] = a[i] ^ b[i]
+	}
+	return buf
+}
+
+// newCipher returns RC4 keyed for one direction, with the first 1024
+// bytes of keystream already discarded
+func newCipher(name string, s []byte, skey [20]byte) *rc4.Cipher {
+	cipher, _ := rc4.NewCipher(hash([]byte(name), s, skey[:]))
+	discard := make([]byte, 1024)
+	cipher.XORKeyStream(discard, discard)
+	return cipher
+}
+
+func randomPad() []byte {
+	buf := make([]byte, mathrand.Intn(maxPad+1))
+	rand.Read(buf)
+	return buf
+}
+
+// synchronize reads until marker shows up, giving up once more than limit bytes
+// went by without it
+func synchronize(reader *bufio.Reader, marker []byte, limit int) error {
+	window := make([]byte, 0, len(marker))
+	for read := 0; read < limit+len(marker); read++ {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return err
+		}
+
+		window = append(window, b)
+		if len(window) > len(marker) {
+			window = window[1:]
+		}
+		if bytes.Equal(window, marker) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("mse: couldn't synchronize with the peer")
+}
+
+// Initiate runs the handshake on a connection we opened, for the torrent
+// with info hash skey. provide holds the crypto methods we accept, the
+// returned connection uses the one the peer picked.
+func Initiate(conn net.Conn, skey [20]byte, provide uint32) (net.Conn, error) {
+	reader := bufio.NewReader(conn)
+
+	private, public, err := keyPair()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := conn.Write(append(public, randomPad()...)); err != nil {
+		return nil, err
+	}
+
+	remote := make([]byte, keyLength)
+	if _, err := io.ReadFull(reader, remote); err != nil {
+		return nil, err
+	}
+	s := secret(private, remote)
+
+	encrypt := newCipher("keyA", s, skey)
+	decrypt := newCipher("keyB", s, skey)
+
+	// VC, crypto_provide, len(PadC) and len(IA), both pads are left empty
+	buf := append([]byte{}, vc...)
+	buf = binary.BigEndian.AppendUint32(buf, provide)
+	buf = binary.BigEndian.AppendUint16(buf, 0)
+	buf = binary.BigEndian.AppendUint16(buf, 0)
+	encrypt.XORKeyStream(buf, buf)
+
+	req := append(hash([]byte("req1"), s), xor(hash([]byte("req2"), skey[:]), hash([]byte("req3"), s))...)
+	if _, err := conn.Write(append(req, buf...)); err != nil {
+		return nil, err
+	}
+
+	// the peer's encrypted VC follows its random pad, the keystream tells us what it looks like
+	marker := make([]byte, len(vc))
+	newCipher("keyB", s, skey).XORKeyStream(marker, vc)
+	if err := synchronize(reader, marker, maxPad); err != nil {
+		return nil, err
+	}
+	decrypt.XORKeyStream(make([]byte, len(vc)), marker)
+
+	// crypto_select and len(PadD)
+	header := make([]byte, 6)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	decrypt.XORKeyStream(header, header)
+
+	selected := binary.BigEndian.Uint32(header[:4])
+	padD := make([]byte, binary.BigEndian.Uint16(header[4:]))
+	if len(padD) > maxPad {
+		return nil, fmt.Errorf("mse: pad too long")
+	}
+	if _, err := io.ReadFull(reader, padD); err != nil {
+		return nil, err
+	}
+	decrypt.XORKeyStream(padD, padD)
+
+	switch {
+	case selected == CryptoRC4 && provide&CryptoRC4 != 0:
+		return newRC4Conn(conn, reader, encrypt, decrypt), nil
+	case selected == CryptoPlaintext && provide&CryptoPlaintext != 0:
+		return &readerConn{Conn: conn, reader: reader}, nil
+	}
+
+	return nil, fmt.Errorf("mse: peer selected unsupported crypto %d", selected)
+}
+
+// Receive runs the handshake on a connection a peer opened to us. skeys
+// are the info hashes we serve, the peer's choice among them is returned
+// along with the connection.
+func Receive(conn net.Conn, reader *bufio.Reader, skeys [][20]byte, policy Policy) (net.Conn, [20]byte, error) {
+	var skey [20]byte
+
+	remote := make([]byte, keyLength)
+	if _, err := io.ReadFull(reader, remote); err != nil {
+		return nil, skey, err
+	}
+
+	private, public, err := keyPair()
+	if err != nil {
+		return nil, skey, err
+	}
+
+	if _, err := conn.Write(append(public, randomPad()...)); err != nil {
+		return nil, skey, err
+	}
+	s := secret(private, remote)
+
+	if err := synchronize(reader, hash([]byte("req1"), s), maxPad); err != nil {
+		return nil, skey, err
+	}
+
+	req := make([]byte, 20)
+	if _, err := io.ReadFull(reader, req); err != nil {
+		return nil, skey, err
+	}
+	req2 := xor(req, hash([]byte("req3"), s))
+
+	found := false
+	for _, candidate := range skeys {
+		if bytes.Equal(req2, hash([]byte("req2"), candidate[:])) {
+			skey, found = candidate, true
+			break
+		}
+	}
+	if !found {
+		return nil, skey, fmt.Errorf("mse: peer asked for a torrent we don't have")
+	}
+
+	decrypt := newCipher("keyA", s, skey)
+	encrypt := newCipher("keyB", s, skey)
+
+	// VC, crypto_provide and len(PadC)
+	header := make([]byte, 14)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, skey, err
+	}
+	decrypt.XORKeyStream(header, header)
+
+	if !bytes.Equal(header[:8], vc) {
+		return nil, skey, fmt.Errorf("mse: bad verification constant")
+	}
+	provide := binary.BigEndian.Uint32(header[8:12])
+
+	padC := make([]byte, binary.BigEndian.Uint16(header[12:]))
+	if len(padC) > maxPad {
+		return nil, skey, fmt.Errorf("mse: pad too long")
+	}
+	if _, err := io.ReadFull(reader, padC); err != nil {
+		return nil, skey, err
+	}
+	decrypt.XORKeyStream(padC, padC)
+
+	lengthIA := make([]byte, 2)
+	if _, err := io.ReadFull(reader, lengthIA); err != nil {
+		return nil, skey, err
+	}
+	decrypt.XORKeyStream(lengthIA, lengthIA)
+
+	// the initial payload is encrypted whatever gets selected
+	ia := make([]byte, binary.BigEndian.Uint16(lengthIA))
+	if _, err := io.ReadFull(reader, ia); err != nil {
+		return nil, skey, err
+	}
+	decrypt.XORKeyStream(ia, ia)
+
+	var selected uint32
+	switch {
+	case provide&CryptoRC4 != 0 && policy != Disable:
+		selected = CryptoRC4
+	case provide&CryptoPlaintext != 0 && policy != Require:
+		selected = CryptoPlaintext
+	default:
+		return nil, skey, fmt.Errorf("mse: no crypto method both sides accept")
+	}
+
+	buf := append([]byte{}, vc...)
+	buf = binary.BigEndian.AppendUint32(buf, selected)
+	buf = binary.BigEndian.AppendUint16(buf, 0)
+	encrypt.XORKeyStream(buf, buf)
+	if _, err := conn.Write(buf); err != nil {
+		return nil, skey, err
+	}
+
+	if selected == CryptoRC4 {
+		c := newRC4Conn(conn, reader, encrypt, decrypt)
+		c.pending = ia
+		return c, skey, nil
+	}
+
+	return &readerConn{Conn: conn, reader: io.MultiReader(bytes.NewReader(ia), reader)}, skey, nil
+}
+
+// readerConn reads through a reader that may hold bytes already taken off the connection
+type readerConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *readerConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// rc4Conn encrypts everything written and decrypts everything read
+type rc4Conn struct {
+	net.Conn
+	reader  io.Reader
+	decrypt *rc4.Cipher
+	// already decrypted bytes to hand out first
+	pending []byte
+
+	// writes come from more than one goroutine and the keystream has to
+	// be used in the order the bytes hit the wire
+	mu      sync.Mutex
+	encrypt *rc4.Cipher
+}
+
+func newRC4Conn(conn net.Conn, reader io.Reader, encrypt, decrypt *rc4.Cipher) *rc4Conn {
+	return &rc4Conn{Conn: conn, reader: reader, encrypt: encrypt, decrypt: decrypt}
+}
+
+func (c *rc4Conn) Read(b []byte) (int, error) {
+	if len(c.pending) > 0 {
+		n := copy(b, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+
+	n, err := c.reader.Read(b)
+	c.decrypt.XORKeyStream(b[:n], b[:n])
+	return n, err
+}
+
+func (c *rc4Conn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	buf := make([]byte, len(b))
+	c.encrypt.XORKeyStream(buf, b)
+	return c.Conn.Write(buf)
+}
+
+// BufferedConn lets the listener peek at the first bytes of a connection to
+// tell a plaintext handshake from an encrypted one
+type BufferedConn struct {
+	net.Conn
+	Reader *bufio.Reader
+}
+
+func NewBufferedConn(conn net.Conn) *BufferedConn {
+	return &BufferedConn{Conn: conn, Reader: bufio.NewReader(conn)}
+}
+
+func (c *BufferedConn) Read(b []byte) (int, error) {
+	return c.Reader.Read(b)
+}
+
+// IsPlaintext tells if the connection starts with a plain BitTorrent handshake
+func (c *BufferedConn) IsPlaintext() (bool, error) {
+	header, err := c.Reader.Peek(20)
+	if err != nil {
+		return false, err
+	}
+
+	return header[0] == 19 && string(header[1:20]) == "BitTorrent protocol", nil
+}
@@ -0,0 +1,198 @@
+package mse
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+var infoHash = [20]byte{1, 2, 3}
+
+// hello stands in for the BitTorrent handshake that follows the encryption
+// handshake
+var hello = append([]byte("\x13BitTorrent protocol"), make([]byte, 48)...)
+
+// listen answers a connection the way the listener does under policy, and
+// echoes the handshake back once it arrived
+func listen(conn net.Conn, policy Policy) error {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	buffered := NewBufferedConn(conn)
+	plaintext, err := buffered.IsPlaintext()
+	if err != nil {
+		return err
+	}
+
+	var peer net.Conn = buffered
+	switch {
+	case plaintext && policy == Require:
+		return fmt.Errorf("plaintext connection refused")
+	case !plaintext && policy == Disable:
+		return fmt.Errorf("encrypted connection refused")
+	case !plaintext:
+		var skey [20]byte
+		peer, skey, err = Receive(buffered, buffered.Reader, [][20]byte{{9}, infoHash}, policy)
+		if err != nil {
+			return err
+		}
+		if skey != infoHash {
+			return fmt.Errorf("the peer asked for %x", skey)
+		}
+	}
+
+	buf := make([]byte, len(hello))
+	if _, err := io.ReadFull(peer, buf); err != nil {
+		return err
+	}
+	_, err = peer.Write(buf)
+	return err
+}
+
+// dial connects the way peers are dialed under one policy to a listener
+// under the other, falling back to plaintext on a fresh connection where
+// the policy allows. It tells if the connection ended up encrypted.
+func dial(t *testing.T, dialing, listening Policy) (bool, error) {
+	t.Helper()
+
+	attempt := func(encrypt bool) (bool, error) {
+		local, remote := net.Pipe()
+		defer local.Close()
+		go listen(remote, listening)
+		local.SetDeadline(time.Now().Add(5 * time.Second))
+
+		var conn net.Conn = local
+		if encrypt {
+			provide := CryptoRC4
+			if dialing == Prefer {
+				provide |= CryptoPlaintext
+			}
+
+			var err error
+			conn, err = Initiate(local, infoHash, provide)
+			if err != nil {
+				return false, err
+			}
+		}
+
+		if _, err := conn.Write(hello); err != nil {
+			return false, err
+		}
+		buf := make([]byte, len(hello))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return false, err
+		}
+		if !bytes.Equal(buf, hello) {
+			return false, fmt.Errorf("sent %x, got %x back", hello, buf)
+		}
+
+		_, encrypted := conn.(*rc4Conn)
+		return encrypted, nil
+	}
+
+	if dialing == Disable {
+		return attempt(false)
+	}
+	encrypted, err := attempt(true)
+	if err != nil && dialing == Prefer {
+		return attempt(false)
+	}
+	return encrypted, err
+}
+
+func TestPolicies(t *testing.T) {
+	const (
+		rc4 = iota
+		plaintext
+		refused
+	)
+	outcomes := []struct {
+		dialing, listening Policy
+		want               int
+	}{
+		{Prefer, Prefer, rc4},
+		{Prefer, Require, rc4},
+		{Prefer, Disable, plaintext},
+		{Require, Prefer, rc4},
+		{Require, Require, rc4},
+		{Require, Disable, refused},
+		{Disable, Prefer, plaintext},
+		{Disable, Require, refused},
+		{Disable, Disable, plaintext},
+	}
+
+	for _, o := range outcomes {
+		encrypted, err := dial(t, o.dialing, o.listening)
+		switch {
+		case o.want == refused && err == nil:
+			t.Errorf("%s to %s: connected", o.dialing, o.listening)
+		case o.want != refused && err != nil:
+			t.Errorf("%s to %s: %v", o.dialing, o.listening, err)
+		case err == nil && encrypted != (o.want == rc4):
+			t.Errorf("%s to %s: encrypted %t", o.dialing, o.listening, encrypted)
+		}
+	}
+}
+
+func TestReceive(t *testing.T) {
+	handshakes := []struct {
+		name    string
+		provide uint32
+		skeys   [][20]byte
+		policy  Policy
+	}{
+		{"a peer that only takes plaintext", CryptoPlaintext, [][20]byte{infoHash}, Require},
+		{"a peer that only takes RC4", CryptoRC4, [][20]byte{infoHash}, Disable},
+		{"a torrent we don't have", CryptoRC4, [][20]byte{{9}}, Prefer},
+	}
+
+	for _, h := range handshakes {
+		local, remote := net.Pipe()
+		local.SetDeadline(time.Now().Add(5 * time.Second))
+		remote.SetDeadline(time.Now().Add(5 * time.Second))
+
+		go func() {
+			buffered := NewBufferedConn(remote)
+			Receive(buffered, buffered.Reader, h.skeys, h.policy)
+			remote.Close()
+		}()
+		if _, err := Initiate(local, infoHash, h.provide); err == nil {
+			t.Errorf("%s: connected", h.name)
+		}
+		local.Close()
+	}
+}
+
+// the listener peeks at a plaintext handshake, none of it may go missing
+func TestBufferedConn(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	remote.SetDeadline(time.Now().Add(5 * time.Second))
+
+	sent := append(append([]byte{}, hello...), "bitfield"...)
+	go local.Write(sent)
+
+	buffered := NewBufferedConn(remote)
+	plaintext, err := buffered.IsPlaintext()
+	if err != nil || !plaintext {
+		t.Fatalf("plaintext %t, %v", plaintext, err)
+	}
+
+	buf := make([]byte, len(sent))
+	if _, err := io.ReadFull(buffered, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, sent) {
+		t.Errorf("read %q", buf)
+	}
+
+	// an encrypted handshake starts with a key, which isn't one
+	go local.Write(make([]byte, keyLength))
+	if plaintext, err := buffered.IsPlaintext(); err != nil || plaintext {
+		t.Errorf("a key read as plaintext %t, %v", plaintext, err)
+	}
+}
@@ -2,6 +2,7 @@ package peer
 
 import (
 	"encoding/binary"
+	"fmt"
 	"net"
 	"strconv"
 )
@@ -9,28 +10,87 @@ import (
 type Peer struct {
 	ip   net.IP
 	port uint16
+	// info hash of the swarm the peer was found in, zero when unknown
+	swarm [20]byte
 }
 
+// New keeps IPv4 addresses in their 4 byte form, even when they arrive
+// mapped into IPv6 from a dual stack socket
 func New(ip net.IP, port uint16) *Peer {
-	return &Peer{ip, port}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return &Peer{ip: ip, port: port}
 }
 
-func Deserialize(peersBinary []byte) []Peer {
-	// Extract peers from binary, 6 bytes for each peer
+// Deserialize extracts peers from the compact IPv4 form, 6 bytes for each
+// peer, 4 for the ip and 2 for the port
+func Deserialize(peersBinary []byte) ([]Peer, error) {
+	return deserialize(peersBinary, net.IPv4len)
+}
 
-	if len(peersBinary)%6 != 0 {
-		panic("Peers binary length is not multiple of 6 bytes (4 for ip 2 for port)")
+// Deserialize6 extracts peers from the compact IPv6 form, 18 bytes for each
+// peer, 16 for the ip and 2 for the port
+func Deserialize6(peersBinary []byte) ([]Peer, error) {
+	return deserialize(peersBinary, net.IPv6len)
+}
+
+func deserialize(peersBinary []byte, ipLength int) ([]Peer, error) {
+	size := ipLength + 2
+	if len(peersBinary)%size != 0 {
+		return nil, fmt.Errorf("peers binary length %d is not a multiple of %d bytes",
+			len(peersBinary), size)
 	}
 
 	peers := []Peer{}
-	for i, offset := 0, 0; i < len(peersBinary)/6; i, offset = i+1, i*6 {
-		newPeer := New(net.IP(peersBinary[offset:offset+4]),
-			binary.BigEndian.Uint16([]byte(peersBinary[offset+4:offset+6])))
+	for offset := 0; offset < len(peersBinary); offset += size {
+		ip := make(net.IP, ipLength)
+		copy(ip, peersBinary[offset:offset+ipLength])
+		port := binary.BigEndian.Uint16(peersBinary[offset+ipLength : offset+size])
+
+		// nobody listens on port 0
+		if port == 0 {
+			continue
+		}
 
-		peers = append(peers, *newPeer)
+		peers = append(peers, *New(ip, port))
 	}
 
-	return peers
+	return peers, nil
+}
+
+// Serialize returns the compact form of the peer, 6 bytes for IPv4 and 18
+// for IPv6
+func (peer Peer) Serialize() []byte {
+	ip := peer.ip.To16()
+	if peer.IsIPv4() {
+		ip = peer.ip.To4()
+	}
+
+	return binary.BigEndian.AppendUint16(append([]byte{}, ip...), peer.port)
+}
+
+func (peer Peer) IsIPv4() bool {
+	return peer.ip.To4() != nil
+}
+
+func (peer Peer) IP() net.IP {
+	return peer.ip
+}
+
+func (peer Peer) Port() uint16 {
+	return peer.port
+}
+
+// InSwarm tags the peer with the info hash of the swarm it was found in,
+// hybrid torrents are in two swarms and a peer only knows its own
+func (peer Peer) InSwarm(infoHash [20]byte) Peer {
+	peer.swarm = infoHash
+	return peer
+}
+
+func (peer Peer) Swarm() [20]byte {
+	return peer.swarm
 }
 
 func (peer Peer) String(iponly bool) string {
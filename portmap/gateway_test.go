@@ -0,0 +1,338 @@
+package portmap
+
+import (
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const deviceXML = `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+<device>
+	<deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+	<deviceList><device>
+		<deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+		<serviceList><service>
+			<serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType>
+			<controlURL> /control </controlURL>
+		</service></serviceList>
+	</device></deviceList>
+</device>
+</root>`
+
+// upnpGateway answers SSDP searches and the SOAP calls of WANIPConnection,
+// and like many routers only takes permanent mappings
+type upnpGateway struct {
+	ssdp net.PacketConn
+	http *httptest.Server
+
+	mu       sync.Mutex
+	mappings map[string]string
+}
+
+func newUPnPGateway(t *testing.T) *upnpGateway {
+	g := &upnpGateway{mappings: map[string]string{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/device.xml", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, deviceXML)
+	})
+	mux.HandleFunc("/control", g.control)
+	g.http = httptest.NewServer(mux)
+	t.Cleanup(g.http.Close)
+
+	ssdp, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ssdp.Close() })
+	g.ssdp = ssdp
+
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := ssdp.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if !strings.HasPrefix(string(buf[:n]), "M-SEARCH") {
+				continue
+			}
+			ssdp.WriteTo([]byte("HTTP/1.1 200 OK\r\n"+
+				"ST: urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\n"+
+				"Location: "+g.http.URL+"/device.xml\r\n\r\n"), addr)
+		}
+	}()
+
+	return g
+}
+
+func (g *upnpGateway) control(w http.ResponseWriter, r *http.Request) {
+	var call struct {
+		Body struct {
+			Action struct {
+				XMLName  xml.Name
+				Port     string `xml:"NewExternalPort"`
+				Protocol string `xml:"NewProtocol"`
+				Client   string `xml:"NewInternalClient"`
+				Lease    string `xml:"NewLeaseDuration"`
+			} `xml:",any"`
+		}
+	}
+	if err := xml.NewDecoder(r.Body).Decode(&call); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	action := call.Body.Action
+	if !strings.HasSuffix(r.Header.Get("SOAPAction"), "#"+action.XMLName.Local+`"`) {
+		http.Error(w, "SOAPAction doesn't match the body", http.StatusBadRequest)
+		return
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	key := action.Protocol + "/" + action.Port
+	switch action.XMLName.Local {
+	case "AddPortMapping":
+		if action.Lease != "0" {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body>`+
+				`<s:Fault><detail><UPnPError><errorCode>%d</errorCode>`+
+				`<errorDescription>OnlyPermanentLeasesSupported</errorDescription></UPnPError>`+
+				`</detail></s:Fault></s:Body></s:Envelope>`, errOnlyPermanentLeases)
+			return
+		}
+		g.mappings[key] = action.Client
+	case "DeletePortMapping":
+		delete(g.mappings, key)
+	case "GetExternalIPAddress":
+		io.WriteString(w, `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body>`+
+			`<u:GetExternalIPAddressResponse><NewExternalIPAddress>203.0.113.7</NewExternalIPAddress>`+
+			`</u:GetExternalIPAddressResponse></s:Body></s:Envelope>`)
+		return
+	default:
+		http.Error(w, "unknown action", http.StatusInternalServerError)
+		return
+	}
+	io.WriteString(w, `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body/></s:Envelope>`)
+}
+
+func (g *upnpGateway) forwarded() map[string]string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	mappings := map[string]string{}
+	for key, client := range g.mappings {
+		mappings[key] = client
+	}
+	return mappings
+}
+
+func TestUPnP(t *testing.T) {
+	g := newUPnPGateway(t)
+
+	upnp, err := DiscoverUPnP(g.ssdp.LocalAddr().String(), 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if upnp.ControlURL != g.http.URL+"/control" || upnp.ServiceType != wanServices[1] {
+		t.Fatalf("found %s at %s", upnp.ServiceType, upnp.ControlURL)
+	}
+
+	f := NewForwarder()
+	f.Discover = func() (Mapper, error) { return upnp, nil }
+	f.port = 6881
+	f.refresh()
+
+	// the gateway refused the lease, so the mappings are permanent
+	status := f.Status()
+	if status.Method != "upnp" || status.ExternalIP != "203.0.113.7" || status.Error != "" {
+		t.Fatalf("status %+v", status)
+	}
+	if len(status.Mappings) != 2 || status.Mappings[0].Expires != nil || status.Mappings[1].Expires != nil {
+		t.Errorf("mappings %+v", status.Mappings)
+	}
+	mappings := g.forwarded()
+	if len(mappings) != 2 || mappings["TCP/6881"] != "127.0.0.1" || mappings["UDP/6881"] != "127.0.0.1" {
+		t.Errorf("the gateway forwards %v", mappings)
+	}
+
+	f.Close()
+	if mappings := g.forwarded(); len(mappings) != 0 {
+		t.Errorf("the gateway still forwards %v after Close", mappings)
+	}
+}
+
+// pmpGateway answers PCP, or only NAT-PMP when legacy. It hands out
+// external ports 1000 above the ones asked for and leases of at most
+// maxLease.
+type pmpGateway struct {
+	conn     net.PacketConn
+	legacy   bool
+	maxLease uint32
+
+	mu       sync.Mutex
+	mappings map[string]uint32
+}
+
+func newPMPGateway(t *testing.T, legacy bool) *pmpGateway {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	g := &pmpGateway{conn: conn, legacy: legacy, maxLease: 600, mappings: map[string]uint32{}}
+	go func() {
+		buf := make([]byte, 1100)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if resp := g.answer(buf[:n]); resp != nil {
+				conn.WriteTo(resp, addr)
+			}
+		}
+	}()
+	return g
+}
+
+func (g *pmpGateway) addr() *net.UDPAddr {
+	return g.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// grant records a mapping, a lease of 0 deletes it
+func (g *pmpGateway) grant(protocol string, internal uint16, lease uint32) uint32 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	key := fmt.Sprintf("%s/%d", protocol, internal)
+	if lease == 0 {
+		delete(g.mappings, key)
+		return 0
+	}
+	lease = min(lease, g.maxLease)
+	g.mappings[key] = lease
+	return lease
+}
+
+func (g *pmpGateway) answer(req []byte) []byte {
+	if len(req) < 2 {
+		return nil
+	}
+
+	if req[0] == pcpVersion && g.legacy {
+		// NAT-PMP answers with its own version and unsupported version
+		return []byte{pmpVersion, req[1] | 0x80, 0, resultUnsupportedVersion}
+	}
+
+	if req[0] == pmpVersion {
+		resp := []byte{pmpVersion, req[1] | 0x80, 0, 0, 0, 0, 0, 1}
+		switch req[1] {
+		case pmpExternalAddress:
+			return append(resp, 203, 0, 113, 9)
+		case pmpMapTCP, pmpMapUDP:
+			protocol := "TCP"
+			if req[1] == pmpMapUDP {
+				protocol = "UDP"
+			}
+			internal := binary.BigEndian.Uint16(req[4:6])
+			lease := g.grant(protocol, internal, binary.BigEndian.Uint32(req[8:12]))
+			external := uint16(0)
+			if lease > 0 {
+				external = binary.BigEndian.Uint16(req[6:8]) + 1000
+			}
+			resp = append(resp, req[4:6]...)
+			resp = binary.BigEndian.AppendUint16(resp, external)
+			return binary.BigEndian.AppendUint32(resp, lease)
+		}
+		return nil
+	}
+
+	resp := make([]byte, pcpHeaderSize)
+	resp[0], resp[1] = pcpVersion, req[1]|0x80
+	switch req[1] {
+	case pcpAnnounce:
+		return resp
+	case pcpMap:
+		if len(req) < pcpHeaderSize+pcpMapSize {
+			return nil
+		}
+		body := req[pcpHeaderSize:]
+		protocol := "TCP"
+		if body[12] == 17 {
+			protocol = "UDP"
+		}
+		internal := binary.BigEndian.Uint16(body[16:18])
+		lease := g.grant(protocol, internal, binary.BigEndian.Uint32(req[4:8]))
+		binary.BigEndian.PutUint32(resp[4:], lease)
+
+		// the nonce, protocol and internal port come back as they were
+		resp = append(resp, body[:18]...)
+		resp = binary.BigEndian.AppendUint16(resp, binary.BigEndian.Uint16(body[18:20])+1000)
+		return append(resp, net.IPv4(203, 0, 113, 9).To16()...)
+	}
+	return nil
+}
+
+func (g *pmpGateway) forwarded() map[string]uint32 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	mappings := map[string]uint32{}
+	for key, lease := range g.mappings {
+		mappings[key] = lease
+	}
+	return mappings
+}
+
+func TestPMP(t *testing.T) {
+	for _, legacy := range []bool{false, true} {
+		g := newPMPGateway(t, legacy)
+		want := map[bool]string{false: "pcp", true: "natpmp"}[legacy]
+
+		pmp, err := DiscoverPMP(g.addr())
+		if err != nil {
+			t.Fatalf("%s: %v", want, err)
+		}
+		if pmp.Name() != want {
+			t.Errorf("a %s gateway was taken for %s", want, pmp.Name())
+		}
+
+		f := NewForwarder()
+		f.Discover = func() (Mapper, error) { return pmp, nil }
+		f.port = 6881
+		if renew := f.refresh(); renew != 300*time.Second {
+			t.Errorf("%s: renewing after %v, half the granted lease is 5m", want, renew)
+		}
+
+		status := f.Status()
+		if status.ExternalIP != "203.0.113.9" || status.Error != "" || len(status.Mappings) != 2 {
+			t.Fatalf("%s: status %+v", want, status)
+		}
+		for _, mapping := range status.Mappings {
+			if mapping.ExternalPort != 7881 || mapping.Expires == nil {
+				t.Errorf("%s: mapping %+v", want, mapping)
+			}
+		}
+
+		// renewals ask for the external port the gateway gave us
+		f.refresh()
+		if port := f.Status().Mappings[0].ExternalPort; port != 8881 {
+			t.Errorf("%s: renewed to external port %d", want, port)
+		}
+
+		f.Close()
+		if mappings := g.forwarded(); len(mappings) != 0 {
+			t.Errorf("%s: the gateway still forwards %v after Close", want, mappings)
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package portmap
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// PMPPort is where gateways listen for PCP and NAT-PMP requests
+const PMPPort = 5351
+
+const (
+	pmpVersion = 0
+	pcpVersion = 2
+
+	// NAT-PMP opcodes, answers add 128
+	pmpExternalAddress = 0
+	pmpMapUDP          = 1
+	pmpMapTCP          = 2
+
+	// PCP opcodes, answers set the top bit
+	pcpAnnounce = 0
+	pcpMap      = 1
+
+	pcpHeaderSize = 24
+	pcpMapSize    = 36
+
+	// result codes both protocols share
+	resultSuccess            = 0
+	resultUnsupportedVersion = 1
+
+	// first resend after this, doubling each time as RFC 6886 asks
+	pmpInitialWait = 250 * time.Millisecond
+	pmpRetries     = 4
+)
+
+var errUnsupportedVersion = errors.New("gateway doesn't speak PCP")
+
+// PMP forwards ports with PCP, or NAT-PMP on gateways that only know the
+// older protocol
+type PMP struct {
+	Gateway *net.UDPAddr
+
+	mu sync.Mutex
+	// the gateway only speaks NAT-PMP
+	legacy bool
+	// external address the last PCP mapping reported
+	external net.IP
+	// PCP renewals and deletes have to repeat the nonce of the mapping
+	nonces map[string][]byte
+}
+
+// DiscoverPMP checks that gateway answers PCP or NAT-PMP requests
+func DiscoverPMP(gateway *net.UDPAddr) (*PMP, error) {
+	pmp := &PMP{Gateway: gateway, nonces: map[string][]byte{}}
+
+	_, err := pmp.call(func(local net.IP) []byte {
+		return pcpHeader(pcpAnnounce, 0, local)
+	}, pcpHeaderSize)
+
+	if errors.Is(err, errUnsupportedVersion) {
+		pmp.legacy = true
+		_, err = pmp.ExternalIP()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return pmp, nil
+}
+
+func (pmp *PMP) Name() string {
+	pmp.mu.Lock()
+	defer pmp.mu.Unlock()
+
+	if pmp.legacy {
+		return "natpmp"
+	}
+	return "pcp"
+}
+
+// call sends the request build returns to the gateway, resending it until an
+// answer of at least size bytes arrives. build gets our address on the way
+// to the gateway, which PCP requests carry.
+func (pmp *PMP) call(build func(local net.IP) []byte, size int) ([]byte, error) {
+	conn, err := net.DialUDP("udp", nil, pmp.Gateway)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	req := build(conn.LocalAddr().(*net.UDPAddr).IP)
+	buf := make([]byte, 1100)
+
+	wait := pmpInitialWait
+	for try := 0; try < pmpRetries; try++ {
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+
+		conn.SetReadDeadline(time.Now().Add(wait))
+		n, err := conn.Read(buf)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				wait *= 2
+				continue
+			}
+			return nil, err
+		}
+
+		// a NAT-PMP gateway answers PCP requests in its own version
+		if req[0] == pcpVersion && n >= 4 && buf[0] == pmpVersion {
+			return nil, errUnsupportedVersion
+		}
+		if n < size {
+			return nil, fmt.Errorf("short answer from the gateway")
+		}
+		if buf[1] != req[1]|0x80 {
+			return nil, fmt.Errorf("gateway answered opcode %d to %d", buf[1]&0x7f, req[1])
+		}
+
+		var result int
+		if buf[0] == pcpVersion {
+			result = int(buf[3])
+		} else {
+			result = int(binary.BigEndian.Uint16(buf[2:4]))
+		}
+		if result == resultUnsupportedVersion && req[0] == pcpVersion {
+			return nil, errUnsupportedVersion
+		}
+		if result != resultSuccess {
+			return nil, fmt.Errorf("gateway refused the request with result %d", result)
+		}
+
+		return buf[:n], nil
+	}
+
+	return nil, fmt.Errorf("gateway %s didn't answer", pmp.Gateway)
+}
+
+// pcpHeader builds the common header of a PCP request
+func pcpHeader(opcode byte, lifetime uint32, local net.IP) []byte {
+	buf := make([]byte, pcpHeaderSize)
+	buf[0] = pcpVersion
+	buf[1] = opcode
+	binary.BigEndian.PutUint32(buf[4:], lifetime)
+	copy(buf[8:], local.To16())
+	return buf
+}
+
+func (pmp *PMP) ExternalIP() (net.IP, error) {
+	pmp.mu.Lock()
+	legacy, external := pmp.legacy, pmp.external
+	pmp.mu.Unlock()
+
+	// PCP has no request for it, mappings report it
+	if !legacy {
+		if external == nil {
+			return nil, fmt.Errorf("no external address reported yet")
+		}
+		return external, nil
+	}
+
+	resp, err := pmp.call(func(net.IP) []byte {
+		return []byte{pmpVersion, pmpExternalAddress}
+	}, 12)
+	if err != nil {
+		return nil, err
+	}
+
+	return net.IP(resp[8:12]), nil
+}
+
+func (pmp *PMP) AddPortMapping(protocol string, internalPort, externalPort int,
+	lease time.Duration) (int, time.Duration, error) {
+
+	pmp.mu.Lock()
+	legacy := pmp.legacy
+	pmp.mu.Unlock()
+
+	if legacy {
+		return pmp.mapPMP(protocol, internalPort, externalPort, lease)
+	}
+	return pmp.mapPCP(protocol, internalPort, externalPort, lease)
+}
+
+func (pmp *PMP) DeletePortMapping(protocol string, internalPort, externalPort int) error {
+	var err error
+	if pmp.Name() == "natpmp" {
+		// deleting takes a lifetime and an external port of 0
+		_, _, err = pmp.mapPMP(protocol, internalPort, 0, 0)
+	} else {
+		_, _, err = pmp.mapPCP(protocol, internalPort, externalPort, 0)
+	}
+	return err
+}
+
+func (pmp *PMP) mapPMP(protocol string, internalPort, externalPort int,
+	lease time.Duration) (int, time.Duration, error) {
+
+	opcode := byte(pmpMapTCP)
+	if protocol == "UDP" {
+		opcode = pmpMapUDP
+	}
+
+	resp, err := pmp.call(func(net.IP) []byte {
+		buf := []byte{pmpVersion, opcode, 0, 0}
+		buf = binary.BigEndian.AppendUint16(buf, uint16(internalPort))
+		buf = binary.BigEndian.AppendUint16(buf, uint16(externalPort))
+		return binary.BigEndian.AppendUint32(buf, uint32(lease.Seconds()))
+	}, 16)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	external := int(binary.BigEndian.Uint16(resp[10:12]))
+	granted := time.Duration(binary.BigEndian.Uint32(resp[12:16])) * time.Second
+	return external, granted, nil
+}
+
+func (pmp *PMP) mapPCP(protocol string, internalPort, externalPort int,
+	lease time.Duration) (int, time.Duration, error) {
+
+	number := byte(6)
+	if protocol == "UDP" {
+		number = 17
+	}
+
+	key := fmt.Sprintf("%s/%d", protocol, internalPort)
+	pmp.mu.Lock()
+	nonce, ok := pmp.nonces[key]
+	if !ok {
+		nonce = make([]byte, 12)
+		rand.Read(nonce)
+		pmp.nonces[key] = nonce
+	}
+	pmp.mu.Unlock()
+
+	resp, err := pmp.call(func(local net.IP) []byte {
+		buf := pcpHeader(pcpMap, uint32(lease.Seconds()), local)
+		buf = append(buf, nonce...)
+		buf = append(buf, number, 0, 0, 0)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(internalPort))
+		buf = binary.BigEndian.AppendUint16(buf, uint16(externalPort))
+		// no preference for the external address, the IPv4 unspecified one
+		return append(buf, net.IPv4zero.To16()...)
+	}, pcpHeaderSize+pcpMapSize)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	granted := time.Duration(binary.BigEndian.Uint32(resp[4:8])) * time.Second
+	body := resp[pcpHeaderSize:]
+	external := int(binary.BigEndian.Uint16(body[18:20]))
+
+	pmp.mu.Lock()
+	if lease > 0 {
+		pmp.external = net.IP(append([]byte{}, body[20:36]...))
+	} else {
+		delete(pmp.nonces, key)
+	}
+	pmp.mu.Unlock()
+
+	return external, granted, nil
+}
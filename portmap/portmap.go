@@ -0,0 +1,295 @@
+package portmap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/johneliades/flash/proxy"
+)
+
+const (
+	// lease we ask for, mappings are renewed halfway through
+	leaseDuration = time.Hour
+	// how often mappings the gateway made permanent are checked anyway,
+	// in case it rebooted and forgot them
+	permanentRenewal = 20 * time.Minute
+	// wait before looking for a gateway again after failing to
+	retryInterval = 5 * time.Minute
+)
+
+// errProxied is the status while a proxy is in use, a forwarded port would
+// tell peers the address the proxy hides
+var errProxied = fmt.Errorf("port forwarding is off while a proxy is in use")
+
+// Mapper forwards ports on a gateway, over UPnP IGD or PCP/NAT-PMP
+type Mapper interface {
+	// Name is the protocol in use: upnp, pcp or natpmp
+	Name() string
+	ExternalIP() (net.IP, error)
+	// AddPortMapping forwards externalPort to internalPort on this machine,
+	// protocol is TCP or UDP. It returns the external port and the lease the
+	// gateway granted, which may differ from the ones asked for, a zero
+	// lease meaning the mapping never expires.
+	AddPortMapping(protocol string, internalPort, externalPort int, lease time.Duration) (int, time.Duration, error)
+	DeletePortMapping(protocol string, internalPort, externalPort int) error
+}
+
+// Mapping is a port the gateway forwards to us
+type Mapping struct {
+	Protocol     string `json:"protocol"`
+	InternalPort int    `json:"internalPort"`
+	ExternalPort int    `json:"externalPort"`
+	// nil when the mapping never expires
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// Status is what the API shows about port forwarding
+type Status struct {
+	// upnp, pcp or natpmp, empty while no gateway is found
+	Method     string    `json:"method"`
+	ExternalIP string    `json:"externalIP"`
+	Mappings   []Mapping `json:"mappings"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// Forwarder keeps the listen port forwarded for TCP and UDP, renewing the
+// mappings before their leases run out and removing them on Close
+type Forwarder struct {
+	// Discover finds the gateway, it can be swapped to point at a fake one
+	Discover func() (Mapper, error)
+
+	mu       sync.Mutex
+	port     int
+	mapper   Mapper
+	mappings []Mapping
+	external net.IP
+	err      error
+	closed   chan struct{}
+	wake     chan struct{}
+	once     sync.Once
+}
+
+// Default forwards the port peers connect to
+var Default = NewForwarder()
+
+func NewForwarder() *Forwarder {
+	return &Forwarder{Discover: Discover, closed: make(chan struct{}), wake: make(chan struct{}, 1)}
+}
+
+// Wake makes Run refresh the mappings now, like when the proxy changes
+func (f *Forwarder) Wake() {
+	select {
+	case f.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run forwards port until Close is called
+func (f *Forwarder) Run(port int) {
+	f.mu.Lock()
+	f.port = port
+	f.mu.Unlock()
+
+	for {
+		wait := f.refresh()
+
+		select {
+		case <-f.closed:
+			return
+		case <-f.wake:
+		case <-time.After(wait):
+		}
+	}
+}
+
+// refresh finds a gateway when there is none, adds or renews the mappings
+// and returns how long until it should run again. Gateways can take
+// seconds to answer, so it talks to them without holding f.mu and only
+// stores what came of it.
+func (f *Forwarder) refresh() time.Duration {
+	f.mu.Lock()
+	port, mapper, previous := f.port, f.mapper, f.mappings
+	f.mu.Unlock()
+
+	select {
+	case <-f.closed:
+		return 0
+	default:
+	}
+
+	if proxy.Enabled() {
+		unmap(mapper, previous)
+		f.store(mapper, nil, nil, errProxied)
+		return retryInterval
+	}
+
+	if mapper == nil {
+		var err error
+		if mapper, err = f.Discover(); err != nil {
+			f.store(nil, nil, nil, err)
+			return retryInterval
+		}
+	}
+
+	renew := permanentRenewal
+	mappings := []Mapping{}
+	for _, protocol := range []string{"TCP", "UDP"} {
+		// renewals ask for the port the gateway gave us last time
+		external := port
+		for _, mapping := range previous {
+			if mapping.Protocol == protocol {
+				external = mapping.ExternalPort
+			}
+		}
+
+		external, lease, err := mapper.AddPortMapping(protocol, port, external, leaseDuration)
+		if err != nil {
+			// the gateway may have gone away, look for it again next time
+			f.store(nil, nil, nil, fmt.Errorf("%s %s mapping: %v", mapper.Name(), protocol, err))
+			return retryInterval
+		}
+
+		mapping := Mapping{Protocol: protocol, InternalPort: port, ExternalPort: external}
+		if lease > 0 {
+			expires := time.Now().Add(lease)
+			mapping.Expires = &expires
+			if lease/2 < renew {
+				renew = lease / 2
+			}
+		}
+		mappings = append(mappings, mapping)
+	}
+
+	ip, err := mapper.ExternalIP()
+	if !f.store(mapper, mappings, ip, err) {
+		// Close came while we were mapping and removed the old ones only
+		unmap(mapper, mappings)
+		return 0
+	}
+
+	return renew
+}
+
+// store keeps the outcome of a refresh for Status, unless the forwarder was
+// closed meanwhile
+func (f *Forwarder) store(mapper Mapper, mappings []Mapping, external net.IP, err error) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	select {
+	case <-f.closed:
+		return false
+	default:
+	}
+
+	f.mapper, f.mappings, f.external, f.err = mapper, mappings, external, err
+	return true
+}
+
+// Close removes the mappings and stops renewing them
+func (f *Forwarder) Close() {
+	f.once.Do(func() {
+		f.mu.Lock()
+		close(f.closed)
+		mapper, mappings := f.mapper, f.mappings
+		f.mappings = nil
+		f.mu.Unlock()
+
+		unmap(mapper, mappings)
+	})
+}
+
+// unmap removes mappings from the gateway
+func unmap(mapper Mapper, mappings []Mapping) {
+	if mapper == nil {
+		return
+	}
+	for _, mapping := range mappings {
+		mapper.DeletePortMapping(mapping.Protocol, mapping.InternalPort, mapping.ExternalPort)
+	}
+}
+
+func (f *Forwarder) Status() Status {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	status := Status{Mappings: append([]Mapping{}, f.mappings...)}
+	if f.mapper != nil {
+		status.Method = f.mapper.Name()
+	}
+	if f.external != nil {
+		status.ExternalIP = f.external.String()
+	}
+	if f.err != nil {
+		status.Error = f.err.Error()
+	}
+
+	return status
+}
+
+// Discover looks for a UPnP gateway and falls back to PCP or NAT-PMP on
+// the default gateway
+func Discover() (Mapper, error) {
+	upnp, upnpErr := DiscoverUPnP(SSDPAddr, 2*time.Second)
+	if upnpErr == nil {
+		return upnp, nil
+	}
+
+	gateway, err := DefaultGateway()
+	if err != nil {
+		return nil, fmt.Errorf("upnp: %v, pcp: %v", upnpErr, err)
+	}
+
+	pmp, err := DiscoverPMP(&net.UDPAddr{IP: gateway, Port: PMPPort})
+	if err != nil {
+		return nil, fmt.Errorf("upnp: %v, pcp: %v", upnpErr, err)
+	}
+
+	return pmp, nil
+}
+
+// DefaultGateway reads the IPv4 default route from /proc/net/route
+func DefaultGateway() (net.IP, error) {
+	file, err := os.Open("/proc/net/route")
+	if err != nil {
+		return nil, fmt.Errorf("can't find the default gateway: %v", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// Iface Destination Gateway ..., addresses in little endian hex
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+
+		var gateway uint32
+		if _, err := fmt.Sscanf(fields[2], "%x", &gateway); err != nil || gateway == 0 {
+			continue
+		}
+
+		ip := make(net.IP, 4)
+		binary.LittleEndian.PutUint32(ip, gateway)
+		return ip, nil
+	}
+
+	return nil, fmt.Errorf("can't find the default gateway")
+}
+
+// localIP returns the address of this machine on the way to addr
+func localIP(addr string) (net.IP, error) {
+	conn, err := net.Dial("udp4", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
@@ -0,0 +1,109 @@
+package portmap
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/johneliades/flash/proxy"
+)
+
+// fakeMapper is a gateway that grants every mapping asked of it, once
+// block is closed when there is one
+type fakeMapper struct {
+	mu       sync.Mutex
+	mappings map[string]int
+	block    chan struct{}
+}
+
+func newFakeMapper() *fakeMapper {
+	return &fakeMapper{mappings: map[string]int{}}
+}
+
+func (m *fakeMapper) Name() string { return "fake" }
+
+func (m *fakeMapper) ExternalIP() (net.IP, error) {
+	return net.IPv4(203, 0, 113, 1), nil
+}
+
+func (m *fakeMapper) AddPortMapping(protocol string, internalPort, externalPort int, lease time.Duration) (int, time.Duration, error) {
+	if m.block != nil {
+		<-m.block
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.mappings[protocol] = internalPort
+	return externalPort, lease, nil
+}
+
+func (m *fakeMapper) DeletePortMapping(protocol string, internalPort, externalPort int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.mappings[protocol] != internalPort {
+		return fmt.Errorf("no %s mapping for port %d", protocol, internalPort)
+	}
+	delete(m.mappings, protocol)
+	return nil
+}
+
+func (m *fakeMapper) count() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.mappings)
+}
+
+func TestProxied(t *testing.T) {
+	mapper := newFakeMapper()
+	f := NewForwarder()
+	f.Discover = func() (Mapper, error) { return mapper, nil }
+	f.port = 6881
+
+	f.refresh()
+	if mapper.count() != 2 || len(f.Status().Mappings) != 2 {
+		t.Fatalf("%d ports forwarded, want TCP and UDP", mapper.count())
+	}
+
+	// a forwarded port would tell peers the address the proxy hides
+	proxy.Set(&proxy.Config{Addr: "127.0.0.1:1080"})
+	defer proxy.Set(nil)
+	f.refresh()
+	status := f.Status()
+	if mapper.count() != 0 || len(status.Mappings) != 0 || status.Error != errProxied.Error() {
+		t.Errorf("behind a proxy %d ports are forwarded, error %q", mapper.count(), status.Error)
+	}
+
+	proxy.Set(nil)
+	f.refresh()
+	if status := f.Status(); mapper.count() != 2 || status.Error != "" {
+		t.Errorf("once the proxy is off %d ports are forwarded, error %q", mapper.count(), status.Error)
+	}
+}
+
+func TestStatusDoesntWait(t *testing.T) {
+	mapper := newFakeMapper()
+	mapper.block = make(chan struct{})
+	f := NewForwarder()
+	f.Discover = func() (Mapper, error) { return mapper, nil }
+
+	go f.Run(6881)
+	defer f.Close()
+
+	status := make(chan Status)
+	go func() { status <- f.Status() }()
+	select {
+	case <-status:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Status waited for the gateway")
+	}
+
+	close(mapper.block)
+	for len(f.Status().Mappings) != 2 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	f.Close()
+	if mapper.count() != 0 {
+		t.Errorf("%d ports still forwarded after Close", mapper.count())
+	}
+}
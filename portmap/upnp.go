@@ -0,0 +1,278 @@
+package portmap
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SSDPAddr is where UPnP devices listen for discovery requests
+const SSDPAddr = "239.255.255.250:1900"
+
+// the gateway services that forward ports, newest first
+var wanServices = []string{
+	"urn:schemas-upnp-org:service:WANIPConnection:2",
+	"urn:schemas-upnp-org:service:WANIPConnection:1",
+	"urn:schemas-upnp-org:service:WANPPPConnection:1",
+}
+
+// UPnP forwards ports through the SOAP API of an Internet Gateway Device
+type UPnP struct {
+	ControlURL  string
+	ServiceType string
+	// our address on the gateway's network, where mappings point to
+	LocalIP net.IP
+	client  *http.Client
+}
+
+type upnpService struct {
+	ServiceType string `xml:"serviceType"`
+	ControlURL  string `xml:"controlURL"`
+}
+
+type upnpDevice struct {
+	Services []upnpService `xml:"serviceList>service"`
+	Devices  []upnpDevice  `xml:"deviceList>device"`
+}
+
+type upnpRoot struct {
+	URLBase string     `xml:"URLBase"`
+	Device  upnpDevice `xml:"device"`
+}
+
+// find looks for a service of type serviceType in the device and the
+// devices nested in it
+func (device *upnpDevice) find(serviceType string) *upnpService {
+	for i, service := range device.Services {
+		if service.ServiceType == serviceType {
+			return &device.Services[i]
+		}
+	}
+	for i := range device.Devices {
+		if service := device.Devices[i].find(serviceType); service != nil {
+			return service
+		}
+	}
+	return nil
+}
+
+// DiscoverUPnP sends an SSDP search to ssdpAddr and returns the first gateway
+// that answers with a service able to forward ports
+func DiscoverUPnP(ssdpAddr string, timeout time.Duration) (*UPnP, error) {
+	addr, err := net.ResolveUDPAddr("udp4", ssdpAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	search := "M-SEARCH * HTTP/1.1\r\n" +
+		"HOST: " + SSDPAddr + "\r\n" +
+		"MAN: \"ssdp:discover\"\r\n" +
+		"MX: 2\r\n" +
+		"ST: urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\n\r\n"
+	if _, err := conn.WriteTo([]byte(search), addr); err != nil {
+		return nil, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, 2048)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return nil, fmt.Errorf("no UPnP gateway found")
+		}
+
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+		if err != nil {
+			continue
+		}
+		location := resp.Header.Get("Location")
+		if location == "" {
+			continue
+		}
+
+		if upnp, err := newUPnP(location); err == nil {
+			return upnp, nil
+		}
+	}
+}
+
+// newUPnP reads the device description at location
+func newUPnP(location string) (*UPnP, error) {
+	client := &http.Client{Timeout: 5 * time.Second}
+
+	resp, err := client.Get(location)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var root upnpRoot
+	if err := xml.NewDecoder(resp.Body).Decode(&root); err != nil {
+		return nil, err
+	}
+
+	base, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	if root.URLBase != "" {
+		if base, err = url.Parse(root.URLBase); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, serviceType := range wanServices {
+		service := root.Device.find(serviceType)
+		if service == nil {
+			continue
+		}
+
+		control, err := base.Parse(strings.TrimSpace(service.ControlURL))
+		if err != nil {
+			return nil, err
+		}
+
+		local, err := localIP(net.JoinHostPort(control.Hostname(), "80"))
+		if err != nil {
+			return nil, err
+		}
+
+		return &UPnP{
+			ControlURL:  control.String(),
+			ServiceType: serviceType,
+			LocalIP:     local,
+			client:      client,
+		}, nil
+	}
+
+	return nil, fmt.Errorf("%s has no port forwarding service", location)
+}
+
+func (upnp *UPnP) Name() string {
+	return "upnp"
+}
+
+// soapError is the error a gateway answers a SOAP call it refuses with
+type soapError struct {
+	Code        int    `xml:"Body>Fault>detail>UPnPError>errorCode"`
+	Description string `xml:"Body>Fault>detail>UPnPError>errorDescription"`
+}
+
+func (err *soapError) Error() string {
+	return fmt.Sprintf("upnp error %d: %s", err.Code, err.Description)
+}
+
+// the gateway only takes leases of 0, meaning permanent
+const errOnlyPermanentLeases = 725
+
+// soap calls action on the gateway, args are the already encoded arguments
+func (upnp *UPnP) soap(action, args string) ([]byte, error) {
+	body := `<?xml version="1.0"?>` +
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" ` +
+		`s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>` +
+		`<u:` + action + ` xmlns:u="` + upnp.ServiceType + `">` + args + `</u:` + action + `>` +
+		`</s:Body></s:Envelope>`
+
+	req, err := http.NewRequest("POST", upnp.ControlURL, strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", `"`+upnp.ServiceType+"#"+action+`"`)
+
+	resp, err := upnp.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		soapErr := &soapError{}
+		if xml.Unmarshal(data, soapErr) == nil && soapErr.Code != 0 {
+			return nil, soapErr
+		}
+		return nil, fmt.Errorf("upnp %s: %s", action, resp.Status)
+	}
+
+	return data, nil
+}
+
+func (upnp *UPnP) ExternalIP() (net.IP, error) {
+	data, err := upnp.soap("GetExternalIPAddress", "")
+	if err != nil {
+		return nil, err
+	}
+
+	var reply struct {
+		IP string `xml:"Body>GetExternalIPAddressResponse>NewExternalIPAddress"`
+	}
+	if err := xml.Unmarshal(data, &reply); err != nil {
+		return nil, err
+	}
+
+	ip := net.ParseIP(strings.TrimSpace(reply.IP))
+	if ip == nil {
+		return nil, fmt.Errorf("gateway returned invalid external ip %q", reply.IP)
+	}
+	return ip, nil
+}
+
+func (upnp *UPnP) AddPortMapping(protocol string, internalPort, externalPort int,
+	lease time.Duration) (int, time.Duration, error) {
+
+	err := upnp.addPortMapping(protocol, internalPort, externalPort, lease)
+
+	var soapErr *soapError
+	if lease > 0 && err != nil && errors.As(err, &soapErr) && soapErr.Code == errOnlyPermanentLeases {
+		lease = 0
+		err = upnp.addPortMapping(protocol, internalPort, externalPort, lease)
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return externalPort, lease, nil
+}
+
+func (upnp *UPnP) addPortMapping(protocol string, internalPort, externalPort int, lease time.Duration) error {
+	args := "<NewRemoteHost></NewRemoteHost>" +
+		"<NewExternalPort>" + strconv.Itoa(externalPort) + "</NewExternalPort>" +
+		"<NewProtocol>" + protocol + "</NewProtocol>" +
+		"<NewInternalPort>" + strconv.Itoa(internalPort) + "</NewInternalPort>" +
+		"<NewInternalClient>" + upnp.LocalIP.String() + "</NewInternalClient>" +
+		"<NewEnabled>1</NewEnabled>" +
+		"<NewPortMappingDescription>flash</NewPortMappingDescription>" +
+		"<NewLeaseDuration>" + strconv.Itoa(int(lease.Seconds())) + "</NewLeaseDuration>"
+
+	_, err := upnp.soap("AddPortMapping", args)
+	return err
+}
+
+func (upnp *UPnP) DeletePortMapping(protocol string, internalPort, externalPort int) error {
+	args := "<NewRemoteHost></NewRemoteHost>" +
+		"<NewExternalPort>" + strconv.Itoa(externalPort) + "</NewExternalPort>" +
+		"<NewProtocol>" + protocol + "</NewProtocol>"
+
+	_, err := upnp.soap("DeletePortMapping", args)
+	return err
+}
@@ -0,0 +1,368 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Config is a SOCKS5 proxy, Username and Password are only sent when set
+type Config struct {
+	Addr     string `json:"addr"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+var (
+	mu      sync.RWMutex
+	current *Config
+)
+
+// Set routes all outgoing peer and tracker traffic through a proxy, nil turns it off
+func Set(config *Config) {
+	mu.Lock()
+	defer mu.Unlock()
+	current = config
+}
+
+// Get returns the proxy in use, nil when there is none
+func Get() *Config {
+	mu.RLock()
+	defer mu.RUnlock()
+	return current
+}
+
+// Enabled tells if traffic goes through a proxy. Anything that would reveal
+// our address, like accepting incoming peers, is off while it does.
+func Enabled() bool {
+	return Get() != nil
+}
+
+const (
+	version        = 5
+	authNone       = 0
+	authPassword   = 2
+	authNoAccept   = 0xff
+	cmdConnect     = 1
+	cmdAssociate   = 3
+	atypIPv4       = 1
+	atypDomain     = 3
+	atypIPv6       = 4
+	passwordStatus = 1
+)
+
+// Dial connects to addr over TCP, through the proxy when one is set
+func Dial(network, addr string, timeout time.Duration) (net.Conn, error) {
+	config := Get()
+	if config == nil {
+		return net.DialTimeout(network, addr, timeout)
+	}
+
+	return config.Dial(addr, timeout)
+}
+
+// HTTPClient returns a client whose connections go through the proxy when one is set
+func HTTPClient(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			Proxy: nil,
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				deadline, ok := ctx.Deadline()
+				if !ok {
+					return Dial(network, addr, timeout)
+				}
+				return Dial(network, addr, time.Until(deadline))
+			},
+		},
+	}
+}
+
+// DialUDP returns a connected UDP socket to addr, relayed by the proxy's
+// UDP ASSOCIATE when one is set
+func DialUDP(addr string, timeout time.Duration) (net.Conn, error) {
+	config := Get()
+	if config == nil {
+		return net.DialTimeout("udp", addr, timeout)
+	}
+
+	return config.DialUDP(addr, timeout)
+}
+
+// Dial opens a TCP connection to addr through the proxy
+func (config *Config) Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	conn, _, err := config.negotiate(cmdConnect, addr, timeout)
+	return conn, err
+}
+
+// negotiate connects to the proxy, authenticates and sends a request. It
+// returns the connection once the proxy accepts, along with the address
+// the proxy bound for the request.
+func (config *Config) negotiate(cmd byte, addr string, timeout time.Duration) (net.Conn, string, error) {
+	conn, err := net.DialTimeout("tcp", config.Addr, timeout)
+	if err != nil {
+		return nil, "", err
+	}
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+
+	bound, err := config.handshake(conn, cmd, addr)
+	if err != nil {
+		conn.Close()
+		return nil, "", fmt.Errorf("socks5 %s: %v", config.Addr, err)
+	}
+
+	return conn, bound, nil
+}
+
+func (config *Config) handshake(conn net.Conn, cmd byte, addr string) (string, error) {
+	methods := []byte{authNone}
+	if config.Username != "" {
+		methods = []byte{authNone, authPassword}
+	}
+
+	_, err := conn.Write(append([]byte{version, byte(len(methods))}, methods...))
+	if err != nil {
+		return "", err
+	}
+
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return "", err
+	}
+	if reply[0] != version {
+		return "", fmt.Errorf("unexpected version %d", reply[0])
+	}
+
+	switch reply[1] {
+	case authNone:
+	case authPassword:
+		if len(config.Username) > 255 || len(config.Password) > 255 {
+			return "", fmt.Errorf("username and password can be at most 255 bytes")
+		}
+
+		buf := []byte{passwordStatus, byte(len(config.Username))}
+		buf = append(buf, config.Username...)
+		buf = append(buf, byte(len(config.Password)))
+		buf = append(buf, config.Password...)
+		if _, err := conn.Write(buf); err != nil {
+			return "", err
+		}
+
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return "", err
+		}
+		if reply[1] != 0 {
+			return "", fmt.Errorf("authentication failed")
+		}
+	case authNoAccept:
+		return "", fmt.Errorf("no acceptable authentication method")
+	default:
+		return "", fmt.Errorf("unsupported authentication method %d", reply[1])
+	}
+
+	target, err := encodeAddr(addr)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = conn.Write(append([]byte{version, cmd, 0}, target...))
+	if err != nil {
+		return "", err
+	}
+
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", err
+	}
+	if header[1] != 0 {
+		return "", fmt.Errorf("request failed with code %d", header[1])
+	}
+
+	return readAddr(conn)
+}
+
+// encodeAddr writes host:port the way SOCKS5 requests and UDP headers expect it
+func encodeAddr(addr string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid port in %s", addr)
+	}
+
+	var buf []byte
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			buf = append([]byte{atypIPv4}, ip4...)
+		} else {
+			buf = append([]byte{atypIPv6}, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("host name too long: %s", host)
+		}
+		buf = append([]byte{atypDomain, byte(len(host))}, host...)
+	}
+
+	return binary.BigEndian.AppendUint16(buf, uint16(port)), nil
+}
+
+// readAddr reads an address in the form encodeAddr writes it, as host:port.
+// Names are left for the proxy to resolve, looking them up here would give
+// away what we talk to.
+func readAddr(reader io.Reader) (string, error) {
+	atyp := make([]byte, 1)
+	if _, err := io.ReadFull(reader, atyp); err != nil {
+		return "", err
+	}
+
+	var host []byte
+	switch atyp[0] {
+	case atypIPv4:
+		host = make([]byte, 4)
+	case atypIPv6:
+		host = make([]byte, 16)
+	case atypDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(reader, length); err != nil {
+			return "", err
+		}
+		host = make([]byte, length[0])
+	default:
+		return "", fmt.Errorf("unknown address type %d", atyp[0])
+	}
+
+	if _, err := io.ReadFull(reader, host); err != nil {
+		return "", err
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(reader, port); err != nil {
+		return "", err
+	}
+
+	portStr := strconv.Itoa(int(binary.BigEndian.Uint16(port)))
+	if atyp[0] == atypDomain {
+		return net.JoinHostPort(string(host), portStr), nil
+	}
+	return net.JoinHostPort(net.IP(host).String(), portStr), nil
+}
+
+// DialUDP asks the proxy for a UDP relay and returns a socket that sends
+// every datagram to addr through it
+func (config *Config) DialUDP(addr string, timeout time.Duration) (net.Conn, error) {
+	target, err := encodeAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// we don't know the address our datagrams will come from, so we let
+	// the proxy accept them from any
+	control, bound, err := config.negotiate(cmdAssociate, "0.0.0.0:0", timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	// the relay is the proxy's own, an unspecified address stands for the
+	// one we reached the proxy on
+	host, port, _ := net.SplitHostPort(bound)
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		host, _, _ = net.SplitHostPort(config.Addr)
+	}
+	relay, err := net.ResolveUDPAddr("udp", net.JoinHostPort(host, port))
+	if err != nil {
+		control.Close()
+		return nil, fmt.Errorf("can't resolve proxy relay %s: %v", bound, err)
+	}
+
+	udp, err := net.DialUDP("udp", nil, relay)
+	if err != nil {
+		control.Close()
+		return nil, err
+	}
+
+	return &udpConn{UDPConn: udp, control: control, header: append([]byte{0, 0, 0}, target...), remote: addr}, nil
+}
+
+// udpConn wraps each datagram in the SOCKS5 UDP header. The relay lives as
+// long as the control connection, so closing one closes the other.
+type udpConn struct {
+	*net.UDPConn
+	control net.Conn
+	header  []byte
+
+	mu sync.Mutex
+	// where datagrams go, as dialed until an answer tells where the proxy
+	// found it
+	remote string
+}
+
+// hostAddr is an address only the proxy can resolve
+type hostAddr string
+
+func (addr hostAddr) Network() string { return "udp" }
+func (addr hostAddr) String() string  { return string(addr) }
+
+// RemoteAddr is the address behind the relay rather than the relay's. A
+// name the proxy resolved becomes the address the relay says answers came
+// from, which tells whether the other side is on IPv4 or IPv6.
+func (conn *udpConn) RemoteAddr() net.Addr {
+	conn.mu.Lock()
+	remote := conn.remote
+	conn.mu.Unlock()
+
+	if addr, err := netip.ParseAddrPort(remote); err == nil {
+		return net.UDPAddrFromAddrPort(addr)
+	}
+	return hostAddr(remote)
+}
+
+func (conn *udpConn) Write(b []byte) (int, error) {
+	_, err := conn.UDPConn.Write(append(append([]byte{}, conn.header...), b...))
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (conn *udpConn) Read(b []byte) (int, error) {
+	buf := make([]byte, len(b)+262)
+	n, err := conn.UDPConn.Read(buf)
+	if err != nil {
+		return 0, err
+	}
+
+	// reserved, fragment and the sender's address
+	if n < 4 || buf[2] != 0 {
+		return 0, fmt.Errorf("socks5: fragmented or short datagram")
+	}
+
+	reader := bytes.NewReader(buf[3:n])
+	from, err := readAddr(reader)
+	if err != nil {
+		return 0, err
+	}
+	conn.mu.Lock()
+	conn.remote = from
+	conn.mu.Unlock()
+
+	return copy(b, buf[n-reader.Len():n]), nil
+}
+
+func (conn *udpConn) Close() error {
+	conn.control.Close()
+	return conn.UDPConn.Close()
+}
@@ -0,0 +1,316 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// socksServer is a SOCKS5 proxy in the test process. It looks the names in
+// requests up in hosts, so the test sees them arrive unresolved, and names
+// itself where it can in replies, which only it could resolve.
+type socksServer struct {
+	listener net.Listener
+	username string
+	password string
+	hosts    map[string]string
+
+	mu sync.Mutex
+	// targets as the requests named them
+	requests []string
+	// where relayed answers say they came from, the target as it was named
+	// when empty
+	answerFrom string
+}
+
+func newSocksServer(t *testing.T, username, password string, hosts map[string]string) *socksServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	s := &socksServer{listener: listener, username: username, password: password, hosts: hosts}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *socksServer) config() *Config {
+	return &Config{Addr: s.listener.Addr().String(), Username: s.username, Password: s.password}
+}
+
+func (s *socksServer) targets() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.requests...)
+}
+
+// resolve finds where a requested target really is, only names in hosts
+// are known
+func (s *socksServer) resolve(target string) (string, bool) {
+	host, port, _ := net.SplitHostPort(target)
+	real, ok := s.hosts[host]
+	return net.JoinHostPort(real, port), ok
+}
+
+func (s *socksServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	greeting := make([]byte, 2)
+	if _, err := io.ReadFull(conn, greeting); err != nil {
+		return
+	}
+	methods := make([]byte, greeting[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return
+	}
+
+	if s.username == "" {
+		conn.Write([]byte{version, authNone})
+	} else {
+		if !bytes.Contains(methods, []byte{authPassword}) {
+			conn.Write([]byte{version, authNoAccept})
+			return
+		}
+		conn.Write([]byte{version, authPassword})
+
+		var fields [2]string
+		header := make([]byte, 1)
+		io.ReadFull(conn, header)
+		for i := range fields {
+			length := make([]byte, 1)
+			io.ReadFull(conn, length)
+			field := make([]byte, length[0])
+			io.ReadFull(conn, field)
+			fields[i] = string(field)
+		}
+		if fields[0] != s.username || fields[1] != s.password {
+			conn.Write([]byte{passwordStatus, 1})
+			return
+		}
+		conn.Write([]byte{passwordStatus, 0})
+	}
+
+	request := make([]byte, 3)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return
+	}
+	target, err := readAddr(conn)
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	s.requests = append(s.requests, target)
+	s.mu.Unlock()
+
+	switch request[1] {
+	case cmdConnect:
+		real, ok := s.resolve(target)
+		if !ok {
+			// host unreachable
+			conn.Write([]byte{version, 4, 0, atypIPv4, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		remote, err := net.Dial("tcp", real)
+		if err != nil {
+			conn.Write([]byte{version, 5, 0, atypIPv4, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		defer remote.Close()
+
+		bound, _ := encodeAddr("proxy.invalid:1080")
+		conn.Write(append([]byte{version, 0, 0}, bound...))
+		go io.Copy(remote, conn)
+		io.Copy(conn, remote)
+
+	case cmdAssociate:
+		relay, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			return
+		}
+		defer relay.Close()
+
+		// the relay is on the address we were reached on
+		_, port, _ := net.SplitHostPort(relay.LocalAddr().String())
+		bound, _ := encodeAddr("0.0.0.0:" + port)
+		conn.Write(append([]byte{version, 0, 0}, bound...))
+		go s.relay(relay)
+		io.Copy(io.Discard, conn)
+	}
+}
+
+// relay forwards each datagram to the target in its header and sends the
+// answer back, from the target as it was named
+func (s *socksServer) relay(relay net.PacketConn) {
+	buf := make([]byte, 2048)
+	for {
+		n, client, err := relay.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		reader := bytes.NewReader(buf[3:n])
+		target, err := readAddr(reader)
+		if err != nil {
+			continue
+		}
+		s.mu.Lock()
+		s.requests = append(s.requests, target)
+		s.mu.Unlock()
+
+		real, ok := s.resolve(target)
+		if !ok {
+			continue
+		}
+		remote, err := net.Dial("udp", real)
+		if err != nil {
+			continue
+		}
+		remote.Write(buf[n-reader.Len() : n])
+		remote.SetReadDeadline(time.Now().Add(5 * time.Second))
+		answer := make([]byte, 2048)
+		m, err := remote.Read(answer)
+		remote.Close()
+		if err != nil {
+			continue
+		}
+
+		s.mu.Lock()
+		from := s.answerFrom
+		s.mu.Unlock()
+		if from == "" {
+			from = target
+		}
+		header, _ := encodeAddr(from)
+		relay.WriteTo(append(append([]byte{0, 0, 0}, header...), answer[:m]...), client)
+	}
+}
+
+func echoTCP(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func echoUDP(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(buf[:n], addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// roundTrip writes msg and expects it back
+func roundTrip(t *testing.T, conn net.Conn, msg string) {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != msg {
+		t.Errorf("sent %q, got %q back", msg, buf[:n])
+	}
+}
+
+func TestDial(t *testing.T) {
+	echo, port, _ := net.SplitHostPort(echoTCP(t))
+	s := newSocksServer(t, "user", "secret", map[string]string{"peer.invalid": echo})
+
+	// names go to the proxy as they are, nothing looks them up here
+	Set(s.config())
+	defer Set(nil)
+	conn, err := Dial("tcp", "peer.invalid:"+port, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	roundTrip(t, conn, "hello")
+
+	if targets := s.targets(); len(targets) != 1 || targets[0] != "peer.invalid:"+port {
+		t.Errorf("the proxy was asked for %q", targets)
+	}
+
+	if _, err := s.config().Dial("unknown.invalid:1", 5*time.Second); err == nil {
+		t.Error("connected to a host the proxy can't reach")
+	}
+
+	wrong := s.config()
+	wrong.Password = "guess"
+	if _, err := wrong.Dial("peer.invalid:"+port, 5*time.Second); err == nil {
+		t.Error("connected with the wrong password")
+	}
+}
+
+func TestDialUDP(t *testing.T) {
+	echo, port, _ := net.SplitHostPort(echoUDP(t))
+	s := newSocksServer(t, "", "", map[string]string{"tracker.invalid": echo})
+
+	conn, err := s.config().DialUDP("tracker.invalid:"+port, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	roundTrip(t, conn, "connect")
+	if remote := conn.RemoteAddr().String(); remote != "tracker.invalid:"+port {
+		t.Errorf("the remote address is %s", remote)
+	}
+
+	// the relay tells where the name led, which decides the peers' family
+	s.mu.Lock()
+	s.answerFrom = "[2001:db8::1]:" + port
+	s.mu.Unlock()
+	roundTrip(t, conn, "announce")
+	if remote, ok := conn.RemoteAddr().(*net.UDPAddr); !ok || remote.IP.To4() != nil {
+		t.Errorf("the remote address is %v, not the IPv6 one the relay reported", conn.RemoteAddr())
+	}
+
+	// the association itself asks for nothing in particular
+	targets := s.targets()
+	if len(targets) != 3 || targets[1] != "tracker.invalid:"+port || targets[2] != targets[1] {
+		t.Errorf("the proxy was asked for %q", targets)
+	}
+}
@@ -0,0 +1,171 @@
+package ratelimit
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// GlobalDown and GlobalUp cap the traffic of every torrent combined
+var (
+	GlobalDown = New(0)
+	GlobalUp   = New(0)
+)
+
+// Limiter is a token bucket that refills continuously at rate bytes per
+// second. It holds at most a tenth of a second worth of tokens and lets
+// callers go into debt, so traffic is spread out evenly instead of passing
+// in one second bursts. A nil Limiter or a rate of 0 means unlimited.
+type Limiter struct {
+	mu     sync.Mutex
+	rate   int64
+	tokens float64
+	last   time.Time
+}
+
+func New(rate int64) *Limiter {
+	return &Limiter{rate: rate, last: time.Now()}
+}
+
+// Rate returns the limit in bytes per second, 0 when unlimited
+func (l *Limiter) Rate() int64 {
+	if l == nil {
+		return 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+// SetRate changes the limit, it applies from the next call to Wait on
+func (l *Limiter) SetRate(rate int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if rate < 0 {
+		rate = 0
+	}
+	l.refill()
+	l.rate = rate
+	l.tokens = 0
+}
+
+func (l *Limiter) refill() {
+	now := time.Now()
+	elapsed := now.Sub(l.last).Seconds()
+	l.last = now
+
+	if l.rate == 0 {
+		return
+	}
+
+	l.tokens += elapsed * float64(l.rate)
+	if burst := float64(l.rate) / 10; l.tokens > burst {
+		l.tokens = burst
+	}
+}
+
+// reserve takes n tokens and returns how long the caller has to wait
+// before the bytes are covered
+func (l *Limiter) reserve(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.refill()
+	if l.rate == 0 {
+		return 0
+	}
+
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+}
+
+// Wait blocks until n bytes can pass
+func (l *Limiter) Wait(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+
+	if wait := l.reserve(n); wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// maxChunk bounds how much passes a limiter at once, so a single large
+// write doesn't hold the whole budget
+const maxChunk = 16 * 1024
+
+func waitAll(limiters []*Limiter, n int) {
+	for _, l := range limiters {
+		l.Wait(n)
+	}
+}
+
+// Conn limits the reads and writes of a net.Conn
+type Conn struct {
+	net.Conn
+	down []*Limiter
+	up   []*Limiter
+}
+
+// NewConn wraps conn so that every read passes the down limiters and every
+// write the up limiters, usually a torrent's own limiter and the global one
+func NewConn(conn net.Conn, down, up []*Limiter) *Conn {
+	return &Conn{Conn: conn, down: down, up: up}
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	if len(b) > maxChunk {
+		b = b[:maxChunk]
+	}
+
+	n, err := c.Conn.Read(b)
+	waitAll(c.down, n)
+	return n, err
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		chunk := b[written:]
+		if len(chunk) > maxChunk {
+			chunk = chunk[:maxChunk]
+		}
+
+		waitAll(c.up, len(chunk))
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+
+	return written, nil
+}
+
+type reader struct {
+	io.Reader
+	limiters []*Limiter
+}
+
+// NewReader limits reads from r, used for traffic that isn't a peer
+// connection such as HTTP response bodies
+func NewReader(r io.Reader, limiters ...*Limiter) io.Reader {
+	return &reader{Reader: r, limiters: limiters}
+}
+
+func (r *reader) Read(b []byte) (int, error) {
+	if len(b) > maxChunk {
+		b = b[:maxChunk]
+	}
+
+	n, err := r.Reader.Read(b)
+	waitAll(r.limiters, n)
+	return n, err
+}
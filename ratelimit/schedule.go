@@ -0,0 +1,226 @@
+package ratelimit
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Clock lets the scheduler run against something other than the wall clock
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// SystemClock is the real wall clock
+var SystemClock Clock = systemClock{}
+
+// Rule limits the global rates on some days between two times of day, for
+// example Mon-Fri 09:00-18:00. When End is before Start the rule runs past
+// midnight into the next day. Rates are in bytes per second, 0 for unlimited.
+type Rule struct {
+	Name  string   `json:"name"`
+	Days  []string `json:"days"`
+	Start string   `json:"start"`
+	End   string   `json:"end"`
+	Down  int64    `json:"downloadLimit"`
+	Up    int64    `json:"uploadLimit"`
+}
+
+// parseDay takes a day by its full name or the first three letters of it,
+// in any case
+func parseDay(day string) (time.Weekday, bool) {
+	day = strings.ToLower(day)
+	for weekday := time.Sunday; weekday <= time.Saturday; weekday++ {
+		name := strings.ToLower(weekday.String())
+		if day == name || day == name[:3] {
+			return weekday, true
+		}
+	}
+	return 0, false
+}
+
+// parseClock turns "HH:MM" into minutes since midnight
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, expected HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// compiled is a validated Rule
+type compiled struct {
+	rule  Rule
+	days  [7]bool
+	start int
+	end   int
+}
+
+func compile(rule Rule) (compiled, error) {
+	c := compiled{rule: rule}
+
+	if len(rule.Days) == 0 {
+		for i := range c.days {
+			c.days[i] = true
+		}
+	}
+	for _, day := range rule.Days {
+		weekday, ok := parseDay(day)
+		if !ok {
+			return c, fmt.Errorf("invalid day %q", day)
+		}
+		c.days[weekday] = true
+	}
+
+	var err error
+	if c.start, err = parseClock(rule.Start); err != nil {
+		return c, err
+	}
+	if c.end, err = parseClock(rule.End); err != nil {
+		return c, err
+	}
+	if c.start == c.end {
+		return c, fmt.Errorf("rule %q starts and ends at %s", rule.Name, rule.Start)
+	}
+	if rule.Down < 0 || rule.Up < 0 {
+		return c, fmt.Errorf("rule %q has a negative rate", rule.Name)
+	}
+
+	return c, nil
+}
+
+func (c compiled) matches(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	today := t.Weekday()
+	yesterday := (today + 6) % 7
+
+	if c.start < c.end {
+		return c.days[today] && minute >= c.start && minute < c.end
+	}
+
+	// runs past midnight, the days refer to the day it starts on
+	return (c.days[today] && minute >= c.start) || (c.days[yesterday] && minute < c.end)
+}
+
+// Scheduler applies a weekly calendar of rules to a pair of limiters. While
+// no rule is active the limiters keep the rates they had before the first
+// rule kicked in.
+type Scheduler struct {
+	mu     sync.Mutex
+	clock  Clock
+	down   *Limiter
+	up     *Limiter
+	rules  []compiled
+	active *compiled
+	// rates to go back to once no rule is active
+	baseDown int64
+	baseUp   int64
+}
+
+func NewScheduler(clock Clock, down, up *Limiter) *Scheduler {
+	return &Scheduler{clock: clock, down: down, up: up}
+}
+
+// Schedule drives the global limiters
+var Schedule = NewScheduler(SystemClock, GlobalDown, GlobalUp)
+
+// SetRules replaces the calendar, the first matching rule wins
+func (s *Scheduler) SetRules(rules []Rule) error {
+	var compiledRules []compiled
+	for _, rule := range rules {
+		c, err := compile(rule)
+		if err != nil {
+			return err
+		}
+		compiledRules = append(compiledRules, c)
+	}
+
+	s.mu.Lock()
+	s.rules = compiledRules
+	s.mu.Unlock()
+
+	s.Apply()
+	return nil
+}
+
+func (s *Scheduler) Rules() []Rule {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rules := []Rule{}
+	for _, c := range s.rules {
+		rules = append(rules, c.rule)
+	}
+	return rules
+}
+
+// Active returns the rule in effect, nil if none is
+func (s *Scheduler) Active() *Rule {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.active == nil {
+		return nil
+	}
+	rule := s.active.rule
+	return &rule
+}
+
+// Apply sets the limiters according to the rule active right now
+func (s *Scheduler) Apply() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.clock.Now()
+
+	var match *compiled
+	for i := range s.rules {
+		if s.rules[i].matches(now) {
+			match = &s.rules[i]
+			break
+		}
+	}
+
+	if match == nil {
+		if s.active != nil {
+			s.down.SetRate(s.baseDown)
+			s.up.SetRate(s.baseUp)
+			s.active = nil
+		}
+		return
+	}
+
+	if s.active == nil {
+		s.baseDown, s.baseUp = s.down.Rate(), s.up.Rate()
+	}
+	if s.down.Rate() != match.rule.Down {
+		s.down.SetRate(match.rule.Down)
+	}
+	if s.up.Rate() != match.rule.Up {
+		s.up.SetRate(match.rule.Up)
+	}
+	s.active = match
+}
+
+// Run applies the rules at the start of every minute until done is closed
+func (s *Scheduler) Run(done chan struct{}) {
+	for {
+		s.Apply()
+
+		now := s.clock.Now()
+		next := now.Truncate(time.Minute).Add(time.Minute)
+
+		select {
+		case <-done:
+			return
+		case <-s.clock.After(next.Sub(now)):
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package ratelimit
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock stands still until the test moves it, and tells the test how
+// long the scheduler waits each time
+type fakeClock struct {
+	mu    sync.Mutex
+	now   time.Time
+	waits chan time.Duration
+	fire  chan time.Time
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now, waits: make(chan time.Duration), fire: make(chan time.Time)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.waits <- d
+	return c.fire
+}
+
+// advance moves the clock by the wait the scheduler asked for and wakes it
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	now := c.now
+	c.mu.Unlock()
+	c.fire <- now
+}
+
+// 2024-01-01 was a Monday
+func at(day int, clock string) time.Time {
+	t, _ := time.Parse("2006-01-02 15:04", "2024-01-0"+string(rune('0'+day))+" "+clock)
+	return t
+}
+
+func TestDays(t *testing.T) {
+	for _, day := range []string{"mon", "Monday", "MON", "tuesday", "Wed", "THU", "friday", "sat", "Sunday"} {
+		if _, err := compile(Rule{Days: []string{day}, Start: "09:00", End: "10:00"}); err != nil {
+			t.Errorf("%q: %v", day, err)
+		}
+	}
+
+	// the Kelvin sign lowercases to a single byte k
+	for _, day := range []string{"Saturnalia", "mo", "m", "", "monday ", "Mondays", "\u212Aelvin", "\u212A"} {
+		if _, err := compile(Rule{Days: []string{day}, Start: "09:00", End: "10:00"}); err == nil {
+			t.Errorf("%q was taken for a day", day)
+		}
+	}
+}
+
+func TestMatches(t *testing.T) {
+	work, _ := compile(Rule{Days: []string{"mon", "tue", "wed", "thu", "fri"}, Start: "09:00", End: "18:00"})
+	night, _ := compile(Rule{Days: []string{"Saturday"}, Start: "22:00", End: "02:00"})
+
+	tests := []struct {
+		rule compiled
+		t    time.Time
+		want bool
+	}{
+		{work, at(1, "09:00"), true},
+		{work, at(5, "17:59"), true},
+		{work, at(1, "18:00"), false},
+		{work, at(1, "08:59"), false},
+		{work, at(6, "12:00"), false},
+		{night, at(6, "22:00"), true},
+		{night, at(7, "01:59"), true},
+		{night, at(7, "02:00"), false},
+		{night, at(7, "23:00"), false},
+		{night, at(6, "01:00"), false},
+	}
+	for _, test := range tests {
+		if test.rule.matches(test.t) != test.want {
+			t.Errorf("%s %s %s: got %v", test.rule.rule.Start, test.t.Weekday(), test.t.Format("15:04"),
+				!test.want)
+		}
+	}
+}
+
+func TestScheduler(t *testing.T) {
+	clock := newFakeClock(at(1, "08:59").Add(30 * time.Second))
+	down, up := New(1000), New(0)
+	s := NewScheduler(clock, down, up)
+
+	done := make(chan struct{})
+	defer close(done)
+	go s.Run(done)
+
+	// waits for the start of the next minute
+	if wait := <-clock.waits; wait != 30*time.Second {
+		t.Fatalf("waiting %v for the next minute", wait)
+	}
+
+	err := s.SetRules([]Rule{{Name: "work", Days: []string{"Monday"}, Start: "09:00", End: "09:02",
+		Down: 100, Up: 50}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Active() != nil || down.Rate() != 1000 {
+		t.Fatalf("a rule is active before its time, download rate %d", down.Rate())
+	}
+
+	clock.advance(30 * time.Second)
+	if wait := <-clock.waits; wait != time.Minute {
+		t.Fatalf("waiting %v for the next minute", wait)
+	}
+	if active := s.Active(); active == nil || active.Name != "work" || down.Rate() != 100 || up.Rate() != 50 {
+		t.Fatalf("at 09:00 rule %v is active with rates %d and %d", active, down.Rate(), up.Rate())
+	}
+
+	// the rates from before the rule come back once it ends
+	clock.advance(time.Minute)
+	<-clock.waits
+	clock.advance(time.Minute)
+	<-clock.waits
+	if s.Active() != nil || down.Rate() != 1000 || up.Rate() != 0 {
+		t.Errorf("at 09:02 rule %v is active with rates %d and %d", s.Active(), down.Rate(), up.Rate())
+	}
+}
@@ -1,20 +1,27 @@
 package routes
 
 import (
+	"errors"
 	"fmt"
 	"math"
 	"net/http"
 	"os"
 
 	"github.com/gin-gonic/gin"
+	"github.com/johneliades/flash/blocklist"
+	"github.com/johneliades/flash/portmap"
+	"github.com/johneliades/flash/proxy"
+	"github.com/johneliades/flash/ratelimit"
+	"github.com/johneliades/flash/storage"
 	"github.com/johneliades/flash/torrent"
 	"github.com/johneliades/flash/torrent_file"
+	"github.com/johneliades/flash/tracker"
 )
 
-var activeTorrents map[string]*torrent.TorrentStatus
+var activeTorrents map[string]*torrent.Torrent
 
 func RegisterRoutes(r *gin.Engine) {
-	activeTorrents = make(map[string]*torrent.TorrentStatus)
+	activeTorrents = make(map[string]*torrent.Torrent)
 
 	r.POST("/start-download", func(c *gin.Context) {
 		file, err := c.FormFile("torrent")
@@ -36,16 +43,40 @@ func RegisterRoutes(r *gin.Engine) {
 			return
 		}
 
+		// where the files are saved, the working directory when left out
+		savePath := c.PostForm("savePath")
+
+		// lazy, sparse or full, lazy when left out
+		allocation, err := storage.ParseAllocation(c.PostForm("allocation"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
 		fmt.Printf("Starting download for torrent: %s\n", tmpFile.Name())
 
 		torrent, err := torrent_file.Open(tmpFile.Name(), false)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			status := http.StatusInternalServerError
+			var invalid *torrent_file.FieldError
+			if errors.As(err, &invalid) {
+				status = http.StatusBadRequest
+			}
+			c.JSON(status, gin.H{"error": err.Error()})
 			return
 		}
 
-		activeTorrents[file.Filename] = &torrent.Status
-		torrent.Download("") 
+		activeTorrents[file.Filename] = &torrent
+		torrent.Allocation = allocation
+		if err := torrent.Download(savePath); err != nil {
+			status := http.StatusInternalServerError
+			var noSpace *storage.NoSpaceError
+			if errors.As(err, &noSpace) {
+				status = http.StatusInsufficientStorage
+			}
+			c.JSON(status, gin.H{"error": err.Error()})
+			return
+		}
 
 		c.JSON(http.StatusOK, gin.H{"message": "Download started"})
 	})
@@ -58,9 +89,9 @@ func RegisterRoutes(r *gin.Engine) {
 			// Create a response object in the expected format
 			response := gin.H{
 				"name":           torrentName,
-				"progress":       math.Round(torrent.Progress*100) / 100, // Round to two decimal places
-				"downloadSpeed":  torrent.DownSpeed,
-				"size":           torrent.Size,
+				"progress":       math.Round(torrent.Status.Progress*100) / 100, // Round to two decimal places
+				"downloadSpeed":  torrent.Status.DownSpeed,
+				"size":           torrent.Status.Size,
 			}
 
 			// Send the response back to the frontend
@@ -69,4 +100,309 @@ func RegisterRoutes(r *gin.Engine) {
 			c.JSON(http.StatusNotFound, gin.H{"error": "Torrent not found"})
 		}
 	})
-}
\ No newline at end of file
+
+	// /peers route: List the connected peers of a torrent with their choke state
+	r.GET("/peers", func(c *gin.Context) {
+		torrentName := c.DefaultQuery("torrent_name", "")
+
+		if torrent, exists := activeTorrents[torrentName]; exists {
+			c.JSON(http.StatusOK, gin.H{"name": torrentName, "peers": torrent.Peers()})
+		} else {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Torrent not found"})
+		}
+	})
+
+	// /limits route: Read and change a single torrent's rate limits,
+	// in bytes per second with 0 for unlimited
+	r.GET("/limits", func(c *gin.Context) {
+		torrentName := c.DefaultQuery("torrent_name", "")
+
+		if torrent, exists := activeTorrents[torrentName]; exists {
+			c.JSON(http.StatusOK, gin.H{
+				"name":          torrentName,
+				"downloadLimit": torrent.DownLimit.Rate(),
+				"uploadLimit":   torrent.UpLimit.Rate(),
+			})
+		} else {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Torrent not found"})
+		}
+	})
+
+	r.POST("/limits", func(c *gin.Context) {
+		var limits struct {
+			Name          string `json:"name"`
+			DownloadLimit int64  `json:"downloadLimit"`
+			UploadLimit   int64  `json:"uploadLimit"`
+		}
+		if err := c.ShouldBindJSON(&limits); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		torrent, exists := activeTorrents[limits.Name]
+		if !exists {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Torrent not found"})
+			return
+		}
+
+		if limits.DownloadLimit < 0 || limits.UploadLimit < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "rate limits can't be negative"})
+			return
+		}
+
+		torrent.DownLimit.SetRate(limits.DownloadLimit)
+		torrent.UpLimit.SetRate(limits.UploadLimit)
+
+		c.JSON(http.StatusOK, gin.H{
+			"name":          limits.Name,
+			"downloadLimit": torrent.DownLimit.Rate(),
+			"uploadLimit":   torrent.UpLimit.Rate(),
+		})
+	})
+
+	// /move-storage route: Move a torrent's files to another directory while
+	// it runs and follow how far the move got
+	r.GET("/move-storage", func(c *gin.Context) {
+		torrentName := c.DefaultQuery("torrent_name", "")
+
+		if torrent, exists := activeTorrents[torrentName]; exists {
+			c.JSON(http.StatusOK, gin.H{"name": torrentName, "move": torrent.MoveStatus()})
+		} else {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Torrent not found"})
+		}
+	})
+
+	r.POST("/move-storage", func(c *gin.Context) {
+		var req struct {
+			Name string `json:"name"`
+			Path string `json:"path"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		torrent, exists := activeTorrents[req.Name]
+		if !exists {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Torrent not found"})
+			return
+		}
+
+		if req.Path == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "path is required"})
+			return
+		}
+
+		if err := torrent.StartMove(req.Path); err != nil {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusAccepted, gin.H{"name": req.Name, "move": torrent.MoveStatus()})
+	})
+
+	// /stop route: Stop a torrent, which is how seeding ends
+	r.POST("/stop", func(c *gin.Context) {
+		var req struct {
+			Name string `json:"name"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		torrent, exists := activeTorrents[req.Name]
+		if !exists {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Torrent not found"})
+			return
+		}
+
+		if err := torrent.Stop(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"name": req.Name, "message": "Torrent stopped"})
+	})
+
+	// /schedule route: Read and replace the weekly calendar of global rate limits
+	r.GET("/schedule", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{
+			"rules":  ratelimit.Schedule.Rules(),
+			"active": ratelimit.Schedule.Active(),
+		})
+	})
+
+	r.POST("/schedule", func(c *gin.Context) {
+		var rules []ratelimit.Rule
+		if err := c.ShouldBindJSON(&rules); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if err := ratelimit.Schedule.SetRules(rules); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"rules":  ratelimit.Schedule.Rules(),
+			"active": ratelimit.Schedule.Active(),
+		})
+	})
+
+	// /bans route: List the peers banned for sending corrupt data and lift bans,
+	// every ban is lifted when no ip is given
+	r.GET("/bans", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"bans": torrent.Bans.List()})
+	})
+
+	r.DELETE("/bans", func(c *gin.Context) {
+		cleared := torrent.Bans.Clear(c.DefaultQuery("ip", ""))
+		c.JSON(http.StatusOK, gin.H{"cleared": cleared, "bans": torrent.Bans.List()})
+	})
+
+	// /blocklist route: Show the ip filter and load or reload it from a file,
+	// the last loaded file is read again when no path is given
+	r.GET("/blocklist", func(c *gin.Context) {
+		c.JSON(http.StatusOK, blocklistStatus())
+	})
+
+	r.POST("/blocklist", func(c *gin.Context) {
+		var req struct {
+			Path string `json:"path"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		var err error
+		if req.Path == "" {
+			err = blocklist.Default.Reload()
+		} else {
+			err = blocklist.Default.LoadFile(req.Path)
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, blocklistStatus())
+	})
+
+	// /proxy route: Show and set the SOCKS5 proxy for peer and tracker traffic,
+	// an empty address turns it off. The password is never sent back.
+	r.GET("/proxy", func(c *gin.Context) {
+		c.JSON(http.StatusOK, proxyStatus())
+	})
+
+	r.POST("/proxy", func(c *gin.Context) {
+		var config proxy.Config
+		if err := c.ShouldBindJSON(&config); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if config.Addr == "" {
+			proxy.Set(nil)
+		} else {
+			proxy.Set(&config)
+		}
+		// port forwarding stops or resumes with the proxy
+		portmap.Default.Wake()
+
+		c.JSON(http.StatusOK, proxyStatus())
+	})
+
+	// /portmap route: Show how the listen port is forwarded on the router and
+	// the external address peers reach us on
+	r.GET("/portmap", func(c *gin.Context) {
+		c.JSON(http.StatusOK, portmap.Default.Status())
+	})
+
+	// the built in tracker answers on /announce and /scrape while enabled
+	tracker.Default.Mount(r)
+
+	// /tracker route: Turn the built in tracker on and off, limit it to a
+	// whitelist of hex info hashes and show the swarms it tracks
+	r.GET("/tracker", func(c *gin.Context) {
+		c.JSON(http.StatusOK, trackerStatus())
+	})
+
+	r.POST("/tracker", func(c *gin.Context) {
+		var config struct {
+			Enabled   bool     `json:"enabled"`
+			Whitelist []string `json:"whitelist"`
+		}
+		if err := c.ShouldBindJSON(&config); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		var whitelist [][20]byte
+		for _, s := range config.Whitelist {
+			infoHash, err := tracker.ParseInfoHash(s)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			whitelist = append(whitelist, infoHash)
+		}
+
+		if err := tracker.Default.SetEnabled(config.Enabled); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		tracker.Default.SetWhitelist(whitelist)
+
+		c.JSON(http.StatusOK, trackerStatus())
+	})
+
+	// /settings route: Read and change the client wide settings at runtime
+	r.GET("/settings", func(c *gin.Context) {
+		c.JSON(http.StatusOK, currentSettings())
+	})
+
+	r.POST("/settings", func(c *gin.Context) {
+		s := currentSettings()
+		if err := c.ShouldBindJSON(&s); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if err := applySettings(s); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, currentSettings())
+	})
+}
+
+func blocklistStatus() gin.H {
+	return gin.H{
+		"path":    blocklist.Default.Path(),
+		"ranges":  blocklist.Default.Len(),
+		"blocked": blocklist.Default.Blocked(),
+	}
+}
+
+func proxyStatus() gin.H {
+	config := proxy.Get()
+	if config == nil {
+		return gin.H{"enabled": false}
+	}
+
+	return gin.H{"enabled": true, "addr": config.Addr, "username": config.Username}
+}
+
+func trackerStatus() gin.H {
+	return gin.H{
+		"enabled":   tracker.Default.Enabled(),
+		"proxied":   proxy.Enabled(),
+		"udpPort":   tracker.UDPPort,
+		"whitelist": tracker.Default.Whitelist(),
+		"torrents":  tracker.Default.Stats(),
+	}
+}
@@ -0,0 +1,100 @@
+package routes
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/johneliades/flash/client"
+	"github.com/johneliades/flash/mse"
+	"github.com/johneliades/flash/ratelimit"
+	"github.com/johneliades/flash/storage"
+	"github.com/johneliades/flash/torrent"
+)
+
+// settings are the knobs the frontend can change while torrents run
+type settings struct {
+	UploadSlots int `json:"uploadSlots"`
+	// peer connection limits, half open ones are dials in flight
+	MaxConnections           int `json:"maxConnections"`
+	MaxConnectionsPerTorrent int `json:"maxConnectionsPerTorrent"`
+	MaxHalfOpen              int `json:"maxHalfOpen"`
+	// peer connection encryption: prefer, require or disable
+	Encryption string `json:"encryption"`
+	// transport peers are dialed with: utp tries uTP first and falls back
+	// to TCP, tcp only uses TCP
+	Transport string `json:"transport"`
+	// global rate limits in bytes per second, 0 for unlimited
+	DownloadLimit int64 `json:"downloadLimit"`
+	UploadLimit   int64 `json:"uploadLimit"`
+	// disk cache sizes in bytes, the read cache of running downloads keeps
+	// the size it started with
+	WriteCache int `json:"writeCache"`
+	ReadCache  int `json:"readCache"`
+	// where running downloads are kept until complete, empty keeps them in
+	// place, and whether their files get a .part suffix meanwhile
+	IncompleteDir string `json:"incompleteDir"`
+	PartSuffix    bool   `json:"partSuffix"`
+}
+
+func currentSettings() settings {
+	staging := torrent.CurrentStaging()
+	return settings{
+		UploadSlots:              int(torrent.UploadSlots.Load()),
+		MaxConnections:           int(torrent.MaxConnections.Load()),
+		MaxConnectionsPerTorrent: int(torrent.MaxConnectionsPerTorrent.Load()),
+		MaxHalfOpen:              int(torrent.MaxHalfOpen.Load()),
+		Encryption:               mse.Policy(mse.CurrentPolicy.Load()).String(),
+		Transport:                transport(),
+		DownloadLimit:            ratelimit.GlobalDown.Rate(),
+		UploadLimit:              ratelimit.GlobalUp.Rate(),
+		WriteCache:               int(storage.WriteCacheSize.Load()),
+		ReadCache:                int(storage.ReadCacheSize.Load()),
+		IncompleteDir:            staging.IncompleteDir,
+		PartSuffix:               staging.PartSuffix,
+	}
+}
+
+func applySettings(s settings) error {
+	if s.UploadSlots < 0 || s.UploadSlots > math.MaxInt32 {
+		return fmt.Errorf("uploadSlots must be from 0 to %d", math.MaxInt32)
+	}
+	for _, limit := range []int{s.MaxConnections, s.MaxConnectionsPerTorrent, s.MaxHalfOpen} {
+		if limit < 1 || limit > math.MaxInt32 {
+			return fmt.Errorf("connection limits must be from 1 to %d", math.MaxInt32)
+		}
+	}
+	if s.DownloadLimit < 0 || s.UploadLimit < 0 {
+		return fmt.Errorf("rate limits can't be negative")
+	}
+	if s.WriteCache < 1 || s.ReadCache < 0 {
+		return fmt.Errorf("writeCache must be at least 1 and readCache can't be negative")
+	}
+	policy, err := mse.ParsePolicy(s.Encryption)
+	if err != nil {
+		return err
+	}
+	if s.Transport != "utp" && s.Transport != "tcp" {
+		return fmt.Errorf("unknown transport %q", s.Transport)
+	}
+
+	torrent.UploadSlots.Store(int32(s.UploadSlots))
+	torrent.MaxConnections.Store(int32(s.MaxConnections))
+	torrent.MaxConnectionsPerTorrent.Store(int32(s.MaxConnectionsPerTorrent))
+	torrent.MaxHalfOpen.Store(int32(s.MaxHalfOpen))
+	mse.CurrentPolicy.Store(int32(policy))
+	client.PreferUTP.Store(s.Transport == "utp")
+	ratelimit.GlobalDown.SetRate(s.DownloadLimit)
+	ratelimit.GlobalUp.SetRate(s.UploadLimit)
+	storage.WriteCacheSize.Store(int64(s.WriteCache))
+	storage.ReadCacheSize.Store(int64(s.ReadCache))
+	torrent.SetStaging(torrent.Staging{IncompleteDir: s.IncompleteDir, PartSuffix: s.PartSuffix})
+
+	return nil
+}
+
+func transport() string {
+	if client.PreferUTP.Load() {
+		return "utp"
+	}
+	return "tcp"
+}
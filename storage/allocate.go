@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+)
+
+// Allocation is how the files of a torrent take up disk space before their
+// pieces arrive
+type Allocation int
+
+const (
+	// AllocateLazy lets files grow as pieces land
+	AllocateLazy Allocation = iota
+	// AllocateSparse sets files to their final size without claiming the
+	// blocks, on filesystems that support holes
+	AllocateSparse
+	// AllocateFull claims every block up front, keeping large files in one
+	// piece on disk
+	AllocateFull
+)
+
+func (a Allocation) String() string {
+	switch a {
+	case AllocateSparse:
+		return "sparse"
+	case AllocateFull:
+		return "full"
+	}
+	return "lazy"
+}
+
+func ParseAllocation(s string) (Allocation, error) {
+	switch s {
+	case "", "lazy":
+		return AllocateLazy, nil
+	case "sparse":
+		return AllocateSparse, nil
+	case "full":
+		return AllocateFull, nil
+	}
+	return AllocateLazy, fmt.Errorf("unknown allocation mode %q", s)
+}
+
+// NoSpaceError refuses a download that doesn't fit on the disk
+type NoSpaceError struct {
+	Dir    string
+	Needed int64
+	Free   int64
+}
+
+func (e *NoSpaceError) Error() string {
+	return fmt.Sprintf("not enough free space in %s: %d bytes needed, %d available",
+		e.Dir, e.Needed, e.Free)
+}
+
+// allocate gives f its final size the way the mode asks, never shrinking it
+func allocate(f *os.File, length int64, mode Allocation) error {
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if mode == AllocateLazy || info.Size() >= length {
+		return nil
+	}
+
+	if mode == AllocateFull {
+		err := fallocate(f, length)
+		if err == nil {
+			return nil
+		}
+		// filesystems without fallocate get a sparse file instead
+		if err != errNoFallocate {
+			return err
+		}
+	}
+
+	return f.Truncate(length)
+}
+
+// checkSpace makes sure the parts of the files still missing fit in dir
+func checkSpace(dir string, paths []string, lengths []int) error {
+	if dir == "" {
+		dir = "."
+	}
+
+	var needed int64
+	for i, path := range paths {
+		length := int64(lengths[i])
+		if info, err := os.Stat(path); err == nil {
+			length -= info.Size()
+		}
+		if length > 0 {
+			needed += length
+		}
+	}
+
+	free, err := freeSpace(dir)
+	if err != nil {
+		// nothing to go on, the writes will tell
+		return nil
+	}
+	if free < needed {
+		return &NoSpaceError{Dir: dir, Needed: needed, Free: free}
+	}
+	return nil
+}
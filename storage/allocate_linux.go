@@ -0,0 +1,17 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+var errNoFallocate = errors.New("fallocate isn't supported")
+
+func fallocate(f *os.File, length int64) error {
+	err := syscall.Fallocate(int(f.Fd()), 0, 0, length)
+	if err == syscall.EOPNOTSUPP || err == syscall.ENOSYS {
+		return errNoFallocate
+	}
+	return err
+}
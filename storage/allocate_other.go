@@ -0,0 +1,15 @@
+//go:build !linux
+
+package storage
+
+import (
+	"errors"
+	"os"
+)
+
+var errNoFallocate = errors.New("fallocate isn't supported")
+
+// full allocation is a Linux thing, elsewhere it falls back to sparse files
+func fallocate(f *os.File, length int64) error {
+	return errNoFallocate
+}
@@ -0,0 +1,490 @@
+package storage
+
+import (
+	"container/list"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// WriteCacheSize is how many bytes of written pieces may wait for the
+	// disk, writes block once it is full. The settings change it while
+	// downloads write.
+	WriteCacheSize atomic.Int64
+	// ReadCacheSize is how many bytes of recently read pieces are kept for
+	// serving peers, 0 turns the cache off. An Async keeps the size it was
+	// made with.
+	ReadCacheSize atomic.Int64
+	// DiskWorkers is the number of goroutines writing to the disk
+	DiskWorkers = 4
+)
+
+func init() {
+	WriteCacheSize.Store(64 << 20)
+	ReadCacheSize.Store(32 << 20)
+}
+
+// pieces waiting this long are written even if the cache isn't filling up
+const flushInterval = time.Second
+
+// rangeWriter is a storage that writes anywhere in the torrent, which lets
+// runs of contiguous pieces go out in one write
+type rangeWriter interface {
+	WriteAt(begin int, buf []byte) error
+}
+
+// Async puts a write-back cache and a pool of workers in front of another
+// storage, so writing a piece returns before it reaches the disk. Contiguous
+// pieces are written together and recently read ones are cached.
+type Async struct {
+	backend Storage
+	layout  Layout
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	// pieces waiting for a worker and the ones being written, both still
+	// served from memory. A piece written again while its last write is on
+	// its way stays dirty until that one is done, so the two can't reach the
+	// disk out of order.
+	dirty   map[int][]byte
+	writing map[int][]byte
+	// bytes in dirty and writing together
+	cached int
+	read   *lru
+	// the first failed write, returned by every call after it
+	err    error
+	closed bool
+	// a flush is on its way, so writes don't start another
+	flushing bool
+
+	runs chan []int
+	done chan struct{}
+	// flushes on their way to the queue, which Close waits for
+	senders sync.WaitGroup
+	wg      sync.WaitGroup
+}
+
+// NewAsync starts the workers writing to backend, which belongs to the Async
+// from then on and is closed along with it
+func NewAsync(backend Storage, layout Layout) *Async {
+	a := &Async{
+		backend: backend,
+		layout:  layout,
+		dirty:   map[int][]byte{},
+		writing: map[int][]byte{},
+		read:    newLRU(int(ReadCacheSize.Load())),
+		runs:    make(chan []int, DiskWorkers),
+		done:    make(chan struct{}),
+	}
+	a.cond = sync.NewCond(&a.mu)
+
+	for i := 0; i < DiskWorkers; i++ {
+		a.wg.Add(1)
+		go a.work()
+	}
+	go a.flushEvery(flushInterval)
+
+	return a
+}
+
+// WritePiece caches the piece for the workers, blocking while the cache is
+// full. A write that failed earlier is reported here.
+func (a *Async) WritePiece(index int, buf []byte) error {
+	if err := a.layout.checkPiece(index); err != nil {
+		return err
+	}
+	if len(buf) != a.layout.PieceSize(index) {
+		return fmt.Errorf("piece #%d is %d bytes, not %d", index, len(buf), a.layout.PieceSize(index))
+	}
+
+	size := int(WriteCacheSize.Load())
+	a.mu.Lock()
+	for a.err == nil && !a.closed && a.cached > 0 && a.cached+len(buf) > size {
+		if a.ready() {
+			a.mu.Unlock()
+			a.flush()
+			a.mu.Lock()
+			continue
+		}
+		a.cond.Wait()
+	}
+	defer a.mu.Unlock()
+
+	if a.err != nil {
+		return a.err
+	}
+	if a.closed {
+		return errClosed
+	}
+
+	if old, ok := a.dirty[index]; ok {
+		a.cached -= len(old)
+	}
+	a.dirty[index] = append([]byte{}, buf...)
+	a.cached += len(buf)
+	a.read.remove(index)
+
+	// start writing at half full, leaving the other half to take pieces in
+	// the meantime
+	if a.cached >= size/2 && !a.flushing {
+		a.flushing = true
+		go a.flush()
+	}
+	return nil
+}
+
+func (a *Async) ReadPiece(index int) ([]byte, error) {
+	if err := a.layout.checkPiece(index); err != nil {
+		return nil, err
+	}
+
+	a.mu.Lock()
+	buf, ok := a.dirty[index]
+	if !ok {
+		buf, ok = a.writing[index]
+	}
+	if !ok {
+		buf, ok = a.read.get(index)
+	}
+	a.mu.Unlock()
+	if ok {
+		return append([]byte{}, buf...), nil
+	}
+
+	buf, err := a.backend.ReadPiece(index)
+	if err != nil {
+		return nil, err
+	}
+
+	a.mu.Lock()
+	a.read.add(index, buf)
+	a.mu.Unlock()
+
+	return append([]byte{}, buf...), nil
+}
+
+// ReadBlock serves part of a piece from the caches. A piece that isn't in
+// them is read whole into the read cache, where the blocks that follow it
+// find it, or just the block is read when the cache is off.
+func (a *Async) ReadBlock(index, begin, length int) ([]byte, error) {
+	if err := a.layout.checkBlock(index, begin, length); err != nil {
+		return nil, err
+	}
+
+	a.mu.Lock()
+	buf, ok := a.dirty[index]
+	if !ok {
+		buf, ok = a.writing[index]
+	}
+	if !ok {
+		buf, ok = a.read.get(index)
+	}
+	a.mu.Unlock()
+	if ok {
+		return append([]byte{}, buf[begin:begin+length]...), nil
+	}
+
+	if a.read.size < a.layout.PieceSize(index) {
+		return ReadBlock(a.backend, index, begin, length)
+	}
+
+	buf, err := a.ReadPiece(index)
+	if err != nil {
+		return nil, err
+	}
+	return buf[begin : begin+length], nil
+}
+
+func (a *Async) Verify(index int, hash [20]byte) (bool, error) {
+	return verify(a, index, hash)
+}
+
+// Full tells if the write cache has no room left, so callers can hold off
+// fetching more pieces
+func (a *Async) Full() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.cached >= int(WriteCacheSize.Load())
+}
+
+// WaitRoom blocks until the write cache has room again
+func (a *Async) WaitRoom() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	size := int(WriteCacheSize.Load())
+	for a.err == nil && !a.closed && a.cached >= size {
+		if a.ready() {
+			a.mu.Unlock()
+			a.flush()
+			a.mu.Lock()
+			continue
+		}
+		a.cond.Wait()
+	}
+}
+
+// Move writes out the cache and relocates the storage behind it, holding
+// off reads and writes until it is done
+func (a *Async) Move(dir, suffix string, progress func(moved int64)) error {
+	mover, ok := a.backend.(Mover)
+	if !ok {
+		return fmt.Errorf("storage can't be moved")
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if err := a.drain(); err != nil {
+		return err
+	}
+	return mover.Move(dir, suffix, progress)
+}
+
+// Backend is the storage behind the cache, which holds every piece written
+// before the last Sync
+func (a *Async) Backend() Storage {
+	return a.backend
+}
+
+// Sync writes out the cache and returns once every piece is in the storage
+// behind it
+func (a *Async) Sync() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.drain()
+}
+
+// drain empties the write cache, called with a.mu held
+func (a *Async) drain() error {
+	for a.err == nil && !a.closed && a.cached > 0 {
+		if a.ready() {
+			a.mu.Unlock()
+			a.flush()
+			a.mu.Lock()
+			continue
+		}
+		a.cond.Wait()
+	}
+	if a.err != nil {
+		return a.err
+	}
+	if a.closed {
+		return errClosed
+	}
+	return nil
+}
+
+// Close writes out the cache and closes the storage behind it
+func (a *Async) Close() error {
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return errClosed
+	}
+	a.closed = true
+	close(a.done)
+	a.cond.Broadcast()
+
+	// pieces held back behind an earlier write of theirs go once it is done
+	for {
+		runs := a.takeRuns()
+		held := len(a.dirty) > 0
+		a.mu.Unlock()
+
+		a.queue(runs)
+		if !held {
+			break
+		}
+
+		a.mu.Lock()
+		for !a.ready() {
+			a.cond.Wait()
+		}
+	}
+	a.senders.Wait()
+	close(a.runs)
+	a.wg.Wait()
+
+	err := a.backend.Close()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.err != nil {
+		return a.err
+	}
+	return err
+}
+
+// ready tells if a dirty piece can go to the workers, one that isn't being
+// written already. Called with a.mu held.
+func (a *Async) ready() bool {
+	for index := range a.dirty {
+		if _, ok := a.writing[index]; !ok {
+			return true
+		}
+	}
+	return false
+}
+
+// takeRuns moves the dirty pieces that aren't being written already to
+// writing, grouped in runs of contiguous pieces
+func (a *Async) takeRuns() [][]int {
+	indexes := make([]int, 0, len(a.dirty))
+	for index, buf := range a.dirty {
+		if _, ok := a.writing[index]; ok {
+			continue
+		}
+		indexes = append(indexes, index)
+		a.writing[index] = buf
+		delete(a.dirty, index)
+	}
+	sort.Ints(indexes)
+
+	var runs [][]int
+	for i, index := range indexes {
+		if i > 0 && indexes[i-1] == index-1 {
+			runs[len(runs)-1] = append(runs[len(runs)-1], index)
+		} else {
+			runs = append(runs, []int{index})
+		}
+	}
+	return runs
+}
+
+// flush queues the dirty pieces for the workers, unless Close did already
+func (a *Async) flush() {
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return
+	}
+	runs := a.takeRuns()
+	a.flushing = false
+	a.senders.Add(1)
+	a.mu.Unlock()
+
+	defer a.senders.Done()
+	a.queue(runs)
+}
+
+// queue hands runs to the workers, blocking while they are all busy
+func (a *Async) queue(runs [][]int) {
+	for _, run := range runs {
+		a.runs <- run
+	}
+}
+
+func (a *Async) flushEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-a.done:
+			return
+		case <-ticker.C:
+			a.flush()
+		}
+	}
+}
+
+func (a *Async) work() {
+	defer a.wg.Done()
+
+	for run := range a.runs {
+		a.mu.Lock()
+		bufs := make([][]byte, len(run))
+		size := 0
+		for i, index := range run {
+			bufs[i] = a.writing[index]
+			size += len(bufs[i])
+		}
+		a.mu.Unlock()
+
+		err := a.write(run, bufs, size)
+
+		a.mu.Lock()
+		for _, index := range run {
+			delete(a.writing, index)
+		}
+		a.cached -= size
+		if err != nil && a.err == nil {
+			a.err = err
+		}
+		a.cond.Broadcast()
+		a.mu.Unlock()
+	}
+}
+
+func (a *Async) write(run []int, bufs [][]byte, size int) error {
+	writer, ok := a.backend.(rangeWriter)
+	if !ok || len(run) == 1 {
+		for i, index := range run {
+			if err := a.backend.WritePiece(index, bufs[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	buf := make([]byte, 0, size)
+	for _, b := range bufs {
+		buf = append(buf, b...)
+	}
+	return writer.WriteAt(run[0]*a.layout.PieceLength, buf)
+}
+
+type lruEntry struct {
+	index int
+	buf   []byte
+}
+
+// lru keeps pieces up to a number of bytes, dropping the least recently used
+type lru struct {
+	size    int
+	used    int
+	order   *list.List
+	entries map[int]*list.Element
+}
+
+func newLRU(size int) *lru {
+	return &lru{size: size, order: list.New(), entries: map[int]*list.Element{}}
+}
+
+func (l *lru) get(index int) ([]byte, bool) {
+	e, ok := l.entries[index]
+	if !ok {
+		return nil, false
+	}
+	l.order.MoveToFront(e)
+	return e.Value.(*lruEntry).buf, true
+}
+
+func (l *lru) add(index int, buf []byte) {
+	if len(buf) > l.size {
+		return
+	}
+	l.remove(index)
+
+	l.entries[index] = l.order.PushFront(&lruEntry{index, buf})
+	l.used += len(buf)
+	for l.used > l.size {
+		l.remove(l.order.Back().Value.(*lruEntry).index)
+	}
+}
+
+func (l *lru) remove(index int) {
+	e, ok := l.entries[index]
+	if !ok {
+		return
+	}
+	l.order.Remove(e)
+	delete(l.entries, index)
+	l.used -= len(e.Value.(*lruEntry).buf)
+}
@@ -0,0 +1,227 @@
+package storage
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+var errFailing = errors.New("disk on fire")
+
+// plain is a single file torrent of n pieces of 16 bytes
+func plain(n int) (Layout, []byte) {
+	layout := Layout{
+		Name:        "plain",
+		PieceLength: 16,
+		Length:      n * 16,
+		Files:       []File{{Length: n * 16, Path: []string{"plain"}}},
+	}
+
+	data := make([]byte, layout.Length)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	return layout, data
+}
+
+// recording keeps pieces in memory and notes the pieces each write to it
+// carried. Writes wait for gate when there is one and writes of piece fail
+// fail.
+type recording struct {
+	*MemoryStorage
+	layout Layout
+	gate   chan struct{}
+	fail   int
+
+	mu     sync.Mutex
+	writes [][]int
+}
+
+func newRecording(layout Layout) *recording {
+	return &recording{MemoryStorage: NewMemory(layout), layout: layout, fail: -1}
+}
+
+func (s *recording) WritePiece(index int, buf []byte) error {
+	return s.WriteAt(index*s.layout.PieceLength, buf)
+}
+
+func (s *recording) WriteAt(begin int, buf []byte) error {
+	if s.gate != nil {
+		<-s.gate
+	}
+
+	var pieces []int
+	for at := 0; at < len(buf); {
+		index := (begin + at) / s.layout.PieceLength
+		size := s.layout.PieceSize(index)
+		pieces = append(pieces, index)
+		if index == s.fail {
+			return errFailing
+		}
+		if err := s.MemoryStorage.WritePiece(index, buf[at:at+size]); err != nil {
+			return err
+		}
+		at += size
+	}
+
+	s.mu.Lock()
+	s.writes = append(s.writes, pieces)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *recording) written() [][]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([][]int{}, s.writes...)
+}
+
+func TestAsyncCoalesces(t *testing.T) {
+	layout, data := plain(8)
+	backend := newRecording(layout)
+	a := NewAsync(backend, layout)
+	defer a.Close()
+
+	// out of order, with a gap after piece 2 and after piece 5
+	for _, index := range []int{2, 0, 1, 4, 5, 7} {
+		begin := index * layout.PieceLength
+		if err := a.WritePiece(index, data[begin:begin+layout.PieceLength]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := a.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	writes := map[int][]int{}
+	for _, pieces := range backend.written() {
+		writes[pieces[0]] = pieces
+	}
+	want := map[int][]int{0: {0, 1, 2}, 4: {4, 5}, 7: {7}}
+	if !reflect.DeepEqual(writes, want) {
+		t.Errorf("the pieces went out in writes of %v, want %v", writes, want)
+	}
+}
+
+func TestAsyncBackpressure(t *testing.T) {
+	defer WriteCacheSize.Store(WriteCacheSize.Load())
+	layout, data := plain(4)
+	WriteCacheSize.Store(int64(2 * layout.PieceLength))
+
+	backend := newRecording(layout)
+	backend.gate = make(chan struct{})
+	a := NewAsync(backend, layout)
+	defer a.Close()
+
+	for index := 0; index < 2; index++ {
+		begin := index * layout.PieceLength
+		if err := a.WritePiece(index, data[begin:begin+layout.PieceLength]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !a.Full() {
+		t.Error("the cache isn't full with two pieces in it")
+	}
+
+	// the disk holds the first two, so the third waits for room
+	written := make(chan error)
+	go func() {
+		written <- a.WritePiece(2, data[32:48])
+	}()
+	select {
+	case <-written:
+		t.Fatal("a write went past a full cache")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(backend.gate)
+	select {
+	case err := <-written:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the write waited on after the disk caught up")
+	}
+	a.WaitRoom()
+	if err := a.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	checkBlocks(t, backend, Layout{PieceLength: 16, Length: 48}, data[:48])
+}
+
+func TestAsyncWriteError(t *testing.T) {
+	layout, data := plain(4)
+	backend := newRecording(layout)
+	backend.fail = 1
+	a := NewAsync(backend, layout)
+
+	// the write is taken, it fails later on the disk
+	if err := a.WritePiece(1, data[16:32]); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Sync(); !errors.Is(err, errFailing) {
+		t.Errorf("Sync: got %v, want %v", err, errFailing)
+	}
+	if err := a.WritePiece(2, data[32:48]); !errors.Is(err, errFailing) {
+		t.Errorf("the next write: got %v, want %v", err, errFailing)
+	}
+	if err := a.Close(); !errors.Is(err, errFailing) {
+		t.Errorf("Close: got %v, want %v", err, errFailing)
+	}
+}
+
+func TestAsyncRewrite(t *testing.T) {
+	layout, data := plain(4)
+	backend := newRecording(layout)
+	backend.gate = make(chan struct{})
+	a := NewAsync(backend, layout)
+	defer a.Close()
+
+	old, rewritten := data[16:32], data[32:48]
+	if err := a.WritePiece(1, old); err != nil {
+		t.Fatal(err)
+	}
+	a.flush()
+
+	// written again while the disk holds the first write, and twice before
+	// it goes anywhere
+	for _, buf := range [][]byte{old, rewritten} {
+		if err := a.WritePiece(1, buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a.flush()
+	if buf, err := a.ReadPiece(1); err != nil || !reflect.DeepEqual(buf, rewritten) {
+		t.Errorf("read %v, %v while the rewrite waits", buf, err)
+	}
+
+	close(backend.gate)
+	synced := make(chan error)
+	go func() {
+		synced <- a.Sync()
+	}()
+	select {
+	case err := <-synced:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Sync waited on after both writes")
+	}
+
+	if writes := backend.written(); !reflect.DeepEqual(writes, [][]int{{1}, {1}}) {
+		t.Errorf("the piece went out in writes of %v, want two in a row", writes)
+	}
+	if buf, err := backend.ReadPiece(1); err != nil || !reflect.DeepEqual(buf, rewritten) {
+		t.Errorf("the disk holds %v, %v, not the rewrite", buf, err)
+	}
+	a.mu.Lock()
+	cached := a.cached
+	a.mu.Unlock()
+	if cached != 0 {
+		t.Errorf("%d bytes counted in the cache once it is written out", cached)
+	}
+}
@@ -0,0 +1,65 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// BEP 47 file attributes, each one a letter of File.Attr
+
+// Padding files only align the next file to a piece, they are all zeros
+// and never touch the disk
+func (f File) Padding() bool {
+	return strings.Contains(f.Attr, "p")
+}
+
+func (f File) Executable() bool {
+	return strings.Contains(f.Attr, "x")
+}
+
+func (f File) Hidden() bool {
+	return strings.Contains(f.Attr, "h")
+}
+
+// Symlink files point at SymlinkPath and hold no data
+func (f File) Symlink() bool {
+	return strings.Contains(f.Attr, "l")
+}
+
+// symlink makes path a link to the file target points at inside the
+// torrent's directory root. The link is relative so the torrent can move.
+func symlink(root, path string, target []string) error {
+	to := filepath.Join(append([]string{root}, target...)...)
+	if len(target) == 0 || !within(root, to) || filepath.Clean(to) == filepath.Clean(root) {
+		return fmt.Errorf("symlink %s points outside %s", path, root)
+	}
+
+	link, err := filepath.Rel(filepath.Dir(path), to)
+	if err != nil {
+		return err
+	}
+
+	// a link left by an earlier run stays, anything else there is replaced
+	if current, err := os.Readlink(path); err == nil && current == link {
+		return nil
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Symlink(link, path)
+}
+
+// applyAttr gives a file on disk the permissions and flags it asks for
+func applyAttr(f *os.File, file File) error {
+	if file.Executable() {
+		if err := f.Chmod(0755); err != nil {
+			return err
+		}
+	}
+	if file.Hidden() {
+		return hide(f.Name())
+	}
+	return nil
+}
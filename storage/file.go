@@ -0,0 +1,205 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// FileStorage keeps the pieces in the torrent's files under a directory,
+// the way other clients lay them out
+type FileStorage struct {
+	layout Layout
+	// held for writing only by Close and Move, positional reads and writes
+	// run side by side
+	mu    sync.RWMutex
+	dir   string
+	paths []string
+	files []*os.File
+}
+
+// NewFile creates the torrent's files under dir, keeping whatever they
+// already hold so an interrupted download can be rechecked and resumed.
+// Every file name gets suffix, like ".part" while the download runs. It
+// refuses with a NoSpaceError when the rest of the files won't fit.
+func NewFile(dir string, layout Layout, mode Allocation, suffix string) (*FileStorage, error) {
+	paths, lengths := layout.Paths(dir, suffix), layout.lengths()
+	s := &FileStorage{layout: layout, dir: dir, paths: paths}
+
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	if err := checkSpace(dir, paths, lengths); err != nil {
+		return nil, err
+	}
+
+	for _, path := range paths {
+		if !within(dir, path) {
+			return nil, fmt.Errorf("%s is outside %s", path, dir)
+		}
+	}
+
+	files := layout.files()
+	s.files = make([]*os.File, len(paths))
+	for i, path := range paths {
+		// padding stays virtual and symlinks have no file to keep open
+		if files[i].Padding() {
+			continue
+		}
+
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+
+		if files[i].Symlink() {
+			err := symlink(filepath.Join(dir, layout.Name), path, files[i].SymlinkPath)
+			if err != nil {
+				s.Close()
+				return nil, err
+			}
+			continue
+		}
+
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.files[i] = f
+
+		if err := allocate(f, int64(lengths[i]), mode); err != nil {
+			s.Close()
+			return nil, err
+		}
+		if err := applyAttr(f, files[i]); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// Paths lists where each file of the torrent is kept
+func (s *FileStorage) Paths() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return append([]string{}, s.paths...)
+}
+
+// Dir is the directory the torrent is kept in
+func (s *FileStorage) Dir() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.dir
+}
+
+// within tells if path stays under dir once cleaned up
+func within(dir, path string) bool {
+	rel, err := filepath.Rel(filepath.Clean("./"+dir), filepath.Clean("./"+path))
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+func (s *FileStorage) WritePiece(index int, buf []byte) error {
+	if err := s.layout.checkPiece(index); err != nil {
+		return err
+	}
+	if len(buf) != s.layout.PieceSize(index) {
+		return fmt.Errorf("piece #%d is %d bytes, not %d", index, len(buf), s.layout.PieceSize(index))
+	}
+
+	return s.WriteAt(index*s.layout.PieceLength, buf)
+}
+
+// WriteAt writes buf at begin of the torrent, over as many files as it
+// spans, so runs of pieces go out in one call per file
+func (s *FileStorage) WriteAt(begin int, buf []byte) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.files == nil {
+		return errClosed
+	}
+	for _, span := range s.layout.Spans(begin, len(buf)) {
+		if f := s.files[span.File]; f != nil {
+			_, err := f.WriteAt(buf[:span.Length], span.Offset)
+			if err != nil {
+				return err
+			}
+		}
+		buf = buf[span.Length:]
+	}
+
+	return nil
+}
+
+func (s *FileStorage) ReadPiece(index int) ([]byte, error) {
+	if err := s.layout.checkPiece(index); err != nil {
+		return nil, err
+	}
+
+	return s.ReadBlock(index, 0, s.layout.PieceSize(index))
+}
+
+// ReadBlock reads only the part of a piece a peer asked for
+func (s *FileStorage) ReadBlock(index, begin, length int) ([]byte, error) {
+	if err := s.layout.checkBlock(index, begin, length); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.files == nil {
+		return nil, errClosed
+	}
+	buf := make([]byte, length)
+	pos := 0
+	for _, span := range s.layout.Spans(index*s.layout.PieceLength+begin, length) {
+		// padding reads as the zeros it is made of
+		if s.files[span.File] == nil {
+			pos += span.Length
+			continue
+		}
+		_, err := s.files[span.File].ReadAt(buf[pos:pos+span.Length], span.Offset)
+		if err == io.EOF {
+			return nil, fmt.Errorf("piece #%d isn't written yet", index)
+		}
+		if err != nil {
+			return nil, err
+		}
+		pos += span.Length
+	}
+
+	return buf, nil
+}
+
+func (s *FileStorage) Verify(index int, hash [20]byte) (bool, error) {
+	return verify(s, index, hash)
+}
+
+func (s *FileStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var first error
+	for _, f := range s.files {
+		if f == nil {
+			continue
+		}
+		if err := f.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	s.files = nil
+	return first
+}
@@ -0,0 +1,9 @@
+//go:build !windows
+
+package storage
+
+// elsewhere hidden files are the ones whose name starts with a dot, and
+// renaming them would break the torrent's layout
+func hide(path string) error {
+	return nil
+}
@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"fmt"
+	"sync"
+)
+
+// MemoryStorage keeps the pieces in memory, for downloads that don't need
+// to outlive the process
+type MemoryStorage struct {
+	layout Layout
+	mu     sync.Mutex
+	pieces map[int][]byte
+}
+
+func NewMemory(layout Layout) *MemoryStorage {
+	return &MemoryStorage{layout: layout, pieces: map[int][]byte{}}
+}
+
+func (s *MemoryStorage) WritePiece(index int, buf []byte) error {
+	if err := s.layout.checkPiece(index); err != nil {
+		return err
+	}
+	if len(buf) != s.layout.PieceSize(index) {
+		return fmt.Errorf("piece #%d is %d bytes, not %d", index, len(buf), s.layout.PieceSize(index))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.pieces[index] = append([]byte{}, buf...)
+	return nil
+}
+
+func (s *MemoryStorage) ReadPiece(index int) ([]byte, error) {
+	if err := s.layout.checkPiece(index); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	buf, ok := s.pieces[index]
+	if !ok {
+		return nil, fmt.Errorf("piece #%d isn't written yet", index)
+	}
+	return append([]byte{}, buf...), nil
+}
+
+func (s *MemoryStorage) ReadBlock(index, begin, length int) ([]byte, error) {
+	if err := s.layout.checkBlock(index, begin, length); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	buf, ok := s.pieces[index]
+	if !ok {
+		return nil, fmt.Errorf("piece #%d isn't written yet", index)
+	}
+	return append([]byte{}, buf[begin:begin+length]...), nil
+}
+
+func (s *MemoryStorage) Verify(index int, hash [20]byte) (bool, error) {
+	return verify(s, index, hash)
+}
+
+func (s *MemoryStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.pieces = map[int][]byte{}
+	return nil
+}
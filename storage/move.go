@@ -0,0 +1,217 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Mover is a storage whose files can be relocated while it is in use
+type Mover interface {
+	// Move puts the files under dir with suffix on their names, calling
+	// progress, when not nil, with the bytes moved so far
+	Move(dir, suffix string, progress func(moved int64)) error
+}
+
+// Move relocates the files to dir, renaming them when dir is on the same
+// filesystem and copying them over otherwise. Reads and writes wait until
+// it is done. Files already at the destination are never overwritten, the
+// move fails before it starts instead. Files that moved before a failure
+// stay moved and keep being used from there.
+func (s *FileStorage) Move(dir, suffix string, progress func(moved int64)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.files == nil {
+		return errClosed
+	}
+
+	paths := s.layout.Paths(dir, suffix)
+	if err := checkMove(s.layout, dir, s.paths, paths); err != nil {
+		return err
+	}
+
+	// files are closed while they move, which Windows needs, and reopened
+	// wherever they ended up
+	for _, f := range s.files {
+		if f != nil {
+			f.Close()
+		}
+	}
+
+	err := moveFiles(s.layout, s.dir, s.paths, paths, progress, func(i int) {
+		s.paths[i] = paths[i]
+	})
+	if err == nil {
+		s.dir = dir
+	}
+
+	for i, path := range s.paths {
+		if s.files[i] == nil {
+			continue
+		}
+		f, openErr := os.OpenFile(path, os.O_RDWR, 0644)
+		if openErr != nil {
+			for _, opened := range s.files[:i] {
+				if opened != nil {
+					opened.Close()
+				}
+			}
+			s.files = nil
+			return openErr
+		}
+		s.files[i] = f
+	}
+
+	return err
+}
+
+// MoveFiles relocates the files of a torrent that isn't running from one
+// directory to another, without opening them. Files that were never written
+// are left out, the rest move like FileStorage.Move moves them.
+func MoveFiles(layout Layout, from, to, suffix string, progress func(moved int64)) error {
+	current, paths := layout.Paths(from, suffix), layout.Paths(to, suffix)
+	for i, path := range current {
+		if _, err := os.Lstat(path); errors.Is(err, os.ErrNotExist) {
+			current[i] = paths[i]
+		}
+	}
+	if err := checkMove(layout, to, current, paths); err != nil {
+		return err
+	}
+
+	return moveFiles(layout, from, current, paths, progress, func(int) {})
+}
+
+// checkMove makes sure the files can go from current to paths under dir,
+// with nothing in their way
+func checkMove(layout Layout, dir string, current, paths []string) error {
+	for i, path := range paths {
+		if !within(dir, path) {
+			return fmt.Errorf("%s is outside %s", path, dir)
+		}
+		if path == current[i] || layout.Virtual(i) {
+			continue
+		}
+		if _, err := os.Lstat(path); err == nil {
+			return &os.PathError{Op: "move", Path: path, Err: os.ErrExist}
+		}
+	}
+	return nil
+}
+
+// moveFiles moves each file from current to paths, removing the directories
+// it leaves empty under root and calling moved with the index of each one
+// that got there. It stops at the first file that fails to move.
+func moveFiles(layout Layout, root string, current, paths []string, progress func(moved int64),
+	moved func(i int)) error {
+
+	if progress == nil {
+		progress = func(int64) {}
+	}
+
+	var total int64
+	lengths := layout.lengths()
+	for i, path := range paths {
+		if path != current[i] && !layout.Virtual(i) {
+			err := moveFile(current[i], path, func(n int64) {
+				progress(total + n)
+			})
+			if err != nil {
+				return err
+			}
+		}
+		removeEmptyDirs(filepath.Dir(current[i]), root)
+		moved(i)
+		total += int64(lengths[i])
+		progress(total)
+	}
+	return nil
+}
+
+// moveFile renames from to to, or copies it when they are on different
+// filesystems. The copy gets its final name only once it is whole.
+func moveFile(from, to string, copied func(n int64)) error {
+	if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+		return err
+	}
+
+	err := os.Rename(from, to)
+	if err == nil || !crossDevice(err) {
+		return err
+	}
+
+	// symlinks are relative, so a copy of the link itself still works
+	if link, err := os.Readlink(from); err == nil {
+		if err := os.Symlink(link, to); err != nil {
+			return err
+		}
+		return os.Remove(from)
+	}
+
+	tmp := to + ".moving"
+	if err := copyFile(from, tmp, copied); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, to); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Remove(from)
+}
+
+// progressWriter reports the bytes written through it so far
+type progressWriter struct {
+	io.Writer
+	written  int64
+	progress func(n int64)
+}
+
+func (w *progressWriter) Write(b []byte) (int, error) {
+	n, err := w.Writer.Write(b)
+	w.written += int64(n)
+	w.progress(w.written)
+	return n, err
+}
+
+func copyFile(from, to string, copied func(n int64)) error {
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	dst, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(&progressWriter{Writer: dst, progress: copied}, src); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Sync(); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+// removeEmptyDirs removes dir and its parents up to root, stopping at the
+// first one that isn't empty
+func removeEmptyDirs(dir, root string) {
+	for within(root, dir) && filepath.Clean(dir) != filepath.Clean(root) {
+		if os.Remove(dir) != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !windows
+
+package storage
+
+import (
+	"errors"
+	"syscall"
+)
+
+// crossDevice tells if a rename failed only because it would cross
+// filesystems, which a copy gets around
+func crossDevice(err error) bool {
+	return errors.Is(err, syscall.EXDEV)
+}
@@ -0,0 +1,13 @@
+package storage
+
+import (
+	"errors"
+	"syscall"
+)
+
+// errorNotSameDevice is what renames to another volume fail with
+const errorNotSameDevice syscall.Errno = 17
+
+func crossDevice(err error) bool {
+	return errors.Is(err, errorNotSameDevice)
+}
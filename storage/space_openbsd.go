@@ -0,0 +1,11 @@
+package storage
+
+import "syscall"
+
+func freeSpace(dir string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	return stat.F_bavail * int64(stat.F_bsize), nil
+}
@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !freebsd && !dragonfly && !openbsd && !windows
+
+package storage
+
+import "errors"
+
+func freeSpace(dir string) (int64, error) {
+	return 0, errors.New("free space is unknown on this system")
+}
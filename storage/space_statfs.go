@@ -0,0 +1,15 @@
+//go:build linux || darwin || freebsd || dragonfly
+
+package storage
+
+import "syscall"
+
+// freeSpace is what an unprivileged user can still write to the
+// filesystem of dir, the blocks kept for root left out
+func freeSpace(dir string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
@@ -0,0 +1,200 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"path/filepath"
+)
+
+var errClosed = errors.New("storage is closed")
+
+type File struct {
+	Length int
+	// where the file is kept, made safe for the local filesystem
+	Path []string
+	// the path as the torrent lists it, which mirrors serve the file under.
+	// Path stands in for it when it is nil.
+	OriginalPath []string
+	// BEP 47 attributes, see attr.go
+	Attr string
+	// where a symlink file points, relative to the torrent's directory
+	SymlinkPath []string
+}
+
+// Layout describes how the pieces of a torrent are laid over its files
+type Layout struct {
+	Name        string
+	PieceLength int
+	Length      int
+	// empty for single file torrents, whose only file is Name
+	Files []File
+	// attributes of the only file of single file torrents
+	Attr string
+}
+
+// Span is the part of a piece that lives in one file
+type Span struct {
+	// index of the file in Layout.Files, 0 for single file torrents
+	File   int
+	Offset int64
+	Length int
+}
+
+// Storage keeps the pieces of a torrent, wherever they end up
+type Storage interface {
+	// WritePiece stores a whole piece, buf must hold all of it
+	WritePiece(index int, buf []byte) error
+	ReadPiece(index int) ([]byte, error)
+	// Verify tells if the stored piece matches its hash, a piece that
+	// can't be read just doesn't
+	Verify(index int, hash [20]byte) (bool, error)
+	Close() error
+}
+
+// blockReader is a storage that reads part of a piece without the rest of
+// it, which is how peers ask for them
+type blockReader interface {
+	ReadBlock(index, begin, length int) ([]byte, error)
+}
+
+// ReadBlock reads length bytes at begin of a piece, only those when the
+// storage can and the whole piece otherwise
+func ReadBlock(s Storage, index, begin, length int) ([]byte, error) {
+	if reader, ok := s.(blockReader); ok {
+		return reader.ReadBlock(index, begin, length)
+	}
+
+	buf, err := s.ReadPiece(index)
+	if err != nil {
+		return nil, err
+	}
+	if begin < 0 || length < 0 || begin+length > len(buf) {
+		return nil, fmt.Errorf("block %d+%d is outside piece #%d", begin, length, index)
+	}
+	return buf[begin : begin+length], nil
+}
+
+// NumPieces is the number of pieces of the torrent
+func (l Layout) NumPieces() int {
+	if l.PieceLength <= 0 {
+		return 0
+	}
+	return (l.Length + l.PieceLength - 1) / l.PieceLength
+}
+
+// PieceSize is the length of a piece, the last one is usually shorter
+func (l Layout) PieceSize(index int) int {
+	begin := index * l.PieceLength
+	end := begin + l.PieceLength
+	if end > l.Length {
+		end = l.Length
+	}
+	return end - begin
+}
+
+func (l Layout) checkPiece(index int) error {
+	if index < 0 || index >= l.NumPieces() {
+		return fmt.Errorf("piece #%d out of range", index)
+	}
+	return nil
+}
+
+func (l Layout) checkBlock(index, begin, length int) error {
+	if err := l.checkPiece(index); err != nil {
+		return err
+	}
+	if begin < 0 || length < 0 || begin+length > l.PieceSize(index) {
+		return fmt.Errorf("block %d+%d is outside piece #%d", begin, length, index)
+	}
+	return nil
+}
+
+// Spans maps length bytes at begin of the torrent onto its files, skipping
+// the empty ones
+func (l Layout) Spans(begin, length int) []Span {
+	if len(l.Files) == 0 {
+		return []Span{{0, int64(begin), length}}
+	}
+
+	var spans []Span
+	fileStart := 0
+	for i, file := range l.Files {
+		fileEnd := fileStart + file.Length
+
+		if begin < fileEnd && length > 0 && file.Length > 0 {
+			n := fileEnd - begin
+			if n > length {
+				n = length
+			}
+			spans = append(spans, Span{i, int64(begin - fileStart), n})
+			begin += n
+			length -= n
+		}
+
+		fileStart = fileEnd
+	}
+
+	return spans
+}
+
+// Paths lists where the files of the torrent go under dir, with suffix
+// added to their names. Symlinks hold no data and never get the suffix.
+func (l Layout) Paths(dir, suffix string) []string {
+	if len(l.Files) == 0 {
+		return []string{filepath.Join(dir, l.Name+suffix)}
+	}
+
+	var paths []string
+	for _, file := range l.Files {
+		path := filepath.Join(append([]string{dir, l.Name}, file.Path...)...)
+		if !file.Symlink() {
+			path += suffix
+		}
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+// files lists every file, the single file too
+func (l Layout) files() []File {
+	if len(l.Files) == 0 {
+		return []File{{Length: l.Length, Path: []string{l.Name}, Attr: l.Attr}}
+	}
+	return l.Files
+}
+
+// lengths lists the bytes every file takes on disk, none for padding
+func (l Layout) lengths() []int {
+	lengths := []int{}
+	for _, file := range l.files() {
+		if file.Padding() {
+			lengths = append(lengths, 0)
+		} else {
+			lengths = append(lengths, file.Length)
+		}
+	}
+	return lengths
+}
+
+// Virtual tells if a file of the torrent is never kept on disk
+func (l Layout) Virtual(file int) bool {
+	return file < len(l.Files) && l.Files[file].Padding()
+}
+
+// PieceSpans maps a whole piece onto the files
+func (l Layout) PieceSpans(index int) []Span {
+	return l.Spans(index*l.PieceLength, l.PieceSize(index))
+}
+
+// verify is the Verify of storages that can read their pieces back
+func verify(s Storage, index int, hash [20]byte) (bool, error) {
+	buf, err := s.ReadPiece(index)
+	if err != nil {
+		return false, nil
+	}
+
+	sum := sha1.Sum(buf)
+	return bytes.Equal(sum[:], hash[:]), nil
+}
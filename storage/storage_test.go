@@ -0,0 +1,265 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// padded is a torrent of three pieces over two files with padding between
+// them, and the bytes it is made of
+func padded() (Layout, []byte) {
+	layout := Layout{
+		Name:        "padded",
+		PieceLength: 16,
+		Length:      36,
+		Files: []File{
+			{Length: 10, Path: []string{"a"}},
+			{Length: 6, Path: []string{".pad", "6"}, Attr: "p"},
+			{Length: 20, Path: []string{"b"}},
+		},
+	}
+
+	data := make([]byte, layout.Length)
+	for i := range data {
+		data[i] = byte(i + 1)
+	}
+	// padding is zeros
+	copy(data[10:16], make([]byte, 6))
+	return layout, data
+}
+
+func writeAll(t *testing.T, s Storage, layout Layout, data []byte) {
+	t.Helper()
+	for index := 0; index < layout.NumPieces(); index++ {
+		begin := index * layout.PieceLength
+		if err := s.WritePiece(index, data[begin:begin+layout.PieceSize(index)]); err != nil {
+			t.Fatalf("piece #%d: %v", index, err)
+		}
+	}
+}
+
+// checkBlocks reads every block of every piece and compares it with data
+func checkBlocks(t *testing.T, s Storage, layout Layout, data []byte) {
+	t.Helper()
+	for index := 0; index < layout.NumPieces(); index++ {
+		size := layout.PieceSize(index)
+		for begin := 0; begin < size; begin++ {
+			for length := 0; begin+length <= size; length++ {
+				buf, err := ReadBlock(s, index, begin, length)
+				if err != nil {
+					t.Fatalf("block %d+%d of piece #%d: %v", begin, length, index, err)
+				}
+				at := index*layout.PieceLength + begin
+				if !bytes.Equal(buf, data[at:at+length]) {
+					t.Fatalf("block %d+%d of piece #%d is %v, want %v", begin, length, index, buf,
+						data[at:at+length])
+				}
+			}
+		}
+	}
+}
+
+func TestMemory(t *testing.T) {
+	layout, data := padded()
+	s := NewMemory(layout)
+
+	if _, err := s.ReadBlock(0, 0, 4); err == nil {
+		t.Error("read a piece that isn't written")
+	}
+	err := s.WritePiece(0, data[:3])
+	if err == nil || !strings.Contains(err.Error(), "is 3 bytes, not 16") {
+		t.Errorf("short piece: got %v", err)
+	}
+	if err := s.WritePiece(3, data[:4]); err == nil {
+		t.Error("wrote a piece out of range")
+	}
+
+	writeAll(t, s, layout, data)
+	checkBlocks(t, s, layout, data)
+
+	for index := 0; index < layout.NumPieces(); index++ {
+		begin := index * layout.PieceLength
+		ok, err := s.Verify(index, sha1.Sum(data[begin:begin+layout.PieceSize(index)]))
+		if !ok || err != nil {
+			t.Errorf("piece #%d doesn't verify: %v", index, err)
+		}
+	}
+	if ok, _ := s.Verify(0, sha1.Sum(nil)); ok {
+		t.Error("piece #0 verifies against the wrong hash")
+	}
+
+	// what is read is a copy
+	buf, _ := s.ReadBlock(0, 0, 4)
+	buf[0]++
+	if again, _ := s.ReadBlock(0, 0, 4); again[0] != data[0] {
+		t.Error("changing a block changed the stored piece")
+	}
+
+	for _, block := range [][3]int{{0, -1, 4}, {0, 12, 5}, {2, 0, 5}, {3, 0, 1}, {0, 0, -1}} {
+		if _, err := s.ReadBlock(block[0], block[1], block[2]); err == nil {
+			t.Errorf("read block %d+%d of piece #%d", block[1], block[2], block[0])
+		}
+	}
+
+	s.Close()
+	if _, err := s.ReadPiece(0); err == nil {
+		t.Error("read a piece after Close")
+	}
+}
+
+func TestFileReadBlock(t *testing.T) {
+	layout, data := padded()
+	s, err := NewFile(t.TempDir(), layout, AllocateLazy, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if _, err := s.ReadBlock(2, 0, 4); err == nil {
+		t.Error("read a piece that isn't written")
+	}
+
+	writeAll(t, s, layout, data)
+	checkBlocks(t, s, layout, data)
+
+	if _, err := s.ReadBlock(0, 10, 7); err == nil {
+		t.Error("read past the end of piece #0")
+	}
+}
+
+// pieceOnly hides the ReadBlock of the storage it holds
+type pieceOnly struct {
+	Storage
+}
+
+func TestReadBlockFallback(t *testing.T) {
+	layout, data := padded()
+	s := pieceOnly{NewMemory(layout)}
+
+	writeAll(t, s, layout, data)
+	checkBlocks(t, s, layout, data)
+
+	if _, err := ReadBlock(s, 2, 2, 3); err == nil {
+		t.Error("read past the end of the last piece")
+	}
+}
+
+func TestAsyncReadBlock(t *testing.T) {
+	layout, data := padded()
+	backend := NewMemory(layout)
+	a := NewAsync(backend, layout)
+	defer a.Close()
+
+	// from the write cache, then from the storage behind it
+	writeAll(t, a, layout, data)
+	checkBlocks(t, a, layout, data)
+	if err := a.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	checkBlocks(t, backend, layout, data)
+	checkBlocks(t, a, layout, data)
+}
+
+func TestMove(t *testing.T) {
+	layout, data := padded()
+	from, to := t.TempDir(), t.TempDir()
+	s, err := NewFile(from, layout, AllocateLazy, ".part")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	writeAll(t, s, layout, data)
+
+	// a file in the way stops the move before anything moves
+	taken := layout.Paths(to, "")[2]
+	if err := os.MkdirAll(filepath.Dir(taken), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(taken, []byte("mine"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Move(to, "", nil); !errors.Is(err, os.ErrExist) {
+		t.Fatalf("got %v, want %v", err, os.ErrExist)
+	}
+	if s.Dir() != from {
+		t.Errorf("the failed move left the storage in %s", s.Dir())
+	}
+	if mine, _ := os.ReadFile(taken); string(mine) != "mine" {
+		t.Errorf("the file in the way was overwritten with %q", mine)
+	}
+	checkBlocks(t, s, layout, data)
+
+	os.Remove(taken)
+	moved := int64(0)
+	if err := s.Move(to, "", func(n int64) { moved = n }); err != nil {
+		t.Fatal(err)
+	}
+	if s.Dir() != to || moved != 30 {
+		t.Errorf("moved %d bytes to %s", moved, s.Dir())
+	}
+	for _, path := range layout.Paths(from, ".part") {
+		if _, err := os.Lstat(path); err == nil {
+			t.Errorf("%s is still there", path)
+		}
+	}
+	checkBlocks(t, s, layout, data)
+}
+
+func TestMoveFiles(t *testing.T) {
+	layout, data := padded()
+	from, to := t.TempDir(), t.TempDir()
+	s, err := NewFile(from, layout, AllocateLazy, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeAll(t, s, layout, data)
+	s.Close()
+
+	// a file that was never written isn't made up at the destination
+	paths := layout.Paths(from, "")
+	os.Remove(paths[0])
+
+	moved := int64(0)
+	if err := MoveFiles(layout, from, to, "", func(n int64) { moved = n }); err != nil {
+		t.Fatal(err)
+	}
+	if moved != 30 {
+		t.Errorf("moved %d bytes", moved)
+	}
+	for i, path := range layout.Paths(to, "") {
+		_, err := os.Lstat(path)
+		if exists := err == nil; exists != (i == 2) {
+			t.Errorf("%s exists: %v", path, exists)
+		}
+	}
+	if b, _ := os.ReadFile(layout.Paths(to, "")[2]); !bytes.Equal(b, data[16:]) {
+		t.Errorf("%s holds %v", layout.Paths(to, "")[2], b)
+	}
+	if _, err := os.Lstat(paths[2]); err == nil {
+		t.Errorf("%s is still there", paths[2])
+	}
+
+	// and moving back onto a file in the way fails before anything moves
+	os.MkdirAll(filepath.Dir(paths[2]), 0755)
+	if err := os.WriteFile(paths[2], []byte("mine"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := MoveFiles(layout, to, from, "", nil); !errors.Is(err, os.ErrExist) {
+		t.Errorf("got %v, want %v", err, os.ErrExist)
+	}
+}
+
+func TestFreeSpace(t *testing.T) {
+	free, err := freeSpace(t.TempDir())
+	if err != nil {
+		t.Skip(err)
+	}
+	if free <= 0 {
+		t.Errorf("%d bytes free", free)
+	}
+}
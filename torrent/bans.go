@@ -0,0 +1,151 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MaxHashFailures is how many pieces a peer may fail the integrity check
+// for before it gets banned, even when smart-ban can't pin the blame on it
+var MaxHashFailures = 5
+
+// Ban is an entry of the ban list, peers are banned by ip since their port
+// changes between connections
+type Ban struct {
+	IP     string    `json:"ip"`
+	Reason string    `json:"reason"`
+	Since  time.Time `json:"since"`
+}
+
+// blockRecord remembers who sent a block of a piece that failed the
+// integrity check and what it looked like
+type blockRecord struct {
+	ip    string
+	begin int
+	hash  [20]byte
+}
+
+// banList tracks hash failures per peer. When a piece fails, the hash of
+// every block is kept along with the peer that sent it. Once the piece
+// verifies, each kept block is compared against the good data and the
+// peers that sent a block that differs are banned (smart-ban).
+type banList struct {
+	mu       sync.Mutex
+	banned   map[string]Ban
+	failures map[string]int
+	// blocks received for the failed attempts of each piece
+	suspects map[pieceKey][]blockRecord
+}
+
+// pieceKey identifies a piece across all torrents
+type pieceKey struct {
+	infoHash [20]byte
+	index    int
+}
+
+// Bans is shared by all torrents
+var Bans = &banList{
+	banned:   map[string]Ban{},
+	failures: map[string]int{},
+	suspects: map[pieceKey][]blockRecord{},
+}
+
+func (bans *banList) IsBanned(ip string) bool {
+	bans.mu.Lock()
+	defer bans.mu.Unlock()
+
+	_, ok := bans.banned[ip]
+	return ok
+}
+
+func (bans *banList) ban(ip, reason string) {
+	if _, ok := bans.banned[ip]; ok {
+		return
+	}
+	bans.banned[ip] = Ban{IP: ip, Reason: reason, Since: time.Now()}
+}
+
+// pieceFailed records the blocks of a piece that didn't match its hash
+func (bans *banList) pieceFailed(infoHash [20]byte, index int, buf []byte, ip string) {
+	bans.mu.Lock()
+	defer bans.mu.Unlock()
+
+	key := pieceKey{infoHash, index}
+	for begin := 0; begin < len(buf); begin += MaxBlockSize {
+		end := min(begin+MaxBlockSize, len(buf))
+		bans.suspects[key] = append(bans.suspects[key], blockRecord{
+			ip:    ip,
+			begin: begin,
+			hash:  sha1.Sum(buf[begin:end]),
+		})
+	}
+
+	bans.failures[ip]++
+	if bans.failures[ip] >= MaxHashFailures {
+		bans.ban(ip, "too many pieces failed the integrity check")
+	}
+}
+
+// pieceVerified bans the peers that sent bad blocks for an earlier attempt
+// of a piece that has now passed the integrity check
+func (bans *banList) pieceVerified(infoHash [20]byte, index int, buf []byte) {
+	bans.mu.Lock()
+	defer bans.mu.Unlock()
+
+	key := pieceKey{infoHash, index}
+	for _, record := range bans.suspects[key] {
+		end := min(record.begin+MaxBlockSize, len(buf))
+		if record.begin >= end {
+			continue
+		}
+
+		hash := sha1.Sum(buf[record.begin:end])
+		if !bytes.Equal(hash[:], record.hash[:]) {
+			bans.ban(record.ip, "sent corrupt data")
+		}
+	}
+
+	delete(bans.suspects, key)
+}
+
+// List returns the banned peers, oldest first
+func (bans *banList) List() []Ban {
+	bans.mu.Lock()
+	defer bans.mu.Unlock()
+
+	list := []Ban{}
+	for _, ban := range bans.banned {
+		list = append(list, ban)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Since.Before(list[j].Since)
+	})
+
+	return list
+}
+
+// Clear lifts the ban of an ip along with its failure count, or of every
+// peer when ip is empty. It returns how many bans were lifted.
+func (bans *banList) Clear(ip string) int {
+	bans.mu.Lock()
+	defer bans.mu.Unlock()
+
+	if ip == "" {
+		n := len(bans.banned)
+		bans.banned = map[string]Ban{}
+		bans.failures = map[string]int{}
+		return n
+	}
+
+	_, ok := bans.banned[ip]
+	delete(bans.banned, ip)
+	delete(bans.failures, ip)
+	if ok {
+		return 1
+	}
+	return 0
+}
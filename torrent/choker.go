@@ -0,0 +1,239 @@
+package torrent
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/johneliades/flash/client"
+)
+
+// UploadSlots is the number of peers unchoked at once, one of them is the
+// optimistic unchoke. The settings change it while the chokers run.
+var UploadSlots atomic.Int32
+
+func init() {
+	UploadSlots.Store(4)
+}
+
+const (
+	rechokeInterval    = 10 * time.Second
+	optimisticInterval = 30 * time.Second
+)
+
+// PeerStatus is a snapshot of a connected peer, as shown in the peer list
+type PeerStatus struct {
+	Addr           string  `json:"addr"`
+	AmChoking      bool    `json:"amChoking"`
+	PeerChoking    bool    `json:"peerChoking"`
+	PeerInterested bool    `json:"peerInterested"`
+	Optimistic     bool    `json:"optimistic"`
+	DownSpeed      float64 `json:"downloadSpeed"`
+	UpSpeed        float64 `json:"uploadSpeed"`
+}
+
+type peerRate struct {
+	// counters at the last rechoke
+	downloaded int64
+	uploaded   int64
+	// bytes per second over the last rechoke interval
+	down float64
+	up   float64
+}
+
+// choker decides which peers may download from us. Every rechokeInterval
+// it unchokes the peers that upload the most to us, or download the most
+// from us while seeding, and every optimisticInterval it rotates one extra
+// unchoke to a random peer so newcomers get a chance to prove themselves.
+type choker struct {
+	mu         sync.Mutex
+	peers      map[string]*client.Client
+	rates      map[string]*peerRate
+	optimistic string
+	lastUpdate time.Time
+	seeding    func() bool
+}
+
+func newChoker(seeding func() bool) *choker {
+	return &choker{
+		peers:      map[string]*client.Client{},
+		rates:      map[string]*peerRate{},
+		lastUpdate: time.Now(),
+		seeding:    seeding,
+	}
+}
+
+func (ch *choker) add(c *client.Client) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	ch.peers[c.Addr()] = c
+	ch.rates[c.Addr()] = &peerRate{}
+}
+
+func (ch *choker) remove(c *client.Client) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	delete(ch.peers, c.Addr())
+	delete(ch.rates, c.Addr())
+	if ch.optimistic == c.Addr() {
+		ch.optimistic = ""
+	}
+}
+
+// interested unchokes a peer that just became interested right away when
+// an upload slot is free, rather than at the next rechoke. The slot is taken
+// under the lock and the peer told after it, a slow peer holds up no one.
+func (ch *choker) interested(c *client.Client) {
+	ch.mu.Lock()
+	unchoked := 0
+	for _, p := range ch.peers {
+		if !p.AmChoking() {
+			unchoked++
+		}
+	}
+	changed := unchoked < int(UploadSlots.Load()) && c.SetChoking(false)
+	ch.mu.Unlock()
+
+	if changed {
+		c.SendChokeState()
+	}
+}
+
+func (ch *choker) clients() []*client.Client {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	clients := []*client.Client{}
+	for _, c := range ch.peers {
+		clients = append(clients, c)
+	}
+	return clients
+}
+
+func (ch *choker) run(done chan struct{}) {
+	ticker := time.NewTicker(rechokeInterval)
+	defer ticker.Stop()
+
+	ticks := 0
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			ticks++
+			rotate := ticks%int(optimisticInterval/rechokeInterval) == 0
+			ch.rechoke(rotate)
+		}
+	}
+}
+
+// rechoke decides who is unchoked under the lock and tells the peers whose
+// state changed after letting go of it
+func (ch *choker) rechoke(rotate bool) {
+	for _, c := range ch.decide(rotate) {
+		c.SendChokeState()
+	}
+}
+
+// decide hands out the upload slots and returns the peers whose choke state
+// changed
+func (ch *choker) decide(rotate bool) []*client.Client {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	elapsed := time.Since(ch.lastUpdate).Seconds()
+	ch.lastUpdate = time.Now()
+
+	for addr, c := range ch.peers {
+		rate := ch.rates[addr]
+		downloaded, uploaded := c.Downloaded.Load(), c.Uploaded.Load()
+		if elapsed > 0 {
+			rate.down = float64(downloaded-rate.downloaded) / elapsed
+			rate.up = float64(uploaded-rate.uploaded) / elapsed
+		}
+		rate.downloaded, rate.uploaded = downloaded, uploaded
+	}
+
+	var candidates []string
+	for addr, c := range ch.peers {
+		if c.PeerInterested() {
+			candidates = append(candidates, addr)
+		}
+	}
+
+	seeding := ch.seeding != nil && ch.seeding()
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := ch.rates[candidates[i]], ch.rates[candidates[j]]
+		if seeding {
+			return a.up > b.up
+		}
+		return a.down > b.down
+	})
+
+	slots := int(UploadSlots.Load())
+	regular := slots - 1
+	if regular < 0 {
+		regular = 0
+	}
+	if regular > len(candidates) {
+		regular = len(candidates)
+	}
+
+	unchoke := map[string]bool{}
+	for _, addr := range candidates[:regular] {
+		unchoke[addr] = true
+	}
+
+	// keep the optimistic unchoke until it is time to rotate, unless it left,
+	// lost interest or earned a regular slot
+	if c, ok := ch.peers[ch.optimistic]; !ok || !c.PeerInterested() || rotate ||
+		unchoke[ch.optimistic] {
+
+		ch.optimistic = ""
+
+		rest := candidates[regular:]
+		if slots > 0 && len(rest) > 0 {
+			ch.optimistic = rest[rand.Intn(len(rest))]
+		}
+	}
+	if ch.optimistic != "" {
+		unchoke[ch.optimistic] = true
+	}
+
+	var changed []*client.Client
+	for addr, c := range ch.peers {
+		if c.SetChoking(!unchoke[addr]) {
+			changed = append(changed, c)
+		}
+	}
+	return changed
+}
+
+func (ch *choker) status() []PeerStatus {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	peers := []PeerStatus{}
+	for addr, c := range ch.peers {
+		rate := ch.rates[addr]
+		peers = append(peers, PeerStatus{
+			Addr:           addr,
+			AmChoking:      c.AmChoking(),
+			PeerChoking:    c.Choked(),
+			PeerInterested: c.PeerInterested(),
+			Optimistic:     addr == ch.optimistic,
+			DownSpeed:      rate.down,
+			UpSpeed:        rate.up,
+		})
+	}
+
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].Addr < peers[j].Addr
+	})
+
+	return peers
+}
@@ -0,0 +1,179 @@
+package torrent
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/johneliades/flash/client"
+	"github.com/johneliades/flash/handshake"
+	"github.com/johneliades/flash/message"
+	"github.com/johneliades/flash/peer"
+)
+
+// fakePeer is a client of a peer at 10.0.0.n on the other end of a pipe,
+// which ignores whatever we send it after telling us whether it is
+// interested
+func fakePeer(t *testing.T, n byte, interested bool) *client.Client {
+	local, remote := net.Pipe()
+	t.Cleanup(func() {
+		local.Close()
+		remote.Close()
+	})
+
+	go func() {
+		handshake.Read(remote)
+		msg := &message.Message{ID: message.NotInterested}
+		if interested {
+			msg.ID = message.Interested
+		}
+		remote.Write(msg.Serialize())
+		io.Copy(io.Discard, remote)
+	}()
+
+	res := &handshake.Handshake{}
+	c, err := client.Accept(local, *peer.New(net.IPv4(10, 0, 0, n), 6881), res, [20]byte{}, 1, nil, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// rechokeWith gives every peer the rates of the interval that just ended,
+// in bytes per second, and rechokes
+func rechokeWith(ch *choker, down, up map[*client.Client]int64, rotate bool) {
+	for c, rate := range down {
+		c.Downloaded.Add(rate * 10)
+	}
+	for c, rate := range up {
+		c.Uploaded.Add(rate * 10)
+	}
+	ch.lastUpdate = time.Now().Add(-10 * time.Second)
+	ch.rechoke(rotate)
+}
+
+func unchoked(peers []*client.Client) map[*client.Client]bool {
+	unchoked := map[*client.Client]bool{}
+	for _, c := range peers {
+		if !c.AmChoking() {
+			unchoked[c] = true
+		}
+	}
+	return unchoked
+}
+
+func TestRechoke(t *testing.T) {
+	defer UploadSlots.Store(UploadSlots.Load())
+	UploadSlots.Store(4)
+
+	seeding := false
+	ch := newChoker(func() bool { return seeding })
+
+	var peers []*client.Client
+	for n := byte(1); n <= 6; n++ {
+		c := fakePeer(t, n, true)
+		peers = append(peers, c)
+		ch.add(c)
+	}
+	// the fastest of them all doesn't want anything from us
+	lazy := fakePeer(t, 7, false)
+	ch.add(lazy)
+
+	// downloading, the three that upload the most to us get the regular
+	// slots and one of the others the optimistic one
+	down := map[*client.Client]int64{lazy: 1000}
+	up := map[*client.Client]int64{}
+	for i, c := range peers {
+		down[c] = int64(600 - i*100)
+		up[c] = int64(i * 100)
+	}
+	rechokeWith(ch, down, up, true)
+
+	got := unchoked(append(peers, lazy))
+	if len(got) != 4 || !got[peers[0]] || !got[peers[1]] || !got[peers[2]] || got[lazy] {
+		t.Fatalf("downloading: unchoked %d peers, not the three fastest and an optimistic one", len(got))
+	}
+	optimistic := ch.optimistic
+	if optimistic == "" || optimistic == peers[0].Addr() || optimistic == peers[1].Addr() ||
+		optimistic == peers[2].Addr() {
+		t.Errorf("optimistic unchoke %q", optimistic)
+	}
+
+	// the optimistic unchoke stays until it is time to rotate
+	rechokeWith(ch, down, up, false)
+	if ch.optimistic != optimistic {
+		t.Errorf("optimistic unchoke moved from %s to %s before its time", optimistic, ch.optimistic)
+	}
+
+	// seeding, the ones that download the most from us get them instead
+	seeding = true
+	rechokeWith(ch, down, up, false)
+	got = unchoked(append(peers, lazy))
+	if len(got) != 4 || !got[peers[5]] || !got[peers[4]] || !got[peers[3]] || got[lazy] {
+		t.Fatalf("seeding: unchoked %d peers, not the three fastest and an optimistic one", len(got))
+	}
+
+	// no slots, nobody gets served
+	UploadSlots.Store(0)
+	rechokeWith(ch, down, up, true)
+	if got := unchoked(append(peers, lazy)); len(got) != 0 {
+		t.Errorf("%d peers unchoked without upload slots", len(got))
+	}
+
+	// a peer that becomes interested gets a free slot right away
+	UploadSlots.Store(1)
+	ch.interested(peers[0])
+	if peers[0].AmChoking() {
+		t.Error("an interested peer wasn't unchoked while a slot was free")
+	}
+	ch.interested(peers[1])
+	if !peers[1].AmChoking() {
+		t.Error("an interested peer was unchoked without a free slot")
+	}
+}
+
+func TestStuckPeer(t *testing.T) {
+	defer UploadSlots.Store(UploadSlots.Load())
+	UploadSlots.Store(1)
+
+	// a peer that stops reading once it said it is interested, so writes
+	// to it never finish
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	go func() {
+		handshake.Read(remote)
+		remote.Write((&message.Message{ID: message.Interested}).Serialize())
+	}()
+	res := &handshake.Handshake{}
+	stuck, err := client.Accept(local, *peer.New(net.IPv4(10, 0, 0, 1), 6881), res, [20]byte{}, 1, nil, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ch := newChoker(nil)
+	ch.add(stuck)
+	go ch.rechoke(true)
+	for deadline := time.Now().Add(time.Second); stuck.AmChoking(); {
+		if time.Now().After(deadline) {
+			t.Fatal("the peer wasn't unchoked")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// the unchoke can't go out, the choker still answers
+	listed := make(chan []PeerStatus)
+	go func() {
+		ch.interested(stuck)
+		listed <- ch.status()
+	}()
+	select {
+	case peers := <-listed:
+		if len(peers) != 1 || peers[0].AmChoking {
+			t.Errorf("listed %+v, not the unchoked peer", peers)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the choker waited for a write to a stuck peer")
+	}
+}
@@ -0,0 +1,290 @@
+package torrent
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/johneliades/flash/peer"
+)
+
+// The connection limits are changed by the settings while peers dial and
+// connect
+var (
+	// MaxConnections caps the peer connections of all torrents combined,
+	// including the ones still dialing
+	MaxConnections atomic.Int32
+	// MaxConnectionsPerTorrent caps the peer connections of a single torrent
+	MaxConnectionsPerTorrent atomic.Int32
+	// MaxHalfOpen caps the dial attempts in flight across all torrents
+	MaxHalfOpen atomic.Int32
+)
+
+func init() {
+	MaxConnections.Store(200)
+	MaxConnectionsPerTorrent.Store(50)
+	MaxHalfOpen.Store(20)
+}
+
+const (
+	// a peer that fails this many times is dropped from the candidates
+	maxFailures = 3
+	// a connection that lasts this long proves the peer, whose failures are
+	// forgiven
+	provenAfter = 5 * time.Minute
+)
+
+// connSlots counts the connections of every torrent against the global limits
+type connSlots struct {
+	mu       sync.Mutex
+	open     int
+	halfOpen int
+}
+
+var slots = &connSlots{}
+
+// reserve claims a half open slot for a dial attempt
+func (s *connSlots) reserve() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.open+s.halfOpen >= int(MaxConnections.Load()) || s.halfOpen >= int(MaxHalfOpen.Load()) {
+		return false
+	}
+	s.halfOpen++
+	return true
+}
+
+// connected turns a half open slot into an open one
+func (s *connSlots) connected() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.halfOpen--
+	s.open++
+}
+
+func (s *connSlots) failed() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.halfOpen--
+}
+
+func (s *connSlots) closed() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.open--
+}
+
+type candidate struct {
+	peer     peer.Peer
+	failures int
+	// order the peer was first seen in, earlier is better
+	seq int
+	// when the connection to the peer was made and whether it sent us a
+	// piece over it, while connected
+	since  time.Time
+	proven bool
+}
+
+// peerPool keeps the peers of a torrent that aren't connected yet and hands
+// out the best one whenever a connection slot opens up
+type peerPool struct {
+	mu         sync.Mutex
+	candidates map[string]*candidate
+	connected  map[string]*candidate
+	halfOpen   map[string]*candidate
+	seq        int
+	// signalled when a candidate arrives or a slot frees up
+	wake chan struct{}
+}
+
+func newPeerPool() *peerPool {
+	return &peerPool{
+		candidates: map[string]*candidate{},
+		connected:  map[string]*candidate{},
+		halfOpen:   map[string]*candidate{},
+		wake:       make(chan struct{}, 1),
+	}
+}
+
+func (pool *peerPool) signal() {
+	select {
+	case pool.wake <- struct{}{}:
+	default:
+	}
+}
+
+// add makes a peer a candidate, unless we already know it
+func (pool *peerPool) add(p peer.Peer) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	if Bans.IsBanned(p.String(true)) {
+		return
+	}
+
+	addr := p.String(false)
+	if _, ok := pool.candidates[addr]; ok {
+		return
+	}
+	if _, ok := pool.halfOpen[addr]; ok {
+		return
+	}
+	if _, ok := pool.connected[addr]; ok {
+		return
+	}
+
+	pool.seq++
+	pool.candidates[addr] = &candidate{peer: p, seq: pool.seq}
+	pool.signal()
+}
+
+// next picks the candidate with the fewest failures, oldest first, if both
+// the torrent and the global limits leave room for another dial
+func (pool *peerPool) next() (peer.Peer, bool) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	if len(pool.candidates) == 0 ||
+		len(pool.connected)+len(pool.halfOpen) >= int(MaxConnectionsPerTorrent.Load()) {
+		return peer.Peer{}, false
+	}
+
+	var best *candidate
+	for addr, c := range pool.candidates {
+		// banned after it became a candidate
+		if Bans.IsBanned(c.peer.String(true)) {
+			delete(pool.candidates, addr)
+			continue
+		}
+
+		if best == nil || c.failures < best.failures ||
+			(c.failures == best.failures && c.seq < best.seq) {
+			best = c
+		}
+	}
+
+	if best == nil || !slots.reserve() {
+		return peer.Peer{}, false
+	}
+
+	addr := best.peer.String(false)
+	delete(pool.candidates, addr)
+	pool.halfOpen[addr] = best
+
+	return best.peer, true
+}
+
+// accept takes a slot for a peer that connected to us, if the limits leave room
+func (pool *peerPool) accept(p peer.Peer) bool {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	addr := p.String(false)
+	if _, ok := pool.connected[addr]; ok {
+		return false
+	}
+	if len(pool.connected)+len(pool.halfOpen) >= int(MaxConnectionsPerTorrent.Load()) || !slots.reserve() {
+		return false
+	}
+
+	slots.connected()
+	c, ok := pool.candidates[addr]
+	if !ok {
+		pool.seq++
+		c = &candidate{peer: p, seq: pool.seq}
+	}
+	delete(pool.candidates, addr)
+	c.since, c.proven = time.Now(), false
+	pool.connected[addr] = c
+
+	return true
+}
+
+// dialed reports the outcome of a dial attempt, failed peers go back to
+// the candidates until they fail too often
+func (pool *peerPool) dialed(p peer.Peer, ok bool) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	addr := p.String(false)
+	c := pool.halfOpen[addr]
+	delete(pool.halfOpen, addr)
+
+	if ok {
+		slots.connected()
+		if c == nil {
+			c = &candidate{peer: p}
+		}
+		c.since, c.proven = time.Now(), false
+		pool.connected[addr] = c
+		return
+	}
+
+	slots.failed()
+	pool.retry(c)
+	pool.signal()
+}
+
+// delivered notes that a connected peer sent us a piece
+func (pool *peerPool) delivered(p peer.Peer) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	if c, ok := pool.connected[p.String(false)]; ok {
+		c.proven = true
+	}
+}
+
+// closed reports the end of a connection, retry puts the peer back in the
+// candidates for when it dropped on an error. Its failures carry over
+// unless the connection proved it, so a peer that keeps dropping us right
+// away runs out of retries like one that can't be dialed.
+func (pool *peerPool) closed(p peer.Peer, retry bool) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	addr := p.String(false)
+	c := pool.connected[addr]
+	delete(pool.connected, addr)
+	slots.closed()
+
+	if retry {
+		if c == nil {
+			c = &candidate{peer: p}
+		}
+		if c.proven || time.Since(c.since) >= provenAfter {
+			c.failures = 0
+		}
+		pool.seq++
+		c.seq = pool.seq
+		pool.retry(c)
+	}
+	pool.signal()
+}
+
+func (pool *peerPool) retry(c *candidate) {
+	if c == nil || Bans.IsBanned(c.peer.String(true)) {
+		return
+	}
+
+	c.failures++
+	if c.failures < maxFailures {
+		pool.candidates[c.peer.String(false)] = c
+	}
+}
+
+// peers lists the connected peers
+func (pool *peerPool) peers() []peer.Peer {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	peers := []peer.Peer{}
+	for _, c := range pool.connected {
+		peers = append(peers, c.peer)
+	}
+	return peers
+}
@@ -0,0 +1,92 @@
+package torrent
+
+import (
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/johneliades/flash/peer"
+)
+
+// TestLimitsChange changes the limits the way the settings do while dials
+// reserve slots, which -race checks
+func TestLimitsChange(t *testing.T) {
+	defer func(max, perTorrent, halfOpen int32) {
+		MaxConnections.Store(max)
+		MaxConnectionsPerTorrent.Store(perTorrent)
+		MaxHalfOpen.Store(halfOpen)
+	}(MaxConnections.Load(), MaxConnectionsPerTorrent.Load(), MaxHalfOpen.Load())
+
+	s := &connSlots{}
+	pool := newPeerPool()
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			p := *peer.New(net.IPv4(10, 0, 1, byte(i)), 6881)
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if s.reserve() {
+					s.failed()
+				}
+				if pool.accept(p) {
+					pool.closed(p, false)
+				}
+			}
+		}(i)
+	}
+
+	for n := int32(1); n <= 1000; n++ {
+		MaxConnections.Store(n)
+		MaxConnectionsPerTorrent.Store(n)
+		MaxHalfOpen.Store(n%20 + 1)
+	}
+	close(done)
+	wg.Wait()
+
+	// the last limits are the ones that hold
+	MaxConnections.Store(1)
+	MaxHalfOpen.Store(1)
+	if !s.reserve() || s.reserve() {
+		t.Error("a limit of one half open slot wasn't kept")
+	}
+}
+
+func TestRetryKeepsFailures(t *testing.T) {
+	pool := newPeerPool()
+	p := *peer.New(net.IPv4(10, 0, 2, 1), 6881)
+	pool.add(p)
+
+	// a peer that takes the connection and drops it right away runs out of
+	// retries like one that can't be dialed
+	for i := 0; i < maxFailures; i++ {
+		next, ok := pool.next()
+		if !ok {
+			t.Fatalf("the peer was dropped after %d connections", i)
+		}
+		pool.dialed(next, true)
+		pool.closed(next, true)
+	}
+	if _, ok := pool.next(); ok {
+		t.Errorf("the peer is still dialed after dropping %d connections", maxFailures)
+	}
+
+	// one that sent us a piece is forgiven
+	proven := *peer.New(net.IPv4(10, 0, 2, 2), 6881)
+	pool.add(proven)
+	for i := 0; i < 2*maxFailures; i++ {
+		next, ok := pool.next()
+		if !ok {
+			t.Fatalf("a peer that delivers was dropped after %d connections", i)
+		}
+		pool.dialed(next, true)
+		pool.delivered(next)
+		pool.closed(next, true)
+	}
+}
@@ -0,0 +1,188 @@
+package torrent
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/johneliades/flash/blocklist"
+	"github.com/johneliades/flash/client"
+	"github.com/johneliades/flash/handshake"
+	"github.com/johneliades/flash/mse"
+	"github.com/johneliades/flash/peer"
+	"github.com/johneliades/flash/proxy"
+	"github.com/johneliades/flash/utp"
+)
+
+// ListenPort is the port we accept peers on and announce to trackers
+var ListenPort = 3000
+
+// torrents that are downloading, by info hash, for matching incoming peers
+var active = struct {
+	sync.Mutex
+	torrents map[[20]byte]*Torrent
+}{torrents: map[[20]byte]*Torrent{}}
+
+func register(torrent *Torrent) {
+	active.Lock()
+	defer active.Unlock()
+	for _, infoHash := range torrent.Meta.Swarms() {
+		active.torrents[infoHash] = torrent
+	}
+}
+
+func unregister(torrent *Torrent) {
+	active.Lock()
+	defer active.Unlock()
+	for _, infoHash := range torrent.Meta.Swarms() {
+		delete(active.torrents, infoHash)
+	}
+}
+
+func infoHashes() [][20]byte {
+	active.Lock()
+	defer active.Unlock()
+
+	hashes := [][20]byte{}
+	for infoHash := range active.torrents {
+		hashes = append(hashes, infoHash)
+	}
+	return hashes
+}
+
+func lookup(infoHash [20]byte) *Torrent {
+	active.Lock()
+	defer active.Unlock()
+	return active.torrents[infoHash]
+}
+
+// Listen accepts peers that connect to us on port, over TCP and uTP, and
+// hands them to the torrent they ask for. Both sockets are dual stack, so
+// IPv6 peers get in as well. The uTP socket becomes the one peers are
+// dialed from too.
+func Listen(port int) error {
+	listener, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+	if err != nil {
+		return err
+	}
+
+	socket, err := utp.Listen(":" + strconv.Itoa(port))
+	if err != nil {
+		listener.Close()
+		return err
+	}
+	utp.SetDefault(socket)
+	go accept(socket)
+
+	return accept(listener)
+}
+
+func accept(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+
+		go handleIncoming(conn)
+	}
+}
+
+// readIncomingHandshake tells a plaintext handshake from an encrypted one
+// and reads it the way the encryption policy allows
+func readIncomingHandshake(conn net.Conn) (net.Conn, *handshake.Handshake, error) {
+	buffered := mse.NewBufferedConn(conn)
+	policy := mse.Policy(mse.CurrentPolicy.Load())
+
+	plaintext, err := buffered.IsPlaintext()
+	if err != nil {
+		return conn, nil, err
+	}
+
+	if plaintext {
+		if policy == mse.Require {
+			return conn, nil, fmt.Errorf("plaintext connection refused")
+		}
+
+		res, err := handshake.Read(buffered)
+		return buffered, res, err
+	}
+
+	if policy == mse.Disable {
+		return conn, nil, fmt.Errorf("encrypted connection refused")
+	}
+
+	encrypted, skey, err := mse.Receive(buffered, buffered.Reader, infoHashes(), policy)
+	if err != nil {
+		return conn, nil, err
+	}
+
+	res, err := handshake.Read(encrypted)
+	if err != nil {
+		return encrypted, nil, err
+	}
+	if res.InfoHash != skey {
+		return encrypted, nil, fmt.Errorf("handshake doesn't match the encrypted torrent")
+	}
+
+	return encrypted, res, nil
+}
+
+func handleIncoming(conn net.Conn) {
+	// behind a proxy nobody should be able to reach us directly
+	if proxy.Enabled() {
+		conn.Close()
+		return
+	}
+
+	var p peer.Peer
+	switch addr := conn.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		p = *peer.New(addr.IP, uint16(addr.Port))
+	case *net.UDPAddr:
+		p = *peer.New(addr.IP, uint16(addr.Port))
+	default:
+		conn.Close()
+		return
+	}
+
+	if blocklist.Default.Check(p.IP()) || Bans.IsBanned(p.String(true)) {
+		conn.Close()
+		return
+	}
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn, res, err := readIncomingHandshake(conn)
+	if err != nil {
+		if Debug {
+			println("\r" + p.String(false) + Red + " - incoming: " + err.Error() + Reset)
+		}
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	// dialed again under the hash it asked for, should it drop
+	p = p.InSwarm(res.InfoHash)
+
+	torrent := lookup(res.InfoHash)
+	if torrent == nil || !torrent.pool.accept(p) {
+		conn.Close()
+		return
+	}
+
+	c, err := client.Accept(conn, p, res, torrent.Meta.PeerID, torrent.numPieces(),
+		torrent.havePieces(), torrent.v2(), torrent.Extensions)
+	if err != nil {
+		if Debug {
+			println("\r" + p.String(false) + Red + " - incoming: " + err.Error() + Reset)
+		}
+		conn.Close()
+		torrent.pool.closed(p, false)
+		return
+	}
+
+	torrent.runPeer(torrent.pool, p, c, torrent.workQueue, torrent.results)
+}
@@ -0,0 +1,63 @@
+package torrent
+
+import (
+	"bytes"
+
+	"github.com/johneliades/flash/extension"
+	"github.com/marksamman/bencode"
+)
+
+// ut_metadata message types, BEP 9
+const (
+	metadataRequest = 0
+	metadataData    = 1
+	metadataReject  = 2
+)
+
+// metadataPieceSize is the size of the pieces the info dictionary is sent in
+const metadataPieceSize = 16384
+
+// metadata implements ut_metadata for peers that came with a magnet link,
+// serving them the info dictionary the torrent file had
+type metadata struct {
+	info []byte
+}
+
+func (m *metadata) Name() string {
+	return "ut_metadata"
+}
+
+// Handle answers requests for pieces of the info dictionary. Data and
+// rejects are ignored, we already have it.
+func (m *metadata) Handle(remote extension.Peer, payload []byte) error {
+	dict, err := bencode.Decode(bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+
+	msgType, _ := dict["msg_type"].(int64)
+	piece, ok := dict["piece"].(int64)
+	if msgType != metadataRequest || !ok {
+		return nil
+	}
+
+	pieces := (len(m.info) + metadataPieceSize - 1) / metadataPieceSize
+	if piece < 0 || piece >= int64(pieces) {
+		reject := map[string]interface{}{"msg_type": int64(metadataReject), "piece": piece}
+		return remote.SendExtended(m.Name(), bencode.Encode(reject))
+	}
+
+	begin := int(piece) * metadataPieceSize
+	end := begin + metadataPieceSize
+	if end > len(m.info) {
+		end = len(m.info)
+	}
+
+	// the piece follows the dictionary in the same message
+	header := map[string]interface{}{
+		"msg_type":   int64(metadataData),
+		"piece":      piece,
+		"total_size": int64(len(m.info)),
+	}
+	return remote.SendExtended(m.Name(), append(bencode.Encode(header), m.info[begin:end]...))
+}
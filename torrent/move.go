@@ -0,0 +1,114 @@
+package torrent
+
+import (
+	"fmt"
+
+	"github.com/johneliades/flash/storage"
+)
+
+// MoveStatus tells how the last storage move of a torrent went
+type MoveStatus struct {
+	// moving, done or failed, empty before the first move. Deferred when
+	// the files are still staged for a running download, they go to Path
+	// once it completes.
+	State string `json:"state"`
+	Path  string `json:"path"`
+	Moved int64  `json:"moved"`
+	Total int64  `json:"total"`
+	Error string `json:"error,omitempty"`
+}
+
+func (torrent *Torrent) MoveStatus() MoveStatus {
+	torrent.moveStatusMu.Lock()
+	defer torrent.moveStatusMu.Unlock()
+
+	return torrent.moveStatus
+}
+
+func (torrent *Torrent) setMoveStatus(update func(status *MoveStatus)) {
+	torrent.moveStatusMu.Lock()
+	defer torrent.moveStatusMu.Unlock()
+
+	update(&torrent.moveStatus)
+}
+
+// StartMove moves the torrent's files to dir in the background, MoveStatus
+// follows it
+func (torrent *Torrent) StartMove(dir string) error {
+	torrent.moveStatusMu.Lock()
+	if torrent.moveStatus.State == "moving" {
+		torrent.moveStatusMu.Unlock()
+		return fmt.Errorf("the torrent is already moving to %s", torrent.moveStatus.Path)
+	}
+	torrent.moveStatus = MoveStatus{State: "moving", Path: dir, Total: int64(torrent.Meta.Length)}
+	torrent.moveStatusMu.Unlock()
+
+	go func() {
+		deferred, err := torrent.moveStorage(dir)
+		torrent.setMoveStatus(func(status *MoveStatus) {
+			switch {
+			case err != nil:
+				status.State, status.Error = "failed", err.Error()
+				if Debug {
+					fmt.Printf(Red+"%v"+Reset, err)
+				}
+			case deferred:
+				status.State = "deferred"
+			default:
+				status.State, status.Moved = "done", status.Total
+			}
+		})
+	}()
+
+	return nil
+}
+
+// MoveStorage relocates the torrent's files to dir and saves it there from
+// then on. A running download pauses its reads and writes for the move and
+// carries on from the new place.
+func (torrent *Torrent) MoveStorage(dir string) error {
+	_, err := torrent.moveStorage(dir)
+	return err
+}
+
+// moveStorage is MoveStorage, telling whether the move waits for the staged
+// files of a running download to complete
+func (torrent *Torrent) moveStorage(dir string) (bool, error) {
+	torrent.moveMu.Lock()
+	defer torrent.moveMu.Unlock()
+
+	progress := func(moved int64) {
+		torrent.setMoveStatus(func(status *MoveStatus) {
+			status.Moved = moved
+		})
+	}
+
+	if torrent.live {
+		mover, ok := torrent.Storage.(storage.Mover)
+		if !ok {
+			return false, fmt.Errorf("the torrent's storage can't be moved")
+		}
+
+		// files still in the incomplete directory go to the new save path
+		// once they are complete
+		if torrent.storageDir != torrent.savePath {
+			torrent.savePath = dir
+			return true, nil
+		}
+
+		if err := mover.Move(dir, torrent.suffix, progress); err != nil {
+			return false, err
+		}
+		torrent.storageDir, torrent.savePath = dir, dir
+		return false, nil
+	}
+
+	// with the download over, the files are moved from where it left them
+	// as they are, nothing is created or allocated for the ones missing
+	err := storage.MoveFiles(torrent.Layout(), torrent.storageDir, dir, torrent.suffix, progress)
+	if err != nil {
+		return false, err
+	}
+	torrent.storageDir, torrent.savePath = dir, dir
+	return false, nil
+}
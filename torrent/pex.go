@@ -0,0 +1,179 @@
+package torrent
+
+import (
+	"bytes"
+	"sync"
+	"time"
+
+	"github.com/johneliades/flash/client"
+	"github.com/johneliades/flash/extension"
+	"github.com/johneliades/flash/peer"
+	"github.com/marksamman/bencode"
+)
+
+const (
+	pexInterval = time.Minute
+	// the most peers a single message adds, as BEP 11 asks
+	maxPexAdded = 50
+)
+
+// pex implements peer exchange, ut_pex. Connected peers tell us about the
+// peers they are connected to and we tell them about ours, IPv4 ones in
+// added and dropped and IPv6 ones in added6 and dropped6.
+type pex struct {
+	pool *peerPool
+
+	mu sync.Mutex
+	// the peers each connection was last told about, by its address
+	sent map[string]map[string]peer.Peer
+}
+
+func newPex(pool *peerPool) *pex {
+	return &pex{pool: pool, sent: map[string]map[string]peer.Peer{}}
+}
+
+func (p *pex) Name() string {
+	return "ut_pex"
+}
+
+// Handle makes the peers a message adds candidates, dropped ones are left
+// for the pool to find out about. Like the messages we send, a message
+// adds at most maxPexAdded peers, the rest are ignored so that a single
+// peer can't flood the pool.
+func (p *pex) Handle(remote extension.Peer, payload []byte) error {
+	dict, err := bencode.Decode(bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+
+	left := maxPexAdded
+	for _, list := range []struct {
+		key         string
+		size        int
+		deserialize func([]byte) ([]peer.Peer, error)
+	}{
+		{"added", 6, peer.Deserialize},
+		{"added6", 18, peer.Deserialize6},
+	} {
+		compact, ok := dict[list.key].(string)
+		if !ok {
+			continue
+		}
+		if len(compact) > left*list.size {
+			compact = compact[:left*list.size]
+		}
+
+		peers, err := list.deserialize([]byte(compact))
+		if err != nil {
+			return err
+		}
+		for _, newPeer := range peers {
+			p.pool.add(newPeer.InSwarm(remote.InfoHash()))
+		}
+		left -= len(peers)
+	}
+
+	return nil
+}
+
+func (p *pex) run(ch *choker, done chan struct{}) {
+	ticker := time.NewTicker(pexInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			p.broadcast(ch.clients())
+		}
+	}
+}
+
+// broadcast tells every connection that supports ut_pex which peers we
+// connected to and dropped since its last message, the first message lists
+// all of them
+func (p *pex) broadcast(clients []*client.Client) {
+	connected := map[string]peer.Peer{}
+	for _, c := range clients {
+		listen := c.ListenPeer()
+		connected[listen.String(false)] = listen
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	current := map[string]bool{}
+	for _, c := range clients {
+		current[c.Addr()] = true
+		if !c.SupportsExtension("ut_pex") {
+			continue
+		}
+
+		self := c.ListenPeer().String(false)
+		sent := p.sent[c.Addr()]
+
+		next := map[string]peer.Peer{}
+		var added, dropped []peer.Peer
+		for addr, connectedPeer := range connected {
+			if addr == self {
+				continue
+			}
+			if _, ok := sent[addr]; !ok {
+				// the rest wait for the next message
+				if len(added) == maxPexAdded {
+					continue
+				}
+				added = append(added, connectedPeer)
+			}
+			next[addr] = connectedPeer
+		}
+		for addr, sentPeer := range sent {
+			if _, ok := next[addr]; !ok {
+				dropped = append(dropped, sentPeer)
+			}
+		}
+
+		if len(added) == 0 && len(dropped) == 0 {
+			continue
+		}
+		if c.SendExtended("ut_pex", pexMessage(added, dropped)) == nil {
+			p.sent[c.Addr()] = next
+		}
+	}
+
+	for addr := range p.sent {
+		if !current[addr] {
+			delete(p.sent, addr)
+		}
+	}
+}
+
+func pexMessage(added, dropped []peer.Peer) []byte {
+	var added4, added6, flags4, flags6, dropped4, dropped6 []byte
+	for _, addedPeer := range added {
+		if addedPeer.IsIPv4() {
+			added4 = append(added4, addedPeer.Serialize()...)
+			flags4 = append(flags4, 0)
+		} else {
+			added6 = append(added6, addedPeer.Serialize()...)
+			flags6 = append(flags6, 0)
+		}
+	}
+	for _, droppedPeer := range dropped {
+		if droppedPeer.IsIPv4() {
+			dropped4 = append(dropped4, droppedPeer.Serialize()...)
+		} else {
+			dropped6 = append(dropped6, droppedPeer.Serialize()...)
+		}
+	}
+
+	return bencode.Encode(map[string]interface{}{
+		"added":    string(added4),
+		"added.f":  string(flags4),
+		"added6":   string(added6),
+		"added6.f": string(flags6),
+		"dropped":  string(dropped4),
+		"dropped6": string(dropped6),
+	})
+}
@@ -0,0 +1,35 @@
+package torrent
+
+import (
+	"net"
+	"testing"
+
+	"github.com/johneliades/flash/peer"
+	"github.com/marksamman/bencode"
+)
+
+// pexPeer is the connection a PEX message arrives on
+type pexPeer struct{}
+
+func (pexPeer) Addr() string                                   { return "10.0.0.1:6881" }
+func (pexPeer) InfoHash() [20]byte                             { return [20]byte{1} }
+func (pexPeer) SendExtended(name string, payload []byte) error { return nil }
+
+func TestPexAddsAtMost(t *testing.T) {
+	var added, added6 []byte
+	for i := 0; i < 40; i++ {
+		added = append(added, peer.New(net.IPv4(10, 1, 0, byte(i)), 6881).Serialize()...)
+		ip := net.ParseIP("2001:db8::")
+		ip[15] = byte(i)
+		added6 = append(added6, peer.New(ip, 6881).Serialize()...)
+	}
+	payload := bencode.Encode(map[string]interface{}{"added": string(added), "added6": string(added6)})
+
+	pool := newPeerPool()
+	if err := newPex(pool).Handle(pexPeer{}, payload); err != nil {
+		t.Fatal(err)
+	}
+	if len(pool.candidates) != maxPexAdded {
+		t.Errorf("a message of 80 peers added %d, want %d", len(pool.candidates), maxPexAdded)
+	}
+}
@@ -2,20 +2,23 @@ package torrent
 
 import (
 	"bufio"
-	"bytes"
-	"crypto/sha1"
+	"errors"
 	"fmt"
 	"math"
+	"net"
 	"os"
-	"path/filepath"
-	"reflect"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/johneliades/flash/client"
+	"github.com/johneliades/flash/extension"
 	"github.com/johneliades/flash/message"
 	"github.com/johneliades/flash/peer"
+	"github.com/johneliades/flash/ratelimit"
+	"github.com/johneliades/flash/storage"
 )
 
 var Debug = false
@@ -38,23 +41,78 @@ const (
 // MaxBlockSize is the largest number of bytes a request can ask for
 const MaxBlockSize = 16384
 
+// Staging is where downloads are kept until they are complete and verified
+type Staging struct {
+	// IncompleteDir holds the files, they stay in the download location
+	// when it is empty
+	IncompleteDir string
+	// PartSuffix adds .part to the names of files still downloading
+	PartSuffix bool
+}
+
+var (
+	stagingMu sync.Mutex
+	staging   Staging
+)
+
+// SetStaging changes where downloads that start from now on are staged
+func SetStaging(s Staging) {
+	stagingMu.Lock()
+	defer stagingMu.Unlock()
+	staging = s
+}
+
+// CurrentStaging returns where new downloads are staged
+func CurrentStaging() Staging {
+	stagingMu.Lock()
+	defer stagingMu.Unlock()
+	return staging
+}
+
+const (
+	// keepAliveInterval is how often a quiet connection is kept open, and
+	// idleTimeout how long a peer may stay silent before it is dropped
+	keepAliveInterval = 2 * time.Minute
+	idleTimeout       = 3 * time.Minute
+)
+
+// ErrStopped is what Download returns when Stop ends it early
+var ErrStopped = errors.New("torrent stopped")
+
 // maxBacklog is the number of unfulfilled requests a client can have in its pipeline
 var maxBacklog int = 200
 
-type File struct {
-	Length int
-	Path   []string
-}
+type File = storage.File
 
 type TorrentMeta struct {
-	Peers       chan *peer.Peer
-	PeerID      [20]byte
-	InfoHash    [20]byte
+	Peers  chan *peer.Peer
+	PeerID [20]byte
+	// the hash peers and trackers know the torrent by, the v1 one or the
+	// truncated v2 one of v2 only torrents
+	InfoHash [20]byte
+	// empty for v2 only torrents
 	PieceHashes [][20]byte
 	PieceLength int
 	Length      int
-	Name        string
-	Files       []File
+	// Name is made safe for the local filesystem, OriginalName is the name
+	// as the torrent gives it, which mirrors go by. Name stands in for it
+	// when it is empty.
+	Name         string
+	OriginalName string
+	Files        []File
+	// BEP 47 attributes of the file of single file torrents
+	Attr string
+	// the info dictionary exactly as it is in the torrent file, what the
+	// info hash is computed over and what ut_metadata serves
+	Info []byte
+	// BitTorrent v2 (BEP 52) of v2 and hybrid torrents: the full info hash,
+	// the Merkle tree root of every file, the single file too, and the
+	// hashes of the pieces of files larger than a piece, by their root
+	InfoHashV2  [32]byte
+	PiecesRoots [][32]byte
+	PieceLayers map[[32]byte][][32]byte
+	// HTTP mirrors of the torrent's content, BEP 19
+	WebSeeds []string
 }
 
 type TorrentStatus struct {
@@ -64,20 +122,261 @@ type TorrentStatus struct {
 }
 
 type Torrent struct {
-	Meta   TorrentMeta
-	Status TorrentStatus
+	Meta       TorrentMeta
+	Status     TorrentStatus
+	Extensions *extension.Registry
+	// per torrent rate limits, on top of the global ones
+	DownLimit *ratelimit.Limiter
+	UpLimit   *ratelimit.Limiter
+	// where the pieces are kept, files under the download location unless
+	// set before Download
+	Storage storage.Storage
+	// how the files take up space before their pieces arrive
+	Allocation storage.Allocation
+	// where the files go, where they are while downloading, the suffix
+	// they have there and if the storage is open, guarded by moveMu which
+	// is held for whole moves
+	moveMu     sync.Mutex
+	savePath   string
+	storageDir string
+	suffix     string
+	live       bool
+	// the last move started from the API
+	moveStatusMu sync.Mutex
+	moveStatus   MoveStatus
+	// verified pieces, the ones we serve to peers
+	haveMu sync.Mutex
+	have   []bool
+	choker *choker
+	// set while downloading, so incoming peers can join in
+	pool      *peerPool
+	workQueue chan *pieceWork
+	results   chan *pieceResult
+	// set once every piece is in, the peers are only served from then on
+	seeding atomic.Bool
+	// done is closed by Stop and stopped once everything Download started
+	// is over, which includes the peers counted in running. Guarded by runMu.
+	runMu    sync.Mutex
+	done     chan struct{}
+	stopped  chan struct{}
+	stopOnce sync.Once
+	stopErr  error
+	stopping bool
+	running  sync.WaitGroup
+}
+
+// Peers lists the connected peers with their choke state
+func (torrent *Torrent) Peers() []PeerStatus {
+	if torrent.choker == nil {
+		return []PeerStatus{}
+	}
+
+	return torrent.choker.status()
+}
+
+// Layout describes how the torrent's pieces are laid over its files
+func (torrent *Torrent) Layout() storage.Layout {
+	return storage.Layout{
+		Name:        torrent.Meta.Name,
+		PieceLength: torrent.Meta.PieceLength,
+		Length:      torrent.Meta.Length,
+		Files:       torrent.Meta.Files,
+		Attr:        torrent.Meta.Attr,
+	}
+}
+
+func (torrent *Torrent) setHave(index int) {
+	torrent.haveMu.Lock()
+	defer torrent.haveMu.Unlock()
+
+	torrent.have[index] = true
+}
+
+// havePieces lists the verified pieces
+func (torrent *Torrent) havePieces() []int {
+	torrent.haveMu.Lock()
+	defer torrent.haveMu.Unlock()
+
+	pieces := []int{}
+	for index, ok := range torrent.have {
+		if ok {
+			pieces = append(pieces, index)
+		}
+	}
+	return pieces
+}
+
+// ReadBlock reads a block of a verified piece for a peer
+func (torrent *Torrent) ReadBlock(index, begin, length int) ([]byte, error) {
+	torrent.haveMu.Lock()
+	ok := index >= 0 && index < len(torrent.have) && torrent.have[index]
+	torrent.haveMu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("piece #%d isn't downloaded", index)
+	}
+
+	return storage.ReadBlock(torrent.Storage, index, begin, length)
+}
+
+// Stop ends the download, or the seeding that carries on after it, and
+// returns once every peer is gone and the storage is closed
+func (torrent *Torrent) Stop() error {
+	torrent.runMu.Lock()
+	done, stopped := torrent.done, torrent.stopped
+	torrent.runMu.Unlock()
+	if done == nil {
+		return nil
+	}
+
+	torrent.stopOnce.Do(func() {
+		close(done)
+	})
+	<-stopped
+	return torrent.stopErr
+}
+
+// teardown waits for Stop, lets the peers go and closes the storage once
+// none of them can read from it anymore. disk is nil for storages the
+// caller set, which are theirs to close.
+func (torrent *Torrent) teardown(disk *storage.Async) {
+	<-torrent.done
+	unregister(torrent)
+
+	torrent.runMu.Lock()
+	torrent.stopping = true
+	torrent.runMu.Unlock()
+
+	// peers stuck writing to a slow connection notice once it is closed
+	if torrent.choker != nil {
+		for _, c := range torrent.choker.clients() {
+			c.Conn.Close()
+		}
+	}
+	torrent.running.Wait()
+
+	if disk != nil {
+		// moves wait for the storage to close and go by the files then
+		torrent.moveMu.Lock()
+		torrent.live = false
+		torrent.stopErr = disk.Close()
+		torrent.moveMu.Unlock()
+	}
+	close(torrent.stopped)
+}
+
+// join counts a peer in for Stop to wait for, unless it is too late
+func (torrent *Torrent) join() bool {
+	torrent.runMu.Lock()
+	defer torrent.runMu.Unlock()
+
+	if torrent.stopping {
+		return false
+	}
+	torrent.running.Add(1)
+	return true
+}
+
+// stagingLocation is where the files are kept while the download runs,
+// which is the download location itself unless the staging settings say
+// otherwise. Files that made it there on an earlier run stay put.
+func (torrent *Torrent) stagingLocation(downloadLocation string) (string, string) {
+	staging := CurrentStaging()
+	dir, suffix := downloadLocation, ""
+	if staging.IncompleteDir != "" {
+		dir = staging.IncompleteDir
+	}
+	if staging.PartSuffix {
+		suffix = ".part"
+	}
+	if dir == downloadLocation && suffix == "" {
+		return dir, suffix
+	}
+
+	layout := torrent.Layout()
+	for i, path := range layout.Paths(downloadLocation, "") {
+		if layout.Virtual(i) {
+			continue
+		}
+		if _, err := os.Lstat(path); err != nil {
+			return dir, suffix
+		}
+	}
+	return downloadLocation, ""
+}
+
+// finish moves the staged files of a complete download to the save path,
+// which a move may have changed since the download started
+func (torrent *Torrent) finish() error {
+	torrent.moveMu.Lock()
+	defer torrent.moveMu.Unlock()
+
+	err := torrent.Storage.(storage.Mover).Move(torrent.savePath, "", nil)
+	if err != nil {
+		return err
+	}
+	torrent.storageDir, torrent.suffix = torrent.savePath, ""
+
+	// a move that waited for this is done now
+	torrent.setMoveStatus(func(status *MoveStatus) {
+		if status.State == "deferred" {
+			status.State, status.Moved = "done", status.Total
+		}
+	})
+	return nil
+}
+
+// recheck verifies every piece again, returning the work for the ones that
+// fail so they can be downloaded again
+func (torrent *Torrent) recheck() ([]*pieceWork, error) {
+	// pieces still cached would pass whatever became of them on the disk
+	s := torrent.Storage
+	if disk, ok := s.(*storage.Async); ok {
+		if err := disk.Sync(); err != nil {
+			return nil, err
+		}
+		s = disk.Backend()
+	}
+
+	failed := []*pieceWork{}
+	for index := 0; index < torrent.numPieces(); index++ {
+		if torrent.verifyIn(s, index) {
+			continue
+		}
+
+		torrent.haveMu.Lock()
+		torrent.have[index] = false
+		torrent.haveMu.Unlock()
+		failed = append(failed, &pieceWork{index, torrent.Layout().PieceSize(index)})
+	}
+	return failed, nil
+}
+
+// waitForDisk puts the piece back and waits while the disk can't keep up,
+// telling the caller to pick again once it can
+func (torrent *Torrent) waitForDisk(workQueue chan *pieceWork, pw *pieceWork) bool {
+	disk, ok := torrent.Storage.(*storage.Async)
+	if !ok || !disk.Full() {
+		return false
+	}
+
+	workQueue <- pw // Put piece back on the queue
+	disk.WaitRoom()
+	return true
 }
 
 type pieceWork struct {
 	index  int
-	hash   [20]byte
 	length int
 }
 
 type pieceResult struct {
 	index int
 	buf   []byte
-	error string
+}
+
+type block struct {
+	begin  int
+	length int
 }
 
 type pieceProgress struct {
@@ -87,23 +386,37 @@ type pieceProgress struct {
 	downloaded int
 	requested  int
 	backlog    int
+	// blocks the peer rejected, requested again before any new ones
+	rejected []block
 }
 
-func getPiece(c *client.Client, pw *pieceWork) ([]byte, error) {
+// getPiece downloads a piece from the peer, taking its messages from msgs
+// and handling the ones that aren't about the piece along the way
+func getPiece(c *client.Client, pw *pieceWork, msgs <-chan *message.Message, readErr <-chan error,
+	done <-chan struct{}) ([]byte, error) {
+
 	state := pieceProgress{
 		index:  pw.index,
 		client: c,
 		buf:    make([]byte, pw.length),
 	}
 
-	// Setting a deadline helps get unresponsive peers unstuck.
-	// 30 seconds is more than enough time to download a 262 KB piece
-	c.Conn.SetDeadline(time.Now().Add(30 * time.Second))
-	defer c.Conn.SetDeadline(time.Time{}) // Disable the deadline
-
 	for state.downloaded < pw.length {
-		// If unchoked, send requests until we have enough unfulfilled requests
-		if !state.client.Choked {
+		// If unchoked, or the piece is allowed fast, send requests until
+		// we have enough unfulfilled requests
+		if !state.client.Choked() || state.client.AllowedFast[pw.index] {
+			for state.backlog < maxBacklog && len(state.rejected) > 0 {
+				b := state.rejected[0]
+
+				err := c.SendRequest(pw.index, b.begin, b.length)
+				if err != nil {
+					return nil, err
+				}
+
+				state.backlog++
+				state.rejected = state.rejected[1:]
+			}
+
 			for state.backlog < maxBacklog && state.requested < pw.length {
 				blockSize := MaxBlockSize
 				// Last block might be shorter than the typical block
@@ -121,27 +434,21 @@ func getPiece(c *client.Client, pw *pieceWork) ([]byte, error) {
 			}
 		}
 
-		// get response
-		msg, err := message.Read(state.client.Conn)
-		if err != nil {
+		// Giving up on a silent peer gets it unstuck. The wait starts over
+		// on every message since rate limits can stretch a piece well past
+		// any fixed time
+		var msg *message.Message
+		select {
+		case msg = <-msgs:
+		case err := <-readErr:
 			return nil, err
-		}
-
-		if msg == nil { // keep-alive
-			continue
+		case <-done:
+			return nil, ErrStopped
+		case <-time.After(30 * time.Second):
+			return nil, fmt.Errorf("timed out waiting for piece #%d", pw.index)
 		}
 
 		switch msg.ID {
-		case message.Unchoke:
-			state.client.Choked = false
-		case message.Choke:
-			state.client.Choked = true
-		case message.Have:
-			index, err := message.ParseHave(msg)
-			if err != nil {
-				return nil, err
-			}
-			state.client.BitField.SetPiece(index)
 		case message.Piece:
 			n, err := message.ParsePiece(state.index, state.buf, msg)
 			if err != nil {
@@ -149,6 +456,22 @@ func getPiece(c *client.Client, pw *pieceWork) ([]byte, error) {
 			}
 			state.downloaded += n
 			state.backlog--
+			state.client.Downloaded.Add(int64(n))
+		case message.RejectRequest:
+			index, begin, length, err := message.ParseRequest(msg)
+			if err != nil {
+				return nil, err
+			}
+			if index != state.index {
+				break
+			}
+			state.rejected = append(state.rejected, block{begin, length})
+			state.backlog--
+		default:
+			err := state.client.Handle(msg)
+			if err != nil {
+				return nil, err
+			}
 		}
 	}
 
@@ -157,8 +480,41 @@ func getPiece(c *client.Client, pw *pieceWork) ([]byte, error) {
 
 var statusLen int = 0
 
-func (torrent *Torrent) startPeer(peer peer.Peer, workQueue chan *pieceWork, results chan *pieceResult) {
-	c, err := client.New(peer, torrent.Meta.PeerID, torrent.Meta.InfoHash )
+// dial connects to the best candidates of the pool whenever there is room
+// for another connection, until done is closed
+func (torrent *Torrent) dial(pool *peerPool, workQueue chan *pieceWork, results chan *pieceResult,
+	done chan struct{}) {
+
+	for {
+		for {
+			peer, ok := pool.next()
+			if !ok {
+				break
+			}
+			go torrent.startPeer(pool, peer, workQueue, results)
+		}
+
+		// slots freed by other torrents don't wake us, so check every second too
+		select {
+		case <-done:
+			return
+		case <-pool.wake:
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (torrent *Torrent) startPeer(pool *peerPool, peer peer.Peer, workQueue chan *pieceWork,
+	results chan *pieceResult) {
+
+	// peers only answer to the info hash of the swarm they were found in
+	infoHash := peer.Swarm()
+	if infoHash == [20]byte{} {
+		infoHash = torrent.Meta.InfoHash
+	}
+
+	c, err := client.New(peer, torrent.Meta.PeerID, infoHash,
+		torrent.numPieces(), torrent.havePieces(), torrent.v2(), torrent.Extensions)
 
 	if err == nil {
 		if Debug {
@@ -168,43 +524,223 @@ func (torrent *Torrent) startPeer(peer peer.Peer, workQueue chan *pieceWork, res
 		if Debug {
 			println("\r" + strings.Repeat(" ", 50+2+statusLen) + "\r" + peer.String(false) + Red + " - " + err.Error() + Reset)
 		}
-		results <- &pieceResult{-1, []byte(""), peer.String(false)}
+		pool.dialed(peer, false)
+
+		return
+	}
+
+	pool.dialed(peer, true)
+	torrent.runPeer(pool, peer, c, workQueue, results)
+}
+
+// runPeer downloads pieces from a connected peer while any are left and
+// serves it the ones we have, which goes on after the download is complete,
+// until either side hangs up or the torrent stops
+func (torrent *Torrent) runPeer(pool *peerPool, peer peer.Peer, c *client.Client,
+	workQueue chan *pieceWork, results chan *pieceResult) {
+
+	defer c.Conn.Close()
+
+	// a peer that drops on an error may be worth another try later
+	retry := false
+	defer func() {
+		pool.closed(peer, retry)
+	}()
+
+	if !torrent.join() {
+		return
+	}
+	defer torrent.running.Done()
+
+	c.Conn = ratelimit.NewConn(c.Conn,
+		[]*ratelimit.Limiter{torrent.DownLimit, ratelimit.GlobalDown},
+		[]*ratelimit.Limiter{torrent.UpLimit, ratelimit.GlobalUp})
+
+	// the choker decides when the peer gets unchoked
+	torrent.choker.add(c)
+	defer torrent.choker.remove(c)
+
+	// the handshake told the peer of the pieces we had before it came along
+	c.Blocks = torrent
+	if torrent.v2() {
+		c.Hashes = torrent
+	}
 
+	// the peer's messages are read in the background, so its requests are
+	// answered whether we download from it or not
+	msgs := make(chan *message.Message)
+	readErr := make(chan error, 1)
+	quit := make(chan struct{})
+	defer close(quit)
+	go readMessages(c.Conn, msgs, readErr, quit)
+
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+
+	// work is nil once the download is complete and while the peer has
+	// none of the pieces left, until it tells us of more or wake fires
+	downloading := !torrent.seeding.Load()
+	work := workQueue
+	var wake <-chan time.Time
+	if downloading {
+		c.SendInterested()
+	} else if c.Seed() {
+		// two seeds have nothing to give each other
 		return
+	} else {
+		work = nil
 	}
 
-	c.SendUnchoke()
-	c.SendInterested()
+	// pieces passed over looking for an allowed fast one, and ones the
+	// peer doesn't have
+	skipped := 0
+	missing := 0
+
+	for {
+		var pw *pieceWork
+		select {
+		case <-torrent.done:
+			return
+		case err := <-readErr:
+			if Debug {
+				println("\r" + strings.Repeat(" ", 50+2+statusLen) + "\r" + peer.String(false) +
+					Red + " - exiting: " + err.Error() + Reset)
+			}
+			retry = downloading
+			return
+		case msg := <-msgs:
+			// blocks of pieces we gave up on fall through here harmlessly
+			if err := c.Handle(msg); err != nil {
+				if Debug {
+					println("\r" + strings.Repeat(" ", 50+2+statusLen) + "\r" + peer.String(false) +
+						Red + " - exiting: " + err.Error() + Reset)
+				}
+				return
+			}
+			if msg.ID == message.Interested {
+				torrent.choker.interested(c)
+			}
+			if !downloading && c.Seed() {
+				return
+			}
+			if downloading {
+				work = workQueue
+			}
+			continue
+		case <-wake:
+			wake = nil
+			work = workQueue
+			continue
+		case <-keepAlive.C:
+			c.SendKeepAlive()
+			continue
+		case next, ok := <-work:
+			if !ok {
+				// the download is complete, from here on we only seed
+				downloading, work = false, nil
+				c.SendNotInterested()
+				if c.Seed() {
+					return
+				}
+				continue
+			}
+			pw = next
+		}
+
+		if Bans.IsBanned(peer.String(true)) {
+			if Debug {
+				println("\r" + strings.Repeat(" ", 50+2+statusLen) + "\r" + peer.String(false) +
+					Red + " - exiting: banned" + Reset)
+			}
+			workQueue <- pw // Put piece back on the queue
+			return
+		}
 
-	for pw := range workQueue {
 		if !c.BitField.HasPiece(pw.index) {
 			workQueue <- pw // Put piece back on the queue
+
+			// after a whole pass of the queue turns up nothing the peer
+			// has, wait for it to announce more
+			missing++
+			if missing >= torrent.numPieces() {
+				missing = 0
+				work, wake = nil, time.After(time.Second)
+			}
 			continue
 		}
+		missing = 0
 
-		buf, err := getPiece(c, pw)
+		// While choked, go after the pieces we are allowed to fetch anyway,
+		// until a whole pass of the queue turns none up
+		if c.Choked() && len(c.AllowedFast) > 0 && !c.AllowedFast[pw.index] &&
+			skipped < torrent.numPieces() {
+
+			skipped++
+			workQueue <- pw // Put piece back on the queue
+			continue
+		}
+		skipped = 0
+
+		if torrent.waitForDisk(workQueue, pw) {
+			continue
+		}
+
+		buf, err := getPiece(c, pw, msgs, readErr, torrent.done)
 		if err != nil {
 			if Debug {
 				println("\r" + strings.Repeat(" ", 50+2+statusLen) + "\r" + peer.String(false) +
 					Red + " - exiting: " + err.Error() + Reset)
 			}
-			results <- &pieceResult{-1, []byte(""), peer.String(false)}
+			retry = true
 
 			workQueue <- pw // Put piece back on the queue
 			return
 		}
 
-		hash := sha1.Sum(buf)
-		if !bytes.Equal(hash[:], pw.hash[:]) {
+		if !torrent.checkPiece(pw.index, buf) {
 			if Debug {
 				fmt.Printf(Red+"Piece #%d failed integrity check, retrying.\n"+Reset, pw.index)
 			}
+			Bans.pieceFailed(torrent.Meta.InfoHash, pw.index, buf, peer.String(true))
 			workQueue <- pw // Put piece back on the queue
 			continue
 		}
 
+		Bans.pieceVerified(torrent.Meta.InfoHash, pw.index, buf)
+		pool.delivered(peer)
+
 		c.SendHave(pw.index)
-		results <- &pieceResult{pw.index, buf, ""}
+		select {
+		case results <- &pieceResult{pw.index, buf}:
+		case <-torrent.done:
+			return
+		}
+	}
+}
+
+// readMessages passes the peer's messages on until reading fails, which
+// ends it with the error, or quit is closed. Peers keep quiet connections
+// alive, so a long silence is an error too.
+func readMessages(conn net.Conn, msgs chan<- *message.Message, readErr chan<- error,
+	quit <-chan struct{}) {
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		msg, err := message.Read(conn)
+		if err != nil {
+			readErr <- err
+			return
+		}
+
+		if msg == nil { // keep-alive
+			continue
+		}
+
+		select {
+		case msgs <- msg:
+		case <-quit:
+			return
+		}
 	}
 }
 
@@ -264,85 +800,51 @@ func secondsToHuman(input int) (result string) {
 	return
 }
 
-func findSlice(s []peer.Peer, key string) int {
-	for i, v := range s {
-		if v.String(false) == key {
-			return i
+// Download fetches the torrent into downloadLocation, returning once it is
+// complete or the pieces can't be stored. A complete torrent is seeded from
+// then on, until Stop.
+func (torrent *Torrent) Download(downloadLocation string) (err error) {
+	torrent.runMu.Lock()
+	torrent.done, torrent.stopped = make(chan struct{}), make(chan struct{})
+	torrent.runMu.Unlock()
+
+	// the peers carry on seeding until Stop, which a failed download calls
+	// right away
+	var disk *storage.Async
+	defer func() {
+		go torrent.teardown(disk)
+		if err != nil {
+			torrent.Stop()
 		}
-	}
+	}()
 
-	return -1
-}
+	// moves wait until the storage is open
+	torrent.moveMu.Lock()
+	torrent.savePath, torrent.storageDir, torrent.suffix = downloadLocation, downloadLocation, ""
 
-func removeIndex(s []peer.Peer, index int) []peer.Peer {
-	return append(s[:index], s[index+1:]...)
-}
+	// a storage set by the caller, like an in-memory one, is theirs to close
+	staged := false
+	if torrent.Storage == nil {
+		dir, suffix := torrent.stagingLocation(downloadLocation)
+		staged = dir != downloadLocation || suffix != ""
+		torrent.storageDir, torrent.suffix = dir, suffix
 
-func (torrent *Torrent) Download(downloadLocation string) {
-	var fileArray []os.File
-	var fileSingle os.File
-
-	if _, err := os.Stat(downloadLocation); os.IsNotExist(err) {
-		err = os.Mkdir(downloadLocation, 0755)
+		store, err := storage.NewFile(dir, torrent.Layout(), torrent.Allocation, suffix)
 		if err != nil {
+			torrent.moveMu.Unlock()
 			if Debug {
 				fmt.Printf(Red+"%v"+Reset, err)
 			}
+			return err
 		}
+		// pieces reach the disk in the background, so a slow disk doesn't
+		// hold up the peers
+		disk = storage.NewAsync(store, torrent.Layout())
+		torrent.Storage = disk
 	}
 
-	if len(torrent.Meta.Files) == 0 {
-		// Single file in torrent
-		f, err := os.Create(filepath.Join(downloadLocation, torrent.Meta.Name))
-		if err != nil {
-			if Debug {
-				fmt.Printf(Red+"%v"+Reset, err)
-			}
-			return
-		}
-		fileSingle = *f
-		defer f.Close()
-	} else {
-		// Multiple files in torrent
-
-		// Creation of core directory
-		if _, err := os.Stat(filepath.Join(downloadLocation, torrent.Meta.Name)); os.IsNotExist(err) {
-			err := os.Mkdir(filepath.Join(downloadLocation, torrent.Meta.Name), 0755)
-			if err != nil {
-				if Debug {
-					fmt.Printf(Red+"%v"+Reset, err)
-				}
-			}
-		}
-
-		// Get each "file" in the torrent
-		for _, file := range torrent.Meta.Files {
-			// create the nested directories
-			path := filepath.Join(downloadLocation, torrent.Meta.Name)
-			for _, f := range file.Path[:len(file.Path)-1] {
-				path = filepath.Join(path, f)
-			}
-
-			if _, err := os.Stat(path); os.IsNotExist(err) {
-				err := os.MkdirAll(path, 0755)
-				if err != nil {
-					if Debug {
-						fmt.Printf(Red+"%v"+Reset, err)
-					}
-				}
-			}
-
-			// and then the file
-			f, err := os.Create(filepath.Join(path, file.Path[len(file.Path)-1]))
-			if err != nil {
-				println("create file error")
-				return
-			}
-			fileArray = append(fileArray, *f)
-
-			defer f.Close()
-		}
-	}
+	torrent.live = true
+	torrent.moveMu.Unlock()
 
 	ch := make(chan string)
 	go func(ch chan string) {
@@ -355,38 +857,56 @@ func (torrent *Torrent) Download(downloadLocation string) {
 			}
 			ch <- s
 		}
-		close(ch)
 	}(ch)
 
 	numPieces := 0
+	donePieces := 0
 
-	workQueue := make(chan *pieceWork, len(torrent.Meta.PieceHashes))
+	// pieces left over from an earlier run are rechecked instead of
+	// downloaded again
+	torrent.have = make([]bool, torrent.numPieces())
+	workQueue := make(chan *pieceWork, torrent.numPieces())
 	results := make(chan *pieceResult)
-	for index, hash := range torrent.Meta.PieceHashes {
-		begin := index * torrent.Meta.PieceLength
-		end := begin + torrent.Meta.PieceLength
-		if end > torrent.Meta.Length {
-			end = torrent.Meta.Length
-		}
+	for index := 0; index < torrent.numPieces(); index++ {
 		numPieces++
-		workQueue <- &pieceWork{index, hash, end - begin}
+		if torrent.verifyStored(index) {
+			torrent.setHave(index)
+			donePieces++
+			continue
+		}
+		workQueue <- &pieceWork{index, torrent.Layout().PieceSize(index)}
 	}
+	torrent.Status.Progress = float64(donePieces) / float64(torrent.numPieces()) * 100
 
-	// Connect to each peer once
-	var peersUsed []peer.Peer
+	torrent.choker = newChoker(torrent.seeding.Load)
+	done := torrent.done
+	go torrent.choker.run(done)
 
-SKIP:
-	for peer := range torrent.Meta.Peers {
-		for _, v := range peersUsed {
-			if reflect.DeepEqual(v, *peer) {
-				continue SKIP
-			}
+	// Peers from the trackers wait in the pool until a connection slot opens
+	pool := newPeerPool()
+	go func() {
+		for peer := range torrent.Meta.Peers {
+			pool.add(*peer)
 		}
-
-		go torrent.startPeer(*peer, workQueue, results)
-		peersUsed = append(peersUsed, *peer)
+	}()
+	if torrent.Extensions != nil {
+		exchange := newPex(pool)
+		torrent.Extensions.Register(exchange)
+		go exchange.run(torrent.choker, done)
+
+		if len(torrent.Meta.Info) > 0 {
+			torrent.Extensions.Register(&metadata{info: torrent.Meta.Info})
+			torrent.Extensions.MetadataSize = len(torrent.Meta.Info)
+		}
+	}
+	go torrent.dial(pool, workQueue, results, done)
+	for _, base := range torrent.Meta.WebSeeds {
+		go torrent.runWebSeed(base, workQueue, results, done)
 	}
 
+	torrent.pool, torrent.workQueue, torrent.results = pool, workQueue, results
+	register(torrent)
+
 	println("\r" + Green + "Download started: " + Reset + torrent.Meta.Name)
 
 	newPieces := 0
@@ -395,169 +915,146 @@ SKIP:
 	var rate float64
 	var oldRate float64
 
-	donePieces := 0
-	for donePieces < len(torrent.Meta.PieceHashes) {
-		res := <-results
-		if res.index == -1 {
-			peersUsed = removeIndex(peersUsed, findSlice(peersUsed, res.error))
-			continue
-		}
-
-		donePieces++
-		newPieces++
+	// staged files only go to the download location once every piece
+	// checks out, the ones that don't are downloaded again
+	for {
+		for donePieces < torrent.numPieces() {
+			var res *pieceResult
+			select {
+			case res = <-results:
+			case <-done:
+				return ErrStopped
+			}
 
-		if time.Since(start).Seconds() > 1 {
-			oldRate = rate
-			rate = float64(newPieces) * float64(torrent.Meta.PieceLength) / time.Since(start).Seconds()
-			rate = (rate + oldRate) / 2
-			if rate/1024 < 20 {
-				maxBacklog = int(rate/1024 + 2)
-			} else {
-				maxBacklog = int(rate/1024/5 + 18)
+			donePieces++
+			newPieces++
+
+			if time.Since(start).Seconds() > 1 {
+				oldRate = rate
+				rate = float64(newPieces) * float64(torrent.Meta.PieceLength) / time.Since(start).Seconds()
+				rate = (rate + oldRate) / 2
+				if rate/1024 < 20 {
+					maxBacklog = int(rate/1024 + 2)
+				} else {
+					maxBacklog = int(rate/1024/5 + 18)
+				}
+				newPieces = 0
+				start = time.Now()
 			}
-			newPieces = 0
-			start = time.Now()
-		}
 
-		if len(torrent.Meta.Files) == 0 {
-			_, err := fileSingle.Seek(int64(res.index*torrent.Meta.PieceLength), 0)
+			err := torrent.Storage.WritePiece(res.index, res.buf)
 			if err != nil {
 				if Debug {
 					fmt.Printf(Red+"%v"+Reset, err)
 				}
-				return
+				return err
 			}
-
-			bytesWritten, err := fileSingle.Write(res.buf)
-			if err != nil || bytesWritten != len(res.buf) {
-				if Debug {
-					fmt.Printf(Red+"%v"+Reset, err)
+			torrent.setHave(res.index)
+
+			percent := float64(donePieces) / float64(torrent.numPieces()) * 100
+			torrent.Status.Progress = percent
+
+			select {
+			case stdin, ok := <-ch:
+				if ok {
+					print("\r")
+					print(strings.Repeat(" ", 101))
+					if string([]byte(stdin)[0]) == "P" || string([]byte(stdin)[0]) == "p" {
+						fmt.Print("\n" + Green + "Active Peers: [" + Reset)
+						peersUsed := pool.peers()
+						for i, v := range peersUsed {
+							fmt.Printf("%v", v.String(true))
+							if i < len(peersUsed)-1 {
+								print(" ")
+							}
+						}
+						println(Green + "]" + Reset + "\n")
+					}
 				}
-				return
+			case <-time.After(10 * time.Millisecond):
+				break
 			}
-		} else {
-			fileStart := 0
-			fileEnd := 0
-			pieceStart := res.index * torrent.Meta.PieceLength
 
-			for i, file := range fileArray {
-				fileEnd = torrent.Meta.Files[i].Length + fileStart
+			print("\r")
+			print(strings.Repeat(" ", 101))
 
-				if pieceStart >= fileStart && pieceStart <= fileEnd {
-					//check if piece belongs in this file
+			percentStr := fmt.Sprintf("%0.2f", percent)
 
-					_, err := file.Seek(int64(pieceStart-fileStart), 0)
-					if err != nil {
-						if Debug {
-							fmt.Printf(Red+"%v"+Reset, err)
-						}
-						return
+			print(Cyan + "\r▕" + Reset)
+			for i := 0; i <= 50; i++ {
+				if i <= int(percent)/2 {
+					print(CyanB)
+				}
+				print(White)
+
+				if i < 22 || i > 27 {
+					print(" ")
+				} else {
+					if i == 22 {
+						fmt.Printf("%c", percentStr[0])
+					} else if i == 23 {
+						fmt.Printf("%c", percentStr[1])
+					} else if i == 24 {
+						fmt.Printf("%c", percentStr[2])
+					} else if i == 25 {
+						fmt.Printf("%c", percentStr[3])
+					} else if (i == 26) && len(percentStr) > 4 {
+						fmt.Printf("%c", percentStr[4])
+					} else if i == 27 {
+						print("%")
 					}
+				}
+				print(Reset)
+			}
+			print(Cyan + "▏ " + Reset)
 
-					if pieceStart+len(res.buf) <= fileEnd {
-						// piece belongs in this file
+			var eta string
+			if rate == 0 {
+				eta = "∞"
+			} else {
+				eta = secondsToHuman((torrent.Meta.Length - res.index*torrent.Meta.PieceLength + len(res.buf)) / int(rate))
+			}
 
-						bytesWritten, err := file.Write(res.buf)
-						if err != nil || bytesWritten != len(res.buf) {
-							if Debug {
-								fmt.Printf(Red+"%v"+Reset, err)
-							}
-							return
-						}
-					} else {
-						// part of piece belongs in next file
+			torrent.Status.DownSpeed = float64(rate)
+			torrent.Status.Size = float64(torrent.Meta.Length-donePieces*torrent.Meta.PieceLength+torrent.Meta.PieceLength)
 
-						bytesWritten, err := file.Write(res.buf[0 : fileEnd-pieceStart])
-						if err != nil || bytesWritten != len(res.buf[0:fileEnd-pieceStart]) {
-							if Debug {
-								fmt.Printf(Red+"%v"+Reset, err.Error())
-							}
-							return
-						}
+			status := fmt.Sprintf("%v | #%s | %d (%s) | %v/s | %s", len(pool.peers()),
+				Green+strconv.Itoa(res.index)+Reset, numPieces-donePieces,
+				ByteCountIEC(int64(torrent.Meta.Length-donePieces*torrent.Meta.PieceLength+torrent.Meta.PieceLength)),
+				ByteCountIEC(int64(rate)), eta)
 
-						res.buf = res.buf[fileEnd-pieceStart : len(res.buf)]
-						pieceStart = fileEnd
-					}
-				}
+			print(status)
 
-				fileStart = fileEnd
-			}
+			statusLen = len(status)
 		}
 
-		percent := float64(donePieces) / float64(len(torrent.Meta.PieceHashes)) * 100
-		torrent.Status.Progress = percent
-
-		select {
-		case stdin, ok := <-ch:
-			if ok {
-				print("\r")
-				print(strings.Repeat(" ", 101))
-				if string([]byte(stdin)[0]) == "P" || string([]byte(stdin)[0]) == "p" {
-					fmt.Print("\n" + Green + "Active Peers: [" + Reset)
-					for i, v := range peersUsed {
-						fmt.Printf("%v", v.String(true))
-						if i < len(peersUsed)-1 {
-							print(" ")
-						}
-					}
-					println(Green + "]" + Reset + "\n")
-				}
-			}
-		case <-time.After(10 * time.Millisecond):
+		if !staged {
 			break
 		}
 
-		print("\r")
-		print(strings.Repeat(" ", 101))
-
-		percentStr := fmt.Sprintf("%0.2f", percent)
-
-		print(Cyan + "\r▕" + Reset)
-		for i := 0; i <= 50; i++ {
-			if i <= int(percent)/2 {
-				print(CyanB)
+		failed, err := torrent.recheck()
+		if err != nil {
+			if Debug {
+				fmt.Printf(Red+"%v"+Reset, err)
 			}
-			print(White)
-
-			if i < 22 || i > 27 {
-				print(" ")
-			} else {
-				if i == 22 {
-					fmt.Printf("%c", percentStr[0])
-				} else if i == 23 {
-					fmt.Printf("%c", percentStr[1])
-				} else if i == 24 {
-					fmt.Printf("%c", percentStr[2])
-				} else if i == 25 {
-					fmt.Printf("%c", percentStr[3])
-				} else if (i == 26) && len(percentStr) > 4 {
-					fmt.Printf("%c", percentStr[4])
-				} else if i == 27 {
-					print("%")
+			return err
+		}
+		if len(failed) == 0 {
+			err := torrent.finish()
+			if err != nil {
+				if Debug {
+					fmt.Printf(Red+"%v"+Reset, err)
 				}
+				return err
 			}
-			print(Reset)
+			break
 		}
-		print(Cyan + "▏ " + Reset)
 
-		var eta string
-		if rate == 0 {
-			eta = "∞"
-		} else {
-			eta = secondsToHuman((torrent.Meta.Length - res.index*torrent.Meta.PieceLength + len(res.buf)) / int(rate))
+		for _, pw := range failed {
+			workQueue <- pw
 		}
-
-		torrent.Status.DownSpeed = float64(rate)
-		torrent.Status.Size = float64(torrent.Meta.Length-donePieces*torrent.Meta.PieceLength+torrent.Meta.PieceLength)
-
-		status := fmt.Sprintf("%v | #%s | %d (%s) | %v/s | %s", len(peersUsed),
-			Green+strconv.Itoa(res.index)+Reset, numPieces-donePieces,
-			ByteCountIEC(int64(torrent.Meta.Length-donePieces*torrent.Meta.PieceLength+torrent.Meta.PieceLength)),
-			ByteCountIEC(int64(rate)), eta)
-
-		print(status)
-
-		statusLen = len(status)
+		donePieces -= len(failed)
+		torrent.Status.Progress = float64(donePieces) / float64(torrent.numPieces()) * 100
 	}
 
 	print("\r")
@@ -581,5 +1078,18 @@ SKIP:
 	}
 	print("\n")
 
+	// the last pieces are only on disk once the cache is written out
+	if disk != nil {
+		if err := disk.Sync(); err != nil {
+			if Debug {
+				fmt.Printf(Red+"%v"+Reset, err)
+			}
+			return err
+		}
+	}
+
+	torrent.seeding.Store(true)
 	close(workQueue)
+	println("\r" + Green + "Seeding: " + Reset + torrent.Meta.Name)
+	return nil
 }
\ No newline at end of file
@@ -0,0 +1,243 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/johneliades/flash/peer"
+	"github.com/johneliades/flash/ratelimit"
+	"github.com/johneliades/flash/storage"
+)
+
+// newTestTorrent is a single file torrent of data kept in memory, with no
+// trackers and no extensions
+func newTestTorrent(data []byte, pieceLength int, peerID byte) *Torrent {
+	meta := TorrentMeta{
+		Peers:       make(chan *peer.Peer, 1),
+		PeerID:      [20]byte{peerID},
+		InfoHash:    sha1.Sum(data),
+		PieceLength: pieceLength,
+		Length:      len(data),
+		Name:        "test",
+	}
+	for begin := 0; begin < len(data); begin += pieceLength {
+		end := min(begin+pieceLength, len(data))
+		meta.PieceHashes = append(meta.PieceHashes, sha1.Sum(data[begin:end]))
+	}
+
+	torrent := &Torrent{Meta: meta, DownLimit: ratelimit.New(0), UpLimit: ratelimit.New(0)}
+	torrent.Storage = storage.NewMemory(torrent.Layout())
+	return torrent
+}
+
+func TestSeeding(t *testing.T) {
+	data := make([]byte, 5*32768+1000)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+
+	seeder := newTestTorrent(data, 32768, 's')
+	for index := range seeder.Meta.PieceHashes {
+		begin := index * seeder.Meta.PieceLength
+		seeder.Storage.WritePiece(index, data[begin:begin+seeder.Layout().PieceSize(index)])
+	}
+	if err := seeder.Download(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer seeder.Stop()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go accept(listener)
+
+	// both torrents are in this process, so the leecher takes incoming
+	// peers over from the seeder once it starts and the seeder dials it
+	leecher := newTestTorrent(data, 32768, 'l')
+	downloaded := make(chan error, 1)
+	go func() {
+		downloaded <- leecher.Download(t.TempDir())
+	}()
+	for lookup(leecher.Meta.InfoHash) != leecher {
+		time.Sleep(10 * time.Millisecond)
+	}
+	addr := listener.Addr().(*net.TCPAddr)
+	seeder.Meta.Peers <- peer.New(addr.IP, uint16(addr.Port))
+
+	select {
+	case err := <-downloaded:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(20 * time.Second):
+		t.Fatal("the seeder didn't serve the download")
+	}
+
+	for index := range leecher.Meta.PieceHashes {
+		buf, err := leecher.Storage.ReadPiece(index)
+		begin := index * leecher.Meta.PieceLength
+		if err != nil || !bytes.Equal(buf, data[begin:begin+len(buf)]) {
+			t.Errorf("piece #%d didn't arrive intact: %v", index, err)
+		}
+	}
+
+	// the leecher seeds from here on too, and both stop when told to
+	for _, torrent := range []*Torrent{leecher, seeder} {
+		if !torrent.seeding.Load() {
+			t.Error("a complete torrent isn't seeding")
+		}
+		if err := torrent.Stop(); err != nil {
+			t.Error(err)
+		}
+		if lookup(torrent.Meta.InfoHash) == torrent {
+			t.Error("a stopped torrent still takes incoming peers")
+		}
+	}
+}
+
+func TestStopDownload(t *testing.T) {
+	torrent := newTestTorrent(make([]byte, 100), 64, 'x')
+
+	downloaded := make(chan error, 1)
+	go func() {
+		downloaded <- torrent.Download(t.TempDir())
+	}()
+	for lookup(torrent.Meta.InfoHash) != torrent {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := torrent.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-downloaded; !errors.Is(err, ErrStopped) {
+		t.Errorf("got %v, want %v", err, ErrStopped)
+	}
+	if err := torrent.Stop(); err != nil {
+		t.Errorf("second Stop: %v", err)
+	}
+}
+
+// corrupting is a storage whose writes of one piece don't come out right,
+// like a failing disk
+type corrupting struct {
+	storage.Storage
+	index int
+}
+
+func (s corrupting) WritePiece(index int, buf []byte) error {
+	if index == s.index {
+		buf = append([]byte{}, buf...)
+		buf[0]++
+	}
+	return s.Storage.WritePiece(index, buf)
+}
+
+func TestRecheckGoesByTheDisk(t *testing.T) {
+	data := make([]byte, 1000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	torrent := newTestTorrent(data, 256, 'r')
+	disk := storage.NewAsync(corrupting{torrent.Storage, 2}, torrent.Layout())
+	defer disk.Close()
+	torrent.Storage = disk
+	torrent.have = make([]bool, torrent.numPieces())
+
+	for index := range torrent.Meta.PieceHashes {
+		begin := index * torrent.Meta.PieceLength
+		disk.WritePiece(index, data[begin:begin+torrent.Layout().PieceSize(index)])
+		torrent.setHave(index)
+	}
+
+	failed, err := torrent.recheck()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failed) != 1 || failed[0].index != 2 {
+		t.Fatalf("%d pieces failed, want piece #2 alone", len(failed))
+	}
+	if torrent.have[2] {
+		t.Error("piece #2 is still served")
+	}
+}
+
+func TestDeferredMove(t *testing.T) {
+	defer SetStaging(CurrentStaging())
+	SetStaging(Staging{IncompleteDir: t.TempDir()})
+
+	torrent := newTestTorrent(make([]byte, 100), 64, 'm')
+	torrent.Storage = nil
+	go torrent.Download(t.TempDir())
+	for lookup(torrent.Meta.InfoHash) != torrent {
+		time.Sleep(10 * time.Millisecond)
+	}
+	defer torrent.Stop()
+
+	// the files stay staged until the download completes
+	to := t.TempDir()
+	if err := torrent.StartMove(to); err != nil {
+		t.Fatal(err)
+	}
+	status := torrent.MoveStatus()
+	for status.State == "moving" {
+		time.Sleep(10 * time.Millisecond)
+		status = torrent.MoveStatus()
+	}
+	if status.State != "deferred" || status.Moved != 0 {
+		t.Errorf("a move of staged files is %s with %d bytes moved", status.State, status.Moved)
+	}
+}
+
+func TestStopWebSeed(t *testing.T) {
+	// a mirror that takes forever to answer
+	requested := make(chan struct{}, 1)
+	answered := make(chan struct{}, 1)
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case requested <- struct{}{}:
+		default:
+		}
+		<-r.Context().Done()
+		answered <- struct{}{}
+	}))
+	defer mirror.Close()
+
+	torrent := newTestTorrent(make([]byte, 100), 64, 'w')
+	torrent.Meta.WebSeeds = []string{mirror.URL}
+	go torrent.Download(t.TempDir())
+
+	select {
+	case <-requested:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the mirror wasn't asked for a piece")
+	}
+
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- torrent.Stop()
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop waited for the mirror")
+	}
+
+	// Stop waited for the web seed to give up on its request and hand the
+	// piece back
+	if len(torrent.workQueue) != torrent.numPieces() {
+		t.Errorf("%d of %d pieces left to download after Stop", len(torrent.workQueue), torrent.numPieces())
+	}
+	select {
+	case <-answered:
+	case <-time.After(5 * time.Second):
+		t.Error("the request to the mirror outlived Stop")
+	}
+}
@@ -0,0 +1,132 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"fmt"
+
+	"github.com/johneliades/flash/merkle"
+	"github.com/johneliades/flash/message"
+	"github.com/johneliades/flash/storage"
+)
+
+// maxHashes is the most hashes a hash request can ask for
+const maxHashes = 512
+
+// v2 tells if the torrent has BitTorrent v2 hashes, hybrids included
+func (torrent *Torrent) v2() bool {
+	return len(torrent.Meta.PiecesRoots) > 0
+}
+
+func (torrent *Torrent) numPieces() int {
+	return torrent.Layout().NumPieces()
+}
+
+// Swarms lists the info hashes peers find the torrent under, hybrids are
+// in the v1 and the v2 swarm
+func (meta *TorrentMeta) Swarms() [][20]byte {
+	swarms := [][20]byte{meta.InfoHash}
+	if meta.InfoHashV2 != [32]byte{} {
+		var short [20]byte
+		copy(short[:], meta.InfoHashV2[:20])
+		if short != meta.InfoHash {
+			swarms = append(swarms, short)
+		}
+	}
+	return swarms
+}
+
+// fileLength is the length of a file of the layout, the single file too
+func (torrent *Torrent) fileLength(file int) int {
+	if len(torrent.Meta.Files) == 0 {
+		return torrent.Meta.Length
+	}
+	return torrent.Meta.Files[file].Length
+}
+
+// checkPiece verifies a piece against every hash the torrent has for it,
+// the SHA-1 of v1 and the Merkle tree of v2
+func (torrent *Torrent) checkPiece(index int, buf []byte) bool {
+	if len(torrent.Meta.PieceHashes) > 0 && sha1.Sum(buf) != torrent.Meta.PieceHashes[index] {
+		return false
+	}
+	if !torrent.v2() {
+		return true
+	}
+
+	// v2 pieces start a file and any padding after it is left out
+	layout := torrent.Layout()
+	for _, span := range layout.PieceSpans(index) {
+		if !layout.Virtual(span.File) {
+			return torrent.checkV2(span, buf[:span.Length])
+		}
+	}
+	return true
+}
+
+// checkV2 verifies the part of a piece in a file against the file's tree.
+// Files up to a piece long have their root as their only piece's hash.
+func (torrent *Torrent) checkV2(span storage.Span, data []byte) bool {
+	root := torrent.Meta.PiecesRoots[span.File]
+	length := torrent.fileLength(span.File)
+	pieceLength := torrent.Meta.PieceLength
+
+	if length <= pieceLength {
+		blocks := (length + merkle.BlockSize - 1) / merkle.BlockSize
+		return span.Offset == 0 &&
+			merkle.Root(merkle.BlockHashes(data), merkle.NextPow2(blocks), [32]byte{}) == root
+	}
+
+	layer := torrent.Meta.PieceLayers[root]
+	i := int(span.Offset) / pieceLength
+	if int(span.Offset)%pieceLength != 0 || i >= len(layer) {
+		return false
+	}
+	return merkle.Root(merkle.BlockHashes(data), pieceLength/merkle.BlockSize, [32]byte{}) == layer[i]
+}
+
+// verifyStored tells if a piece of the storage checks out
+func (torrent *Torrent) verifyStored(index int) bool {
+	return torrent.verifyIn(torrent.Storage, index)
+}
+
+// verifyIn tells if a piece checks out in s
+func (torrent *Torrent) verifyIn(s storage.Storage, index int) bool {
+	if !torrent.v2() {
+		ok, _ := s.Verify(index, torrent.Meta.PieceHashes[index])
+		return ok
+	}
+
+	buf, err := s.ReadPiece(index)
+	return err == nil && torrent.checkPiece(index, buf)
+}
+
+// ReadHashes serves the hash requests of peers from the piece layers, the
+// only layer of the trees we keep. The proof follows the hashes.
+func (torrent *Torrent) ReadHashes(req message.HashRange) ([][32]byte, error) {
+	layer, ok := torrent.Meta.PieceLayers[req.PiecesRoot]
+	if !ok {
+		return nil, fmt.Errorf("no piece layer for %x", req.PiecesRoot)
+	}
+
+	pieceLayer := merkle.Log2(torrent.Meta.PieceLength / merkle.BlockSize)
+	if req.BaseLayer != pieceLayer {
+		return nil, fmt.Errorf("only layer %d is kept, not %d", pieceLayer, req.BaseLayer)
+	}
+	if req.Length < 1 || req.Length > maxHashes || merkle.NextPow2(req.Length) != req.Length ||
+		req.Index%req.Length != 0 {
+
+		return nil, fmt.Errorf("invalid hash request of %d hashes at %d", req.Length, req.Index)
+	}
+
+	layers := merkle.Layers(layer, merkle.NextPow2(len(layer)), merkle.PadHash(pieceLayer))
+	if req.Index+req.Length > len(layers[0]) {
+		return nil, fmt.Errorf("hashes %d to %d are outside the tree", req.Index, req.Index+req.Length)
+	}
+
+	hashes := append([][32]byte{}, layers[0][req.Index:req.Index+req.Length]...)
+	proof, err := merkle.Proof(layers, merkle.Log2(req.Length), req.Index/req.Length, req.ProofLayers)
+	if err != nil {
+		return nil, err
+	}
+	return append(hashes, proof...), nil
+}
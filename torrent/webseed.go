@@ -0,0 +1,180 @@
+package torrent
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/johneliades/flash/proxy"
+	"github.com/johneliades/flash/ratelimit"
+)
+
+const (
+	// a mirror that fails waits this long before its next request, doubling
+	// with every failure in a row up to webSeedMaxBackoff
+	webSeedBackoff    = 5 * time.Second
+	webSeedMaxBackoff = 10 * time.Minute
+	// rate limits can stretch a piece, so the timeout is generous
+	webSeedTimeout = 2 * time.Minute
+)
+
+// webSeedURL is where a mirror serves a file, following BEP 19: a url ending
+// in a slash is a directory holding the torrent's name. Mirrors go by the
+// names in the torrent, not the ones made safe for our disk.
+func (torrent *Torrent) webSeedURL(base string, file int) string {
+	name := torrent.Meta.OriginalName
+	if name == "" {
+		name = torrent.Meta.Name
+	}
+
+	if len(torrent.Meta.Files) == 0 {
+		if strings.HasSuffix(base, "/") {
+			return base + url.PathEscape(name)
+		}
+		return base
+	}
+
+	path := torrent.Meta.Files[file].OriginalPath
+	if path == nil {
+		path = torrent.Meta.Files[file].Path
+	}
+
+	if !strings.HasSuffix(base, "/") {
+		base += "/"
+	}
+	escaped := []string{url.PathEscape(name)}
+	for _, element := range path {
+		escaped = append(escaped, url.PathEscape(element))
+	}
+	return base + strings.Join(escaped, "/")
+}
+
+// getWebPiece downloads a piece from a mirror with a Range request for every
+// file it spans
+func (torrent *Torrent) getWebPiece(ctx context.Context, httpClient *http.Client, base string,
+	pw *pieceWork) ([]byte, error) {
+
+	buf := make([]byte, pw.length)
+	pos := 0
+
+	layout := torrent.Layout()
+	for _, s := range layout.PieceSpans(pw.index) {
+		// mirrors don't serve padding, which is all zeros anyway
+		if layout.Virtual(s.File) {
+			pos += s.Length
+			continue
+		}
+
+		req, err := http.NewRequestWithContext(ctx, "GET", torrent.webSeedURL(base, s.File), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", s.Offset, s.Offset+int64(s.Length)-1))
+
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		// a server that ignores ranges still works for the start of a file
+		if resp.StatusCode != http.StatusPartialContent &&
+			!(resp.StatusCode == http.StatusOK && s.Offset == 0) {
+
+			resp.Body.Close()
+			return nil, fmt.Errorf("%s", resp.Status)
+		}
+
+		body := ratelimit.NewReader(resp.Body, torrent.DownLimit, ratelimit.GlobalDown)
+		_, err = io.ReadFull(body, buf[pos:pos+s.Length])
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		pos += s.Length
+	}
+
+	return buf, nil
+}
+
+// runWebSeed downloads pieces from an HTTP mirror, a peer that has every
+// piece, until the work runs out or done is closed. A failing mirror backs
+// off instead of giving up, since mirrors tend to come back. Stop waits for
+// it like for the peers, and its requests end along with the download.
+func (torrent *Torrent) runWebSeed(base string, workQueue chan *pieceWork, results chan *pieceResult,
+	done chan struct{}) {
+
+	if !torrent.join() {
+		return
+	}
+	defer torrent.running.Done()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	httpClient := proxy.HTTPClient(webSeedTimeout)
+	backoff := webSeedBackoff
+
+	for {
+		var pw *pieceWork
+		select {
+		case <-done:
+			return
+		case next, ok := <-workQueue:
+			if !ok {
+				return
+			}
+			pw = next
+		}
+
+		if torrent.waitForDisk(workQueue, pw) {
+			continue
+		}
+
+		buf, err := torrent.getWebPiece(ctx, httpClient, base, pw)
+		if err == nil && !torrent.checkPiece(pw.index, buf) {
+			err = fmt.Errorf("piece #%d failed integrity check", pw.index)
+		}
+
+		if err != nil {
+			workQueue <- pw // Put piece back on the queue
+			if ctx.Err() != nil {
+				return
+			}
+			if Debug {
+				println("\r" + strings.Repeat(" ", 50+2+statusLen) + "\r" + base +
+					Red + " - " + err.Error() + ", retrying in " + backoff.String() + Reset)
+			}
+
+			select {
+			case <-done:
+				return
+			case <-time.After(backoff):
+			}
+
+			backoff *= 2
+			if backoff > webSeedMaxBackoff {
+				backoff = webSeedMaxBackoff
+			}
+			continue
+		}
+		backoff = webSeedBackoff
+
+		select {
+		case <-done:
+			return
+		case results <- &pieceResult{pw.index, buf}:
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package torrent
+
+import "testing"
+
+func TestWebSeedURL(t *testing.T) {
+	single := &Torrent{Meta: TorrentMeta{Name: "a_b", OriginalName: "a:b"}}
+	multi := &Torrent{Meta: TorrentMeta{Name: "dir", Files: []File{
+		{Path: []string{"what_", "c"}, OriginalPath: []string{"what?", "c."}},
+		{Path: []string{"plain name"}},
+	}}}
+
+	urls := []struct {
+		torrent *Torrent
+		base    string
+		file    int
+		want    string
+	}{
+		{single, "http://mirror.example/file", 0, "http://mirror.example/file"},
+		{single, "http://mirror.example/", 0, "http://mirror.example/a:b"},
+		{multi, "http://mirror.example", 0, "http://mirror.example/dir/what%3F/c."},
+		{multi, "http://mirror.example/", 1, "http://mirror.example/dir/plain%20name"},
+	}
+
+	for _, u := range urls {
+		if got := u.torrent.webSeedURL(u.base, u.file); got != u.want {
+			t.Errorf("got %s, want %s", got, u.want)
+		}
+	}
+}
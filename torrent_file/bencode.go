@@ -0,0 +1,140 @@
+package torrent_file
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+)
+
+// maxDepth is how deep lists and dictionaries may nest, deeper torrents are
+// refused before they can exhaust the stack
+const maxDepth = 256
+
+// rawInfo finds the info dictionary of a torrent file and returns its bytes
+// exactly as they are in the file, what the info hash is computed over.
+// Decoding and encoding it again loses anything that isn't canonical.
+func rawInfo(data []byte) ([]byte, error) {
+	if len(data) == 0 || data[0] != 'd' {
+		return nil, malformed(fmt.Errorf("torrent file isn't a dictionary"))
+	}
+
+	var info []byte
+	pos := 1
+	for pos < len(data) && data[pos] != 'e' {
+		if data[pos] < '0' || data[pos] > '9' {
+			return nil, malformed(fmt.Errorf("dictionary key at %d isn't a string", pos))
+		}
+		keyEnd, err := skipValue(data, pos, 1)
+		if err != nil {
+			return nil, malformed(err)
+		}
+		key := data[bytes.IndexByte(data[pos:keyEnd], ':')+pos+1 : keyEnd]
+
+		end, err := skipValue(data, keyEnd, 1)
+		if err != nil {
+			return nil, malformed(err)
+		}
+		if string(key) == "info" {
+			info = data[keyEnd:end]
+		}
+		pos = end
+	}
+	if pos >= len(data) {
+		return nil, malformed(fmt.Errorf("torrent file ends early"))
+	}
+
+	if info == nil {
+		return nil, &FieldError{Field: "info", Err: ErrMissingField}
+	}
+	if info[0] != 'd' {
+		return nil, &FieldError{Field: "info", Err: ErrWrongType}
+	}
+	return info, nil
+}
+
+// malformed is the error of a torrent file that isn't valid bencode
+func malformed(err error) error {
+	return &FieldError{Err: fmt.Errorf("%w, %v", ErrMalformed, err)}
+}
+
+// skipValue returns where the bencoded value at pos ends
+func skipValue(data []byte, pos, depth int) (int, error) {
+	if pos >= len(data) {
+		return 0, fmt.Errorf("torrent file ends early")
+	}
+	if depth > maxDepth {
+		return 0, fmt.Errorf("torrent file nests deeper than %d", maxDepth)
+	}
+
+	switch c := data[pos]; {
+	case c == 'i':
+		end := bytes.IndexByte(data[pos:], 'e')
+		if end < 0 {
+			return 0, fmt.Errorf("integer at %d never ends", pos)
+		}
+		end += pos
+		if !validInt(data[pos+1 : end]) {
+			return 0, fmt.Errorf("invalid integer at %d", pos)
+		}
+		return end + 1, nil
+
+	case c >= '0' && c <= '9':
+		colon := bytes.IndexByte(data[pos:], ':')
+		if colon < 0 {
+			return 0, fmt.Errorf("string at %d has no length", pos)
+		}
+		colon += pos
+		length, err := strconv.Atoi(string(data[pos:colon]))
+		if err != nil || length < 0 || length > len(data)-colon-1 {
+			return 0, fmt.Errorf("invalid string length at %d", pos)
+		}
+		return colon + 1 + length, nil
+
+	case c == 'l' || c == 'd':
+		pos++
+		for pos < len(data) && data[pos] != 'e' {
+			if c == 'd' && (data[pos] < '0' || data[pos] > '9') {
+				return 0, fmt.Errorf("dictionary key at %d isn't a string", pos)
+			}
+			end, err := skipValue(data, pos, depth+1)
+			if err != nil {
+				return 0, err
+			}
+			pos = end
+			if c == 'd' {
+				if pos, err = skipValue(data, pos, depth+1); err != nil {
+					return 0, err
+				}
+			}
+		}
+		if pos >= len(data) {
+			return 0, fmt.Errorf("torrent file ends early")
+		}
+		return pos + 1, nil
+	}
+
+	return 0, fmt.Errorf("invalid value at %d", pos)
+}
+
+// validInt tells if the digits of an integer are written the only way
+// bencode allows, without a plus sign, leading zeros or a negative zero
+func validInt(number []byte) bool {
+	digits := number
+	if len(digits) > 0 && digits[0] == '-' {
+		digits = digits[1:]
+		if len(digits) > 0 && digits[0] == '0' {
+			return false
+		}
+	}
+	if len(digits) == 0 || (digits[0] == '0' && len(digits) > 1) {
+		return false
+	}
+	for _, c := range digits {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+
+	_, err := strconv.ParseInt(string(number), 10, 64)
+	return err == nil
+}
@@ -0,0 +1,139 @@
+package torrent_file
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors of torrent files that don't hold up, a FieldError tells which field
+// they are about
+var (
+	ErrMalformed      = errors.New("not valid bencode")
+	ErrMissingField   = errors.New("missing")
+	ErrWrongType      = errors.New("wrong type")
+	ErrPiecesLength   = errors.New("pieces length isn't a multiple of 20")
+	ErrNegativeLength = errors.New("negative length")
+	ErrPieceCount     = errors.New("piece count doesn't match the length")
+	ErrPieceLength    = errors.New("piece length out of range")
+	ErrTooLarge       = errors.New("total length too large")
+	ErrNoData         = errors.New("no data to download")
+)
+
+// FieldError is what Open returns for a torrent file it can't use, rather
+// than anything going wrong on our side. Field is like info.files[2].length.
+type FieldError struct {
+	Field string
+	Err   error
+}
+
+func (e *FieldError) Error() string {
+	if e.Field == "" {
+		return "invalid torrent file: " + e.Err.Error()
+	}
+	return fmt.Sprintf("invalid torrent file, %s: %v", e.Field, e.Err)
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+// invalid makes err the error of field, unless it already tells its own
+func invalid(field string, err error) error {
+	var fieldErr *FieldError
+	if errors.As(err, &fieldErr) {
+		return err
+	}
+	return &FieldError{Field: field, Err: err}
+}
+
+// lookup finds a field of a dictionary, a missing one is an error when
+// required and nil otherwise
+func lookup(dict map[string]interface{}, key, field string, required bool) (interface{}, error) {
+	val, ok := dict[key]
+	if !ok && required {
+		return nil, &FieldError{Field: field, Err: ErrMissingField}
+	}
+	return val, nil
+}
+
+func getString(dict map[string]interface{}, key, field string, required bool) (string, error) {
+	val, err := lookup(dict, key, field, required)
+	if err != nil || val == nil {
+		return "", err
+	}
+
+	s, ok := val.(string)
+	if !ok {
+		return "", &FieldError{Field: field, Err: ErrWrongType}
+	}
+	return s, nil
+}
+
+func getInt(dict map[string]interface{}, key, field string, required bool) (int64, error) {
+	val, err := lookup(dict, key, field, required)
+	if err != nil || val == nil {
+		return 0, err
+	}
+
+	i, ok := val.(int64)
+	if !ok {
+		return 0, &FieldError{Field: field, Err: ErrWrongType}
+	}
+	return i, nil
+}
+
+// getLength reads a length, which can't be negative
+func getLength(dict map[string]interface{}, key, field string, required bool) (int, error) {
+	length, err := getInt(dict, key, field, required)
+	if err != nil {
+		return 0, err
+	}
+	if length < 0 {
+		return 0, &FieldError{Field: field, Err: ErrNegativeLength}
+	}
+	return int(length), nil
+}
+
+func getList(dict map[string]interface{}, key, field string, required bool) ([]interface{}, error) {
+	val, err := lookup(dict, key, field, required)
+	if err != nil || val == nil {
+		return nil, err
+	}
+
+	list, ok := val.([]interface{})
+	if !ok {
+		return nil, &FieldError{Field: field, Err: ErrWrongType}
+	}
+	return list, nil
+}
+
+func getDict(dict map[string]interface{}, key, field string, required bool) (map[string]interface{}, error) {
+	val, err := lookup(dict, key, field, required)
+	if err != nil || val == nil {
+		return nil, err
+	}
+
+	d, ok := val.(map[string]interface{})
+	if !ok {
+		return nil, &FieldError{Field: field, Err: ErrWrongType}
+	}
+	return d, nil
+}
+
+// getStrings reads a list of strings, like a path
+func getStrings(dict map[string]interface{}, key, field string, required bool) ([]string, error) {
+	list, err := getList(dict, key, field, required)
+	if err != nil {
+		return nil, err
+	}
+
+	strs := []string{}
+	for i, element := range list {
+		s, ok := element.(string)
+		if !ok {
+			return nil, &FieldError{Field: fmt.Sprintf("%s[%d]", field, i), Err: ErrWrongType}
+		}
+		strs = append(strs, s)
+	}
+	return strs, nil
+}
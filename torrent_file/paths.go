@@ -0,0 +1,81 @@
+package torrent_file
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// ErrUnsafePath is wrapped by the errors of torrents whose name or file
+// paths could end up outside the download location
+var ErrUnsafePath = errors.New("unsafe file path")
+
+// names Windows keeps for devices, with any extension
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// sanitizeElement checks a single name or path element of a torrent. Those
+// that could leave the download location are rejected, characters that
+// some filesystems don't allow are replaced.
+func sanitizeElement(element string) (string, error) {
+	if !utf8.ValidString(element) {
+		return "", fmt.Errorf("%q is not valid UTF-8", element)
+	}
+	if element == "" {
+		return "", fmt.Errorf("empty path element")
+	}
+	if element == "." || element == ".." {
+		return "", fmt.Errorf("%q path element", element)
+	}
+	if strings.ContainsAny(element, "/\\") {
+		return "", fmt.Errorf("%q holds a path separator", element)
+	}
+	for _, r := range element {
+		if r < 0x20 || r == 0x7f {
+			return "", fmt.Errorf("%q holds control characters", element)
+		}
+	}
+
+	// Windows drops trailing dots and spaces, which would make "..." or
+	// ". ." the parent directory there
+	sanitized := strings.TrimRight(element, ". ")
+	if sanitized == "" {
+		return "", fmt.Errorf("%q is only dots and spaces", element)
+	}
+	sanitized = strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`<>:"|?*`, r) {
+			return '_'
+		}
+		return r
+	}, sanitized)
+
+	base := strings.ToUpper(strings.SplitN(sanitized, ".", 2)[0])
+	if reservedNames[strings.TrimRight(base, " ")] {
+		return "", fmt.Errorf("%q is a reserved name", element)
+	}
+
+	return sanitized, nil
+}
+
+// sanitizePath checks every element of a file path of a torrent
+func sanitizePath(path []string) ([]string, error) {
+	if len(path) == 0 {
+		return nil, fmt.Errorf("%w: empty path", ErrUnsafePath)
+	}
+
+	sanitized := make([]string, len(path))
+	for i, element := range path {
+		s, err := sanitizeElement(element)
+		if err != nil {
+			return nil, fmt.Errorf("%w %q: %v", ErrUnsafePath, strings.Join(path, "/"), err)
+		}
+		sanitized[i] = s
+	}
+	return sanitized, nil
+}
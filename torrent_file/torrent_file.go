@@ -1,14 +1,14 @@
 package torrent_file
 
 import (
-	"bufio"
 	"bytes"
 	"crypto/sha1"
 	"encoding/binary"
+	"fmt"
 	"io"
+	"math"
 	"math/rand"
 	"net"
-	"net/http"
 	"net/url"
 	"os"
 	"strconv"
@@ -16,7 +16,10 @@ import (
 	"sync"
 	"time"
 
+	"github.com/johneliades/flash/extension"
 	"github.com/johneliades/flash/peer"
+	"github.com/johneliades/flash/proxy"
+	"github.com/johneliades/flash/ratelimit"
 	"github.com/johneliades/flash/torrent"
 	"github.com/marksamman/bencode"
 )
@@ -46,35 +49,135 @@ type torrentFile struct {
 	// when torrent has a single file this is the file name
 	// when multiple files this is the directory
 	name string
+	// the name before it was made safe for the local filesystem
+	originalName string
 
 	//list of file lengths and paths, used only when multiple files
 	files []torrent.File
+
+	// HTTP mirrors from url-list, a single url or a list of them
+	webSeeds []string
+
+	// BEP 47 attributes of the single file
+	attr string
+
+	// the info dictionary as it is in the file
+	info []byte
+
+	// BitTorrent v2, BEP 52, zero for v1 only torrents
+	infoHashV2 [32]byte
+	// Merkle tree roots of the files, including the single file
+	piecesRoots [][32]byte
+	pieceLayers map[[32]byte][][32]byte
 }
 
-func btoTorrentStruct(file_bytes io.Reader) torrentFile {
-	data, ok := bencode.Decode(file_bytes)
+// maxPieceLength is the largest piece length we take, far beyond what any
+// torrent uses
+const maxPieceLength = 1 << 30
+
+func btoTorrentStruct(file_bytes io.Reader) (torrentFile, error) {
+	raw, ok := io.ReadAll(file_bytes)
+	if ok != nil {
+		return torrentFile{}, ok
+	}
+
+	info, ok := rawInfo(raw)
 	if ok != nil {
-		panic(ok)
+		return torrentFile{}, ok
 	}
 
-	announce := ""
-	if val, ok := data["announce"].(string); ok {
-		announce = val
+	data, ok := bencode.Decode(bytes.NewReader(raw))
+	if ok != nil {
+		return torrentFile{}, malformed(ok)
+	}
+
+	announce, err := getString(data, "announce", "announce", false)
+	if err != nil {
+		return torrentFile{}, err
 	}
 
+	// tiers of trackers, of which the first of each is used
 	var announceList []string
-	for _, tracker := range data["announce-list"].([]interface{}) {
-		announceList = append(announceList, tracker.([]interface{})[0].(string))
+	tiers, err := getList(data, "announce-list", "announce-list", false)
+	if err != nil {
+		return torrentFile{}, err
+	}
+	for i, element := range tiers {
+		tier, ok := element.([]interface{})
+		if !ok {
+			return torrentFile{}, &FieldError{Field: fmt.Sprintf("announce-list[%d]", i), Err: ErrWrongType}
+		}
+		if len(tier) == 0 {
+			continue
+		}
+		tracker, ok := tier[0].(string)
+		if !ok {
+			return torrentFile{}, &FieldError{Field: fmt.Sprintf("announce-list[%d][0]", i), Err: ErrWrongType}
+		}
+		announceList = append(announceList, tracker)
+	}
+	// torrents with a single tracker often have no list
+	if len(announceList) == 0 && announce != "" {
+		announceList = []string{announce}
 	}
 
-	bencodeInfo := data["info"].(map[string]interface{})
-	pieceStr := bencodeInfo["pieces"].(string)
-	pieceLength := int(bencodeInfo["piece length"].(int64))
-	name := bencodeInfo["name"].(string)
+	var webSeeds []string
+	switch val := data["url-list"].(type) {
+	case string:
+		if val != "" {
+			webSeeds = append(webSeeds, val)
+		}
+	case []interface{}:
+		for _, element := range val {
+			if seed, ok := element.(string); ok && seed != "" {
+				webSeeds = append(webSeeds, seed)
+			}
+		}
+	}
 
-	//sha1 hash of bencoded info
-	buf := bencode.Encode(bencodeInfo)
-	infoHash := sha1.Sum(buf)
+	bencodeInfo, err := getDict(data, "info", "info", true)
+	if err != nil {
+		return torrentFile{}, err
+	}
+
+	version, err := getInt(bencodeInfo, "meta version", "info.meta version", false)
+	if err != nil {
+		return torrentFile{}, err
+	}
+
+	// v2 only torrents have no v1 pieces
+	pieceStr, err := getString(bencodeInfo, "pieces", "info.pieces", version != 2)
+	if err != nil {
+		return torrentFile{}, err
+	}
+	if len(pieceStr)%20 != 0 {
+		return torrentFile{}, &FieldError{Field: "info.pieces", Err: ErrPiecesLength}
+	}
+
+	pieceLength, err := getLength(bencodeInfo, "piece length", "info.piece length", true)
+	if err != nil {
+		return torrentFile{}, err
+	}
+	if pieceLength == 0 || pieceLength > maxPieceLength {
+		return torrentFile{}, &FieldError{Field: "info.piece length",
+			Err: fmt.Errorf("%w, %d isn't from 1 to %d", ErrPieceLength, pieceLength, maxPieceLength)}
+	}
+
+	rawName, err := getString(bencodeInfo, "name", "info.name", true)
+	if err != nil {
+		return torrentFile{}, err
+	}
+	// the utf-8 variants are there for torrents whose names are in another encoding
+	if val, ok := bencodeInfo["name.utf-8"].(string); ok && val != "" {
+		rawName = val
+	}
+	name, ok := sanitizeElement(rawName)
+	if ok != nil {
+		return torrentFile{}, invalid("info.name", fmt.Errorf("%w %q: %v", ErrUnsafePath, rawName, ok))
+	}
+
+	//sha1 hash of bencoded info, as it is in the file
+	infoHash := sha1.Sum(info)
 
 	//split string of hashes in [][20]byte
 	pieces := [][20]byte{}
@@ -94,34 +197,187 @@ func btoTorrentStruct(file_bytes io.Reader) torrentFile {
 		pieceHashes:  pieces,
 		pieceLength:  pieceLength,
 		name:         name,
+		originalName: rawName,
+		webSeeds:     webSeeds,
+		info:         info,
 	}
 
 	if _, ok := bencodeInfo["files"]; ok {
 		//multiple files
 
-		for _, element := range bencodeInfo["files"].([]interface{}) {
-			file_dict := element.(map[string]interface{})
-			var temp_path []string
-			for _, path := range file_dict["path"].([]interface{}) {
-				temp_path = append(temp_path, path.(string))
+		list, err := getList(bencodeInfo, "files", "info.files", true)
+		if err != nil {
+			return torrentFile{}, err
+		}
+
+		seen := map[string]bool{}
+		for i, element := range list {
+			field := fmt.Sprintf("info.files[%d]", i)
+			file_dict, ok := element.(map[string]interface{})
+			if !ok {
+				return torrentFile{}, &FieldError{Field: field, Err: ErrWrongType}
 			}
 
-			t.files = append(t.files, torrent.File{
-				int(file_dict["length"].(int64)),
-				temp_path,
-			})
-			t.length += int(file_dict["length"].(int64))
+			temp_path, err := getStrings(file_dict, "path", field+".path", true)
+			if err != nil {
+				return torrentFile{}, err
+			}
+			if val, err := getStrings(file_dict, "path.utf-8", field+".path.utf-8", false); err != nil {
+				return torrentFile{}, err
+			} else if len(val) > 0 {
+				temp_path = val
+			}
+			original := temp_path
+			temp_path, err = sanitizePath(temp_path)
+			if err != nil {
+				return torrentFile{}, invalid(field+".path", err)
+			}
+
+			file, err := parseFile(file_dict, temp_path, field)
+			if err != nil {
+				return torrentFile{}, err
+			}
+			file.OriginalPath = original
+
+			// two files in one place would overwrite each other's pieces,
+			// padding is never written so it can share names
+			joined := strings.Join(temp_path, "/")
+			if seen[joined] && !file.Padding() {
+				return torrentFile{}, invalid(field+".path", fmt.Errorf("%w %q: listed twice", ErrUnsafePath, joined))
+			}
+			seen[joined] = true
+
+			if file.Length > math.MaxInt-t.length {
+				return torrentFile{}, &FieldError{Field: "info.files", Err: ErrTooLarge}
+			}
+			t.files = append(t.files, file)
+			t.length += file.Length
 		}
 	} else {
-		//single file
-		t.length = int(bencodeInfo["length"].(int64))
+		//single file, v2 only torrents have their lengths in the file tree
+		t.length, err = getLength(bencodeInfo, "length", "info.length", version != 2)
+		if err != nil {
+			return torrentFile{}, err
+		}
+
+		// padding and symlinks only make sense next to other files
+		attr, err := getString(bencodeInfo, "attr", "info.attr", false)
+		if err != nil {
+			return torrentFile{}, err
+		}
+		t.attr = strings.Map(func(r rune) rune {
+			if r == 'x' || r == 'h' {
+				return r
+			}
+			return -1
+		}, attr)
+	}
+
+	// the v1 pieces must cover the files exactly, hybrids included
+	if version != 2 || len(pieces) > 0 {
+		count := t.length / pieceLength
+		if t.length%pieceLength != 0 {
+			count++
+		}
+		if len(pieces) != count {
+			return torrentFile{}, &FieldError{Field: "info.pieces",
+				Err: fmt.Errorf("%w, %d pieces for %d bytes", ErrPieceCount, len(pieces), t.length)}
+		}
 	}
 
-	return t
+	if version == 2 {
+		if err := t.parseV2(data, bencodeInfo); err != nil {
+			return torrentFile{}, invalid("info", err)
+		}
+	}
+
+	// a torrent of empty files would be done before it starts
+	if t.length == 0 {
+		return torrentFile{}, &FieldError{Field: "info", Err: ErrNoData}
+	}
+
+	return t, nil
 }
 
-func (t *torrentFile) getPeers(tracker string, peers chan *peer.Peer, wg *sync.WaitGroup,
-	peerID string, port int) {
+// parseFile reads the length and BEP 47 attributes of a file of a torrent,
+// field is where its dictionary is in the torrent
+func parseFile(dict map[string]interface{}, path []string, field string) (torrent.File, error) {
+	length, err := getLength(dict, "length", field+".length", true)
+	if err != nil {
+		return torrent.File{}, err
+	}
+	attr, err := getString(dict, "attr", field+".attr", false)
+	if err != nil {
+		return torrent.File{}, err
+	}
+	file := torrent.File{
+		Length: length,
+		Path:   path,
+		Attr:   attr,
+	}
+
+	if file.Symlink() {
+		target, err := getStrings(dict, "symlink path", field+".symlink path", true)
+		if err != nil {
+			return torrent.File{}, err
+		}
+		target, err = sanitizePath(target)
+		if err != nil {
+			return torrent.File{}, invalid(field+".symlink path",
+				fmt.Errorf("symlink %q: %w", strings.Join(path, "/"), err))
+		}
+		if file.Length != 0 {
+			return torrent.File{}, &FieldError{Field: field + ".length",
+				Err: fmt.Errorf("symlink %q holds data", strings.Join(path, "/"))}
+		}
+		file.SymlinkPath = target
+	}
+
+	return file, nil
+}
+
+// parsePeers reads the peers of an HTTP tracker response, given in compact
+// form or as a list of dictionaries, along with the compact IPv6 peers6
+func parsePeers(data map[string]interface{}) ([]peer.Peer, error) {
+	peers := []peer.Peer{}
+
+	switch val := data["peers"].(type) {
+	case string:
+		compact, err := peer.Deserialize([]byte(val))
+		if err != nil {
+			return nil, err
+		}
+		peers = append(peers, compact...)
+	case []interface{}:
+		for _, element := range val {
+			dict, ok := element.(map[string]interface{})
+			if !ok {
+				continue
+			}
+
+			ipStr, _ := dict["ip"].(string)
+			port, _ := dict["port"].(int64)
+			ip := net.ParseIP(ipStr)
+			if ip == nil || port <= 0 || port > 65535 {
+				continue
+			}
+			peers = append(peers, *peer.New(ip, uint16(port)))
+		}
+	}
+
+	if val, ok := data["peers6"].(string); ok {
+		compact, err := peer.Deserialize6([]byte(val))
+		if err != nil {
+			return nil, err
+		}
+		peers = append(peers, compact...)
+	}
+
+	return peers, nil
+}
+
+func (t *torrentFile) getPeers(tracker string, infoHash [20]byte, peers chan *peer.Peer,
+	wg *sync.WaitGroup, peerID string, port int) {
 
 	var body []byte
 
@@ -139,7 +395,7 @@ func (t *torrentFile) getPeers(tracker string, peers chan *peer.Peer, wg *sync.W
 		}
 
 		params := url.Values{}
-		params.Add("info_hash", string(t.infoHash[:]))
+		params.Add("info_hash", string(infoHash[:]))
 		// peer_id must be 20 bytes
 		params.Add("peer_id", peerID)
 		params.Add("port", strconv.Itoa(port))
@@ -152,7 +408,7 @@ func (t *torrentFile) getPeers(tracker string, peers chan *peer.Peer, wg *sync.W
 
 		// communicate with tracker url
 
-		resp, ok := http.Get(base.String())
+		resp, ok := proxy.HTTPClient(10 * time.Second).Get(base.String())
 		if ok != nil {
 			if torrent.Debug {
 				println("\rTrying tracker: " + tracker + " - " + Red + ok.Error() + Reset)
@@ -181,10 +437,17 @@ func (t *torrentFile) getPeers(tracker string, peers chan *peer.Peer, wg *sync.W
 		// in seconds, for connecting to the tracker again
 		//interval := data["interval"].(int64)
 
-		val := data["peers"]
-		if val != nil {
-			// Wrong if peers are dictionary?
-			for _, peer := range peer.Deserialize([]byte(data["peers"].(string))) {
+		if data["peers"] != nil || data["peers6"] != nil {
+			list, ok := parsePeers(data)
+			if ok != nil {
+				if torrent.Debug {
+					println("\rTrying tracker: " + tracker + " - " + Red + ok.Error() + Reset)
+				}
+				return
+			}
+
+			for _, peer := range list {
+				peer = peer.InSwarm(infoHash)
 				peers <- &peer
 			}
 			if torrent.Debug {
@@ -197,13 +460,14 @@ func (t *torrentFile) getPeers(tracker string, peers chan *peer.Peer, wg *sync.W
 		// https://libtorrent.org/udp_tracker_protocol.html#authentication
 		// http://xbtt.sourceforge.net/udp_tracker_protocol.html
 
-		conn, ok := net.Dial("udp", tracker[len("udp://"):len(tracker)-len("/announce")])
+		conn, ok := proxy.DialUDP(tracker[len("udp://"):len(tracker)-len("/announce")], 3*time.Second)
 		if ok != nil {
 			if torrent.Debug {
 				println("\rTrying tracker: " + tracker + " - " + Red + ok.Error() + Reset)
 			}
 			return
 		}
+		defer conn.Close()
 
 		conn.SetDeadline(time.Now().Add(1 * time.Second))
 		defer conn.SetDeadline(time.Time{})
@@ -257,7 +521,7 @@ func (t *torrentFile) getPeers(tracker string, peers chan *peer.Peer, wg *sync.W
 		binary.BigEndian.PutUint64(buf, connection_id)
 		binary.BigEndian.PutUint32(buf[8:], uint32(1))
 		binary.BigEndian.PutUint32(buf[12:], uint32(transaction))
-		copy(buf[16:], t.infoHash[:])
+		copy(buf[16:], infoHash[:])
 		copy(buf[36:], peerID[:])
 		binary.BigEndian.PutUint64(buf[56:], 0)
 		binary.BigEndian.PutUint64(buf[64:], uint64(t.length))
@@ -282,14 +546,22 @@ func (t *torrentFile) getPeers(tracker string, peers chan *peer.Peer, wg *sync.W
 		//ok = binary.Read(conn, binary.BigEndian, &buf_res)
 		//but uses big endian
 
-		buf_res = make([]byte, 20+30*6) // 20 header and 30 clients of 6 bytes each
-		_, ok = bufio.NewReader(conn).Read(buf_res)
+		// the whole response is a single datagram
+		buf_res = make([]byte, 65536)
+		n, ok := conn.Read(buf_res)
 		if ok != nil {
 			if torrent.Debug {
 				println("\rTrying tracker: " + tracker + " - " + Red + ok.Error() + Reset)
 			}
 			return
 		}
+		if n < 20 {
+			if torrent.Debug {
+				println("\rTrying tracker: " + tracker + " - " + Red + "short response" + Reset)
+			}
+			return
+		}
+		buf_res = buf_res[:n]
 
 		action = binary.BigEndian.Uint32(buf_res[:4])
 		if action != 1 {
@@ -317,7 +589,24 @@ func (t *torrentFile) getPeers(tracker string, peers chan *peer.Peer, wg *sync.W
 
 		buf_res = buf_res[20:]
 
-		for _, peer := range peer.Deserialize(buf_res) {
+		// trackers reached over IPv6 answer with IPv6 peers, 18 bytes each.
+		// Through a proxy the remote address is where the relay says the
+		// answer came from, not the relay itself.
+		deserialize := peer.Deserialize
+		if addr, isUDP := conn.RemoteAddr().(*net.UDPAddr); isUDP && addr.IP.To4() == nil {
+			deserialize = peer.Deserialize6
+		}
+
+		list, ok := deserialize(buf_res)
+		if ok != nil {
+			if torrent.Debug {
+				println("\rTrying tracker: " + tracker + " - " + Red + ok.Error() + Reset)
+			}
+			return
+		}
+
+		for _, peer := range list {
+			peer = peer.InSwarm(infoHash)
 			peers <- &peer
 		}
 		if torrent.Debug {
@@ -360,19 +649,10 @@ func Open(path string, debug bool, data ...[]byte) (torrent.Torrent, error) {
     peers := make(chan *peer.Peer)
     wg := &sync.WaitGroup{}
 
-    t := btoTorrentStruct(reader)
-    for i := 0; i < len(t.announceList); i++ {
-        tracker = t.announceList[i]
-
-        wg.Add(1)
-        go t.getPeers(tracker, peers, wg, string(peerID[:]), 3000)
+    t, err := btoTorrentStruct(reader)
+    if err != nil {
+        return torrent.Torrent{}, err
     }
-
-    go func() {
-        wg.Wait()
-        close(peers)
-    }()
-
 	torrentMeta := torrent.TorrentMeta{
         Peers:       peers,
         PeerID:      peerID,
@@ -381,17 +661,45 @@ func Open(path string, debug bool, data ...[]byte) (torrent.Torrent, error) {
         PieceLength: t.pieceLength,
         Length:      t.length,
         Name:        t.name,
+        OriginalName: t.originalName,
         Files:       t.files,
+        WebSeeds:    t.webSeeds,
+        Attr:        t.attr,
+        Info:        t.info,
+        InfoHashV2:  t.infoHashV2,
+        PiecesRoots: t.piecesRoots,
+        PieceLayers: t.pieceLayers,
 	}
 
+    for i := 0; i < len(t.announceList); i++ {
+        tracker = t.announceList[i]
+
+        for _, infoHash := range torrentMeta.Swarms() {
+            wg.Add(1)
+            go t.getPeers(tracker, infoHash, peers, wg, string(peerID[:]), torrent.ListenPort)
+        }
+    }
+
+    go func() {
+        wg.Wait()
+        close(peers)
+    }()
+
 	torrentStatus := torrent.TorrentStatus{
 		Progress:   0.0,
 		DownSpeed:  0.0,
 		Size:       0.0,
 	}
 
+	extensions := extension.NewRegistry()
+	extensions.Port = torrent.ListenPort
+	extensions.Reqq = 250
+
 	return torrent.Torrent{
-		Meta:   torrentMeta,
-		Status: torrentStatus,
+		Meta:       torrentMeta,
+		Status:     torrentStatus,
+		Extensions: extensions,
+		DownLimit:  ratelimit.New(0),
+		UpLimit:    ratelimit.New(0),
 	}, nil
 }
\ No newline at end of file
@@ -0,0 +1,251 @@
+package torrent_file
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/marksamman/bencode"
+)
+
+func seeds(t testing.TB) map[string][]byte {
+	paths, err := filepath.Glob("testdata/*.torrent")
+	if err != nil || len(paths) == 0 {
+		t.Fatalf("no torrents in testdata: %v", err)
+	}
+
+	seeds := map[string][]byte{}
+	for _, path := range paths {
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seeds[filepath.Base(path)] = raw
+	}
+	return seeds
+}
+
+func TestSeeds(t *testing.T) {
+	for name, raw := range seeds(t) {
+		tf, err := btoTorrentStruct(bytes.NewReader(raw))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if tf.length <= 0 || tf.pieceLength <= 0 || len(tf.announceList) == 0 {
+			t.Errorf("%s: length %d, piece length %d, %d trackers", name, tf.length, tf.pieceLength,
+				len(tf.announceList))
+		}
+	}
+
+	tf, _ := btoTorrentStruct(bytes.NewReader(seeds(t)["multi.torrent"]))
+	if len(tf.files) != 3 || !tf.files[1].Executable() || len(tf.webSeeds) != 1 {
+		t.Errorf("multi.torrent: %d files, web seeds %v", len(tf.files), tf.webSeeds)
+	}
+
+	// v2 only torrents get padding between the files
+	tf, _ = btoTorrentStruct(bytes.NewReader(seeds(t)["v2.torrent"]))
+	if len(tf.pieceHashes) != 0 || len(tf.files) != 5 || !tf.files[1].Padding() || tf.length%tf.pieceLength == 0 {
+		t.Errorf("v2.torrent: %d pieces, %d files, length %d", len(tf.pieceHashes), len(tf.files), tf.length)
+	}
+	if tf.infoHash != truncate(tf.infoHashV2) {
+		t.Errorf("v2.torrent: info hash %x isn't the truncated v2 hash", tf.infoHash)
+	}
+
+	tf, _ = btoTorrentStruct(bytes.NewReader(seeds(t)["hybrid.torrent"]))
+	if len(tf.pieceHashes) == 0 || len(tf.piecesRoots) != len(tf.files) || tf.infoHash == truncate(tf.infoHashV2) {
+		t.Errorf("hybrid.torrent: %d pieces, %d roots for %d files", len(tf.pieceHashes), len(tf.piecesRoots),
+			len(tf.files))
+	}
+}
+
+// valid is a single file torrent of two pieces for the tests to break
+func valid() map[string]interface{} {
+	return map[string]interface{}{
+		"announce": "http://tracker.example.org/announce",
+		"info": map[string]interface{}{
+			"name":         "file",
+			"piece length": int64(16384),
+			"length":       int64(20000),
+			"pieces":       strings.Repeat("x", 40),
+		},
+	}
+}
+
+func multi(files ...interface{}) func(d, info map[string]interface{}) {
+	return func(d, info map[string]interface{}) {
+		delete(info, "length")
+		info["files"] = files
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		edit  func(d, info map[string]interface{})
+		field string
+		err   error
+	}{
+		{"no info", func(d, info map[string]interface{}) { delete(d, "info") }, "info", ErrMissingField},
+		{"info not a dict", func(d, info map[string]interface{}) { d["info"] = "info" }, "info", ErrWrongType},
+		{"announce not a string", func(d, info map[string]interface{}) { d["announce"] = int64(1) },
+			"announce", ErrWrongType},
+		{"tier not a list", func(d, info map[string]interface{}) { d["announce-list"] = []interface{}{"a"} },
+			"announce-list[0]", ErrWrongType},
+		{"no name", func(d, info map[string]interface{}) { delete(info, "name") }, "info.name", ErrMissingField},
+		{"no pieces", func(d, info map[string]interface{}) { delete(info, "pieces") }, "info.pieces",
+			ErrMissingField},
+		{"pieces not a multiple of 20", func(d, info map[string]interface{}) { info["pieces"] = strings.Repeat("x", 41) },
+			"info.pieces", ErrPiecesLength},
+		{"too few pieces", func(d, info map[string]interface{}) { info["length"] = int64(40000) }, "info.pieces",
+			ErrPieceCount},
+		{"too many pieces", func(d, info map[string]interface{}) { info["length"] = int64(100) }, "info.pieces",
+			ErrPieceCount},
+		{"negative length", func(d, info map[string]interface{}) { info["length"] = int64(-1) }, "info.length",
+			ErrNegativeLength},
+		{"no length", func(d, info map[string]interface{}) { delete(info, "length") }, "info.length",
+			ErrMissingField},
+		{"zero piece length", func(d, info map[string]interface{}) { info["piece length"] = int64(0) },
+			"info.piece length", ErrPieceLength},
+		{"huge piece length", func(d, info map[string]interface{}) { info["piece length"] = int64(1<<63 - 1) },
+			"info.piece length", ErrPieceLength},
+		{"no data", func(d, info map[string]interface{}) {
+			info["length"] = int64(0)
+			info["pieces"] = ""
+		}, "info", ErrNoData},
+		{"file not a dict", multi("file"), "info.files[0]", ErrWrongType},
+		{"file negative length", multi(map[string]interface{}{"path": []interface{}{"a"}, "length": int64(-5)}),
+			"info.files[0].length", ErrNegativeLength},
+		{"path element not a string", multi(map[string]interface{}{"path": []interface{}{int64(3)}, "length": int64(5)}),
+			"info.files[0].path[0]", ErrWrongType},
+		{"path escapes", multi(map[string]interface{}{"path": []interface{}{".."}, "length": int64(20000)}),
+			"info.files[0].path", ErrUnsafePath},
+		{"total overflows", multi(
+			map[string]interface{}{"path": []interface{}{"a"}, "length": int64(1<<63 - 1)},
+			map[string]interface{}{"path": []interface{}{"b"}, "length": int64(1)}),
+			"info.files", ErrTooLarge},
+		{"v2 huge piece length", func(d, info map[string]interface{}) {
+			info["meta version"] = int64(2)
+			info["piece length"] = int64(1<<62 + 1)
+		}, "info.piece length", ErrPieceLength},
+		{"v2 empty files", func(d, info map[string]interface{}) {
+			delete(info, "length")
+			delete(info, "pieces")
+			info["meta version"] = int64(2)
+			info["file tree"] = map[string]interface{}{"a": map[string]interface{}{"": map[string]interface{}{"length": int64(0)}}}
+		}, "info", ErrNoData},
+		{"v2 file without root", func(d, info map[string]interface{}) {
+			delete(info, "length")
+			delete(info, "pieces")
+			info["meta version"] = int64(2)
+			info["file tree"] = map[string]interface{}{"a": map[string]interface{}{"": map[string]interface{}{"length": int64(5)}}}
+		}, "info.file tree.a.pieces root", ErrMissingField},
+	}
+
+	for _, test := range tests {
+		d := valid()
+		test.edit(d, d["info"].(map[string]interface{}))
+
+		_, err := btoTorrentStruct(bytes.NewReader(bencode.Encode(d)))
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.err)
+			continue
+		}
+		var fieldErr *FieldError
+		if !errors.As(err, &fieldErr) || fieldErr.Field != test.field {
+			t.Errorf("%s: got %v, want an error of %s", test.name, err, test.field)
+		}
+	}
+
+	if _, err := btoTorrentStruct(bytes.NewReader(bencode.Encode(valid()))); err != nil {
+		t.Errorf("valid torrent: %v", err)
+	}
+}
+
+// names made safe for the disk keep the originals, which mirrors go by
+func TestSanitizedNames(t *testing.T) {
+	d := valid()
+	info := d["info"].(map[string]interface{})
+	info["name"] = "what?"
+	multi(
+		map[string]interface{}{"length": int64(10000), "path": []interface{}{"a:b", "c."}},
+		map[string]interface{}{"length": int64(10000), "path": []interface{}{"d"}},
+	)(d, info)
+
+	tf, err := btoTorrentStruct(bytes.NewReader(bencode.Encode(d)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tf.name != "what_" || tf.originalName != "what?" {
+		t.Errorf("name %q, originally %q", tf.name, tf.originalName)
+	}
+	file := tf.files[0]
+	if strings.Join(file.Path, "/") != "a_b/c" || strings.Join(file.OriginalPath, "/") != "a:b/c." {
+		t.Errorf("path %q, originally %q", file.Path, file.OriginalPath)
+	}
+}
+
+func TestMalformed(t *testing.T) {
+	tests := []string{
+		"",
+		"le",
+		"d4:info",
+		"d4:infod4:name1:ae",
+		"d4:infodee5:extrai+10ee",
+		"d4:infodee5:extrai03ee",
+		"d4:infodee5:extrai-0ee",
+		"d4:infodee5:extraiee",
+		"d4:infodee5:extrai99999999999999999999ee",
+		"d4:infodee5:extra5:abce",
+		"d4:infodei1ei2ee",
+		"d4:infode5:extra" + strings.Repeat("l", 1000) + strings.Repeat("e", 1000) + "e",
+	}
+
+	for _, raw := range tests {
+		_, err := btoTorrentStruct(strings.NewReader(raw))
+		if !errors.Is(err, ErrMalformed) {
+			t.Errorf("%.30q: got %v, want %v", raw, err, ErrMalformed)
+		}
+	}
+}
+
+// FuzzOpen runs the parsing Open does on the torrent files of testdata and
+// mutations of them, without contacting the trackers they name
+func FuzzOpen(f *testing.F) {
+	for _, raw := range seeds(f) {
+		f.Add(raw)
+	}
+
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		tf, err := btoTorrentStruct(bytes.NewReader(raw))
+		if err != nil {
+			var fieldErr *FieldError
+			if !errors.As(err, &fieldErr) {
+				t.Fatalf("error isn't a FieldError: %v", err)
+			}
+			return
+		}
+
+		if tf.length <= 0 || tf.pieceLength <= 0 || tf.pieceLength > maxPieceLength {
+			t.Fatalf("length %d, piece length %d", tf.length, tf.pieceLength)
+		}
+		count := (tf.length-1)/tf.pieceLength + 1
+		if len(tf.pieceHashes) > 0 && len(tf.pieceHashes) != count {
+			t.Fatalf("%d pieces for %d bytes", len(tf.pieceHashes), tf.length)
+		}
+
+		total := 0
+		for _, file := range tf.files {
+			if file.Length < 0 {
+				t.Fatalf("file %v has length %d", file.Path, file.Length)
+			}
+			total += file.Length
+		}
+		if len(tf.files) > 0 && total != tf.length {
+			t.Fatalf("files add up to %d, not %d", total, tf.length)
+		}
+	})
+}
@@ -0,0 +1,244 @@
+package torrent_file
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/johneliades/flash/merkle"
+	"github.com/johneliades/flash/torrent"
+)
+
+// v2File is a file of the file tree of a v2 torrent
+type v2File struct {
+	file torrent.File
+	root [32]byte
+}
+
+// parseV2 reads the BitTorrent v2 (BEP 52) part of a torrent, the file tree
+// and the piece layers. Hybrid torrents keep the layout of their v1 file
+// list, v2 only ones get padding so that every file starts a piece.
+func (t *torrentFile) parseV2(data, info map[string]interface{}) error {
+	t.infoHashV2 = sha256.Sum256(t.info)
+
+	if t.pieceLength < merkle.BlockSize || t.pieceLength > maxPieceLength ||
+		merkle.NextPow2(t.pieceLength) != t.pieceLength {
+		return &FieldError{Field: "info.piece length", Err: fmt.Errorf("%w, %d isn't a power of two from %d to %d",
+			ErrPieceLength, t.pieceLength, merkle.BlockSize, maxPieceLength)}
+	}
+
+	tree, ok := info["file tree"].(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("v2 torrent without a file tree")
+	}
+	files, err := walkFileTree(tree, nil)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("v2 torrent without files")
+	}
+
+	layers, _ := data["piece layers"].(map[string]interface{})
+	t.pieceLayers = map[[32]byte][][32]byte{}
+	for _, f := range files {
+		if f.file.Length <= t.pieceLength {
+			continue
+		}
+
+		raw, _ := layers[string(f.root[:])].(string)
+		layer, err := t.pieceLayer(f, raw)
+		if err != nil {
+			return err
+		}
+		t.pieceLayers[f.root] = layer
+	}
+
+	// a single file is the torrent's name, like in v1
+	single := len(files) == 1 && len(files[0].file.Path) == 1 && files[0].file.Path[0] == t.name
+
+	if len(t.pieceHashes) > 0 {
+		return t.matchV1(files, single)
+	}
+
+	t.infoHash = truncate(t.infoHashV2)
+	t.length = 0
+	if single {
+		t.length = files[0].file.Length
+		t.attr = files[0].file.Attr
+		t.piecesRoots = [][32]byte{files[0].root}
+		return nil
+	}
+
+	// pieces never span files in v2, which is the same as padding every
+	// file to the next piece
+	for i, f := range files {
+		if f.file.Length > math.MaxInt-t.length-t.pieceLength {
+			return &FieldError{Field: "info.file tree", Err: ErrTooLarge}
+		}
+		t.files = append(t.files, f.file)
+		t.piecesRoots = append(t.piecesRoots, f.root)
+		t.length += f.file.Length
+
+		if rest := f.file.Length % t.pieceLength; rest != 0 && i < len(files)-1 {
+			pad := t.pieceLength - rest
+			t.files = append(t.files, torrent.File{
+				Length: pad,
+				Path:   []string{".pad", strconv.Itoa(pad)},
+				Attr:   "p",
+			})
+			t.piecesRoots = append(t.piecesRoots, [32]byte{})
+			t.length += pad
+		}
+	}
+	return nil
+}
+
+// walkFileTree lists the files of a file tree in its order, where a file is
+// a dictionary under an empty key
+func walkFileTree(tree map[string]interface{}, path []string) ([]v2File, error) {
+	names := make([]string, 0, len(tree))
+	for name := range tree {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	files := []v2File{}
+	for _, name := range names {
+		node, ok := tree[name].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("file tree entry %q isn't a dictionary", name)
+		}
+
+		if name == "" {
+			if len(path) == 0 {
+				return nil, fmt.Errorf("file tree with a file at its root")
+			}
+			f, err := parseV2File(node, path)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, f)
+			continue
+		}
+
+		// copied so that sibling paths don't share their backing arrays
+		child := append(append([]string{}, path...), name)
+		found, err := walkFileTree(node, child)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, found...)
+	}
+	return files, nil
+}
+
+func parseV2File(dict map[string]interface{}, path []string) (v2File, error) {
+	field := "info.file tree." + strings.Join(path, ".")
+	sanitized, err := sanitizePath(path)
+	if err != nil {
+		return v2File{}, invalid(field, err)
+	}
+
+	file, err := parseFile(dict, sanitized, field)
+	if err != nil {
+		return v2File{}, err
+	}
+	file.OriginalPath = path
+
+	f := v2File{file: file}
+	if file.Length == 0 {
+		return f, nil
+	}
+
+	root, err := getString(dict, "pieces root", field+".pieces root", true)
+	if err != nil {
+		return v2File{}, err
+	}
+	if len(root) != 32 {
+		return v2File{}, &FieldError{Field: field + ".pieces root", Err: fmt.Errorf("%d bytes, not 32", len(root))}
+	}
+	copy(f.root[:], root)
+	return f, nil
+}
+
+// pieceLayer splits the piece layer of a file and checks it against the
+// file's pieces root
+func (t *torrentFile) pieceLayer(f v2File, raw string) ([][32]byte, error) {
+	pieces := f.file.Length / t.pieceLength
+	if f.file.Length%t.pieceLength != 0 {
+		pieces++
+	}
+	if len(raw) != 32*pieces {
+		return nil, fmt.Errorf("file %q has %d bytes of piece layer, not %d",
+			strings.Join(f.file.Path, "/"), len(raw), 32*pieces)
+	}
+
+	layer := make([][32]byte, pieces)
+	for i := range layer {
+		copy(layer[i][:], raw[32*i:32*i+32])
+	}
+
+	pad := merkle.PadHash(merkle.Log2(t.pieceLength / merkle.BlockSize))
+	if merkle.Root(layer, merkle.NextPow2(pieces), pad) != f.root {
+		return nil, fmt.Errorf("file %q has a piece layer that doesn't match its pieces root",
+			strings.Join(f.file.Path, "/"))
+	}
+	return layer, nil
+}
+
+// matchV1 pairs the files of a hybrid torrent with their v2 counterparts,
+// both lists must describe the same files with every one starting a piece
+func (t *torrentFile) matchV1(files []v2File, single bool) error {
+	if len(t.files) == 0 {
+		if !single || files[0].file.Length != t.length {
+			return fmt.Errorf("v1 and v2 files of the hybrid torrent differ")
+		}
+		t.piecesRoots = [][32]byte{files[0].root}
+		return nil
+	}
+
+	byPath := map[string]v2File{}
+	for _, f := range files {
+		byPath[strings.Join(f.file.Path, "/")] = f
+	}
+
+	matched := 0
+	offset := 0
+	t.piecesRoots = make([][32]byte, len(t.files))
+	for i, file := range t.files {
+		if file.Padding() {
+			offset += file.Length
+			continue
+		}
+
+		f, ok := byPath[strings.Join(file.Path, "/")]
+		if !ok || f.file.Length != file.Length {
+			return fmt.Errorf("v1 and v2 files of the hybrid torrent differ at %q",
+				strings.Join(file.Path, "/"))
+		}
+		if file.Length > 0 && offset%t.pieceLength != 0 {
+			return fmt.Errorf("file %q of the hybrid torrent doesn't start a piece",
+				strings.Join(file.Path, "/"))
+		}
+
+		t.piecesRoots[i] = f.root
+		matched++
+		offset += file.Length
+	}
+
+	if matched != len(files) {
+		return fmt.Errorf("v1 and v2 files of the hybrid torrent differ")
+	}
+	return nil
+}
+
+// truncate is the v2 info hash as it goes in handshakes and to trackers
+func truncate(infoHash [32]byte) [20]byte {
+	var short [20]byte
+	copy(short[:], infoHash[:20])
+	return short
+}
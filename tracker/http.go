@@ -0,0 +1,147 @@
+package tracker
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/johneliades/flash/peer"
+	"github.com/marksamman/bencode"
+)
+
+// Mount adds the HTTP tracker's /announce and /scrape routes
+func (t *Tracker) Mount(r gin.IRoutes) {
+	r.GET("/announce", t.handleAnnounce)
+	r.GET("/scrape", t.handleScrape)
+}
+
+func writeBencode(c *gin.Context, dict map[string]interface{}) {
+	c.Data(http.StatusOK, "text/plain", bencode.Encode(dict))
+}
+
+// failure is how trackers report errors, with a 200 so clients read the reason
+func failure(c *gin.Context, reason string) {
+	writeBencode(c, map[string]interface{}{"failure reason": reason})
+}
+
+func (t *Tracker) handleAnnounce(c *gin.Context) {
+	query := c.Request.URL.Query()
+
+	infoHash := query.Get("info_hash")
+	peerID := query.Get("peer_id")
+	if len(infoHash) != 20 || len(peerID) != 20 {
+		failure(c, "info_hash and peer_id must be 20 bytes")
+		return
+	}
+
+	port, err := strconv.Atoi(query.Get("port"))
+	if err != nil || port <= 0 || port > 65535 {
+		failure(c, "invalid port")
+		return
+	}
+
+	ip := net.ParseIP(c.ClientIP())
+	if ip == nil {
+		failure(c, "can't tell the peer's address")
+		return
+	}
+
+	a := &announce{
+		peer:    *peer.New(ip, uint16(port)),
+		left:    -1,
+		numWant: -1,
+	}
+	copy(a.infoHash[:], infoHash)
+	copy(a.peerID[:], peerID)
+
+	if left, err := strconv.ParseInt(query.Get("left"), 10, 64); err == nil {
+		a.left = left
+	}
+	if numWant, err := strconv.Atoi(query.Get("numwant")); err == nil {
+		a.numWant = numWant
+	}
+	switch query.Get("event") {
+	case "started":
+		a.event = eventStarted
+	case "completed":
+		a.event = eventCompleted
+	case "stopped":
+		a.event = eventStopped
+	}
+
+	peers, seeders, leechers, err := t.announce(a)
+	if err != nil {
+		failure(c, err.Error())
+		return
+	}
+
+	dict := map[string]interface{}{
+		"interval":     int64(Interval.Seconds()),
+		"min interval": int64(MinInterval.Seconds()),
+		"complete":     int64(seeders),
+		"incomplete":   int64(leechers),
+	}
+
+	if query.Get("compact") == "1" {
+		var peers4, peers6 []byte
+		for _, p := range peers {
+			if p.peer.IsIPv4() {
+				peers4 = append(peers4, p.peer.Serialize()...)
+			} else {
+				peers6 = append(peers6, p.peer.Serialize()...)
+			}
+		}
+		dict["peers"] = string(peers4)
+		if len(peers6) > 0 {
+			dict["peers6"] = string(peers6)
+		}
+	} else {
+		list := []interface{}{}
+		for _, p := range peers {
+			entry := map[string]interface{}{
+				"ip":   p.peer.String(true),
+				"port": int64(p.peer.Port()),
+			}
+			if query.Get("no_peer_id") != "1" {
+				entry["peer id"] = string(p.id[:])
+			}
+			list = append(list, entry)
+		}
+		dict["peers"] = list
+	}
+
+	writeBencode(c, dict)
+}
+
+func (t *Tracker) handleScrape(c *gin.Context) {
+	var infoHashes [][20]byte
+	for _, infoHash := range c.Request.URL.Query()["info_hash"] {
+		if len(infoHash) != 20 {
+			failure(c, "info_hash must be 20 bytes")
+			return
+		}
+
+		var hash [20]byte
+		copy(hash[:], infoHash)
+		infoHashes = append(infoHashes, hash)
+	}
+
+	stats, err := t.scrape(infoHashes)
+	if err != nil {
+		failure(c, err.Error())
+		return
+	}
+
+	files := map[string]interface{}{}
+	for _, s := range stats {
+		infoHash, _ := ParseInfoHash(s.InfoHash)
+		files[string(infoHash[:])] = map[string]interface{}{
+			"complete":   int64(s.Seeders),
+			"downloaded": int64(s.Completed),
+			"incomplete": int64(s.Leechers),
+		}
+	}
+
+	writeBencode(c, map[string]interface{}{"files": files})
+}
@@ -0,0 +1,323 @@
+package tracker
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	mathrand "math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/johneliades/flash/peer"
+	"github.com/johneliades/flash/proxy"
+)
+
+const (
+	// how often peers should announce, and the least they may
+	Interval    = 30 * time.Minute
+	MinInterval = 5 * time.Minute
+	// peers that go quiet for this long are dropped from the swarm
+	peerTimeout = 2 * Interval
+
+	defaultNumWant = 50
+	maxNumWant     = 200
+)
+
+// UDPPort is where the UDP tracker listens while the tracker is enabled
+var UDPPort = 6969
+
+// errProxied is returned while a proxy is in use, answering peers would
+// tell them the address the proxy hides
+var errProxied = fmt.Errorf("tracker is off while a proxy is in use")
+
+type event int
+
+const (
+	eventNone event = iota
+	eventCompleted
+	eventStarted
+	eventStopped
+)
+
+// announce is a request from a peer, over HTTP or UDP
+type announce struct {
+	infoHash [20]byte
+	peerID   [20]byte
+	peer     peer.Peer
+	left     int64
+	event    event
+	numWant  int
+}
+
+type swarmPeer struct {
+	id       [20]byte
+	peer     peer.Peer
+	seeding  bool
+	lastSeen time.Time
+}
+
+type swarm struct {
+	peers map[[20]byte]*swarmPeer
+	// completed downloads we heard about
+	completed int
+}
+
+func (s *swarm) counts() (seeders, leechers int) {
+	for _, p := range s.peers {
+		if p.seeding {
+			seeders++
+		} else {
+			leechers++
+		}
+	}
+	return seeders, leechers
+}
+
+// prune drops the peers that stopped announcing
+func (s *swarm) prune() {
+	for id, p := range s.peers {
+		if time.Since(p.lastSeen) > peerTimeout {
+			delete(s.peers, id)
+		}
+	}
+}
+
+// Stats describes the swarm of a torrent, as shown in the API
+type Stats struct {
+	InfoHash  string `json:"infoHash"`
+	Seeders   int    `json:"seeders"`
+	Leechers  int    `json:"leechers"`
+	Completed int    `json:"completed"`
+}
+
+// Tracker keeps the swarms of the torrents peers announce to us. It speaks
+// HTTP through the routes Mount adds and UDP on UDPPort, both only while it
+// is enabled.
+type Tracker struct {
+	mu      sync.Mutex
+	enabled bool
+	swarms  map[[20]byte]*swarm
+	// torrents we track, every torrent when empty
+	whitelist map[[20]byte]bool
+	udp       net.PacketConn
+	// signs UDP connection ids
+	secret []byte
+}
+
+// Default is the tracker mounted on the API
+var Default = New()
+
+func New() *Tracker {
+	secret := make([]byte, 16)
+	rand.Read(secret)
+
+	return &Tracker{
+		swarms:    map[[20]byte]*swarm{},
+		whitelist: map[[20]byte]bool{},
+		secret:    secret,
+	}
+}
+
+func (t *Tracker) Enabled() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.enabled
+}
+
+// unavailable tells why the tracker can't answer, nil when it can. t.mu
+// must be held.
+func (t *Tracker) unavailable() error {
+	if !t.enabled {
+		return fmt.Errorf("tracker is disabled")
+	}
+	if proxy.Enabled() {
+		return errProxied
+	}
+	return nil
+}
+
+// SetEnabled turns the tracker on or off, opening or closing the UDP tracker
+func (t *Tracker) SetEnabled(enabled bool) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if enabled == t.enabled {
+		return nil
+	}
+
+	if enabled {
+		conn, err := net.ListenPacket("udp", ":"+strconv.Itoa(UDPPort))
+		if err != nil {
+			return err
+		}
+		t.udp = conn
+		go t.serveUDP(conn)
+	} else {
+		t.udp.Close()
+		t.udp = nil
+	}
+
+	t.enabled = enabled
+	return nil
+}
+
+// SetWhitelist limits the tracker to the given torrents, none allows all
+func (t *Tracker) SetWhitelist(infoHashes [][20]byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.whitelist = map[[20]byte]bool{}
+	for _, infoHash := range infoHashes {
+		t.whitelist[infoHash] = true
+	}
+}
+
+func (t *Tracker) Whitelist() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	hashes := []string{}
+	for infoHash := range t.whitelist {
+		hashes = append(hashes, hex.EncodeToString(infoHash[:]))
+	}
+	sort.Strings(hashes)
+	return hashes
+}
+
+func (t *Tracker) allowed(infoHash [20]byte) bool {
+	return len(t.whitelist) == 0 || t.whitelist[infoHash]
+}
+
+// announce records a peer and returns other peers of its swarm along with
+// the swarm's size
+func (t *Tracker) announce(a *announce) ([]*swarmPeer, int, int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err := t.unavailable(); err != nil {
+		return nil, 0, 0, err
+	}
+	if !t.allowed(a.infoHash) {
+		return nil, 0, 0, fmt.Errorf("torrent not tracked here")
+	}
+
+	s, ok := t.swarms[a.infoHash]
+	if !ok {
+		s = &swarm{peers: map[[20]byte]*swarmPeer{}}
+		t.swarms[a.infoHash] = s
+	}
+	s.prune()
+
+	if a.event == eventStopped {
+		delete(s.peers, a.peerID)
+		seeders, leechers := s.counts()
+		return nil, seeders, leechers, nil
+	}
+
+	if a.event == eventCompleted {
+		s.completed++
+	}
+
+	s.peers[a.peerID] = &swarmPeer{
+		id:       a.peerID,
+		peer:     a.peer,
+		seeding:  a.left == 0,
+		lastSeen: time.Now(),
+	}
+
+	numWant := a.numWant
+	if numWant < 0 {
+		numWant = defaultNumWant
+	}
+	if numWant > maxNumWant {
+		numWant = maxNumWant
+	}
+
+	// seeders have no use for other seeders
+	seeding := a.left == 0
+	peers := []*swarmPeer{}
+	for id, p := range s.peers {
+		if id == a.peerID || (seeding && p.seeding) {
+			continue
+		}
+		peers = append(peers, p)
+	}
+	mathrand.Shuffle(len(peers), func(i, j int) {
+		peers[i], peers[j] = peers[j], peers[i]
+	})
+	if len(peers) > numWant {
+		peers = peers[:numWant]
+	}
+
+	seeders, leechers := s.counts()
+	return peers, seeders, leechers, nil
+}
+
+// scrape returns the stats of the given torrents, every allowed one when
+// none are given
+func (t *Tracker) scrape(infoHashes [][20]byte) ([]Stats, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err := t.unavailable(); err != nil {
+		return nil, err
+	}
+
+	if len(infoHashes) == 0 {
+		for infoHash := range t.swarms {
+			if t.allowed(infoHash) {
+				infoHashes = append(infoHashes, infoHash)
+			}
+		}
+	}
+
+	stats := []Stats{}
+	for _, infoHash := range infoHashes {
+		stats = append(stats, t.stats(infoHash))
+	}
+	return stats, nil
+}
+
+func (t *Tracker) stats(infoHash [20]byte) Stats {
+	stats := Stats{InfoHash: hex.EncodeToString(infoHash[:])}
+
+	s, ok := t.swarms[infoHash]
+	if !ok || !t.allowed(infoHash) {
+		return stats
+	}
+
+	s.prune()
+	stats.Seeders, stats.Leechers = s.counts()
+	stats.Completed = s.completed
+	return stats
+}
+
+// Stats lists the swarms the tracker knows about
+func (t *Tracker) Stats() []Stats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	stats := []Stats{}
+	for infoHash := range t.swarms {
+		stats = append(stats, t.stats(infoHash))
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].InfoHash < stats[j].InfoHash
+	})
+	return stats
+}
+
+// ParseInfoHash reads an info hash written in hex
+func ParseInfoHash(s string) ([20]byte, error) {
+	var infoHash [20]byte
+
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != 20 {
+		return infoHash, fmt.Errorf("invalid info hash %q", s)
+	}
+	copy(infoHash[:], b)
+	return infoHash, nil
+}
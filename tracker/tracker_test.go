@@ -0,0 +1,68 @@
+package tracker
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/johneliades/flash/peer"
+	"github.com/johneliades/flash/proxy"
+)
+
+// udpConnect sends a BEP 15 connect request to the tracker and tells if it
+// answered
+func udpConnect(t *testing.T, tr *Tracker) bool {
+	t.Helper()
+	conn, err := net.Dial("udp", tr.udp.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	req := binary.BigEndian.AppendUint64(nil, protocolID)
+	req = binary.BigEndian.AppendUint32(req, actionConnect)
+	req = binary.BigEndian.AppendUint32(req, 1)
+	conn.Write(req)
+
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	_, err = conn.Read(make([]byte, 16))
+	return err == nil
+}
+
+func TestProxied(t *testing.T) {
+	defer func(port int) { UDPPort = port }(UDPPort)
+	UDPPort = 0
+
+	tr := New()
+	if err := tr.SetEnabled(true); err != nil {
+		t.Fatal(err)
+	}
+	defer tr.SetEnabled(false)
+
+	a := &announce{peer: *peer.New(net.IPv4(10, 0, 0, 1), 6881), numWant: -1}
+	if _, _, _, err := tr.announce(a); err != nil {
+		t.Fatal(err)
+	}
+	if !udpConnect(t, tr) {
+		t.Fatal("the UDP tracker didn't answer")
+	}
+
+	// answering would tell peers the address the proxy hides
+	proxy.Set(&proxy.Config{Addr: "127.0.0.1:1080"})
+	defer proxy.Set(nil)
+	if _, _, _, err := tr.announce(a); err != errProxied {
+		t.Errorf("announce behind a proxy: got %v, want %v", err, errProxied)
+	}
+	if _, err := tr.scrape(nil); err != errProxied {
+		t.Errorf("scrape behind a proxy: got %v, want %v", err, errProxied)
+	}
+	if udpConnect(t, tr) {
+		t.Error("the UDP tracker answered behind a proxy")
+	}
+
+	proxy.Set(nil)
+	if _, err := tr.scrape(nil); err != nil {
+		t.Errorf("scrape once the proxy is off: %v", err)
+	}
+}
@@ -0,0 +1,166 @@
+package tracker
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"net"
+	"time"
+
+	"github.com/johneliades/flash/peer"
+	"github.com/johneliades/flash/proxy"
+)
+
+// BEP 15 actions
+const (
+	actionConnect  = 0
+	actionAnnounce = 1
+	actionScrape   = 2
+	actionError    = 3
+)
+
+const (
+	protocolID = 0x41727101980
+	// a scrape fits this many info hashes
+	maxScrape = 74
+)
+
+func (t *Tracker) serveUDP(conn net.PacketConn) {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		// not even errors go out while a proxy hides our address
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok || n < 16 || proxy.Enabled() {
+			continue
+		}
+
+		if resp := t.handleUDP(buf[:n], udpAddr); resp != nil {
+			conn.WriteTo(resp, addr)
+		}
+	}
+}
+
+// connectionID signs the client address and the current minute, so ids
+// need no bookkeeping and go stale on their own
+func (t *Tracker) connectionID(addr *net.UDPAddr, minute int64) uint64 {
+	mac := hmac.New(sha1.New, t.secret)
+	mac.Write([]byte(addr.String()))
+	binary.Write(mac, binary.BigEndian, minute)
+	return binary.BigEndian.Uint64(mac.Sum(nil))
+}
+
+// validConnection accepts ids from this minute and the last one, BEP 15
+// wants them to live for at least a minute
+func (t *Tracker) validConnection(id uint64, addr *net.UDPAddr) bool {
+	minute := time.Now().Unix() / 60
+	return id == t.connectionID(addr, minute) || id == t.connectionID(addr, minute-1)
+}
+
+func udpError(transaction uint32, message string) []byte {
+	buf := binary.BigEndian.AppendUint32(nil, actionError)
+	buf = binary.BigEndian.AppendUint32(buf, transaction)
+	return append(buf, message...)
+}
+
+func (t *Tracker) handleUDP(req []byte, addr *net.UDPAddr) []byte {
+	connection := binary.BigEndian.Uint64(req[:8])
+	action := binary.BigEndian.Uint32(req[8:12])
+	transaction := binary.BigEndian.Uint32(req[12:16])
+
+	if action == actionConnect {
+		if connection != protocolID {
+			return nil
+		}
+
+		buf := binary.BigEndian.AppendUint32(nil, actionConnect)
+		buf = binary.BigEndian.AppendUint32(buf, transaction)
+		return binary.BigEndian.AppendUint64(buf, t.connectionID(addr, time.Now().Unix()/60))
+	}
+
+	if !t.validConnection(connection, addr) {
+		return udpError(transaction, "invalid connection id")
+	}
+
+	switch action {
+	case actionAnnounce:
+		return t.handleUDPAnnounce(req, addr, transaction)
+	case actionScrape:
+		return t.handleUDPScrape(req, transaction)
+	}
+
+	return udpError(transaction, "unknown action")
+}
+
+func (t *Tracker) handleUDPAnnounce(req []byte, addr *net.UDPAddr, transaction uint32) []byte {
+	if len(req) < 98 {
+		return udpError(transaction, "announce too short")
+	}
+
+	// the ip field is ignored, peers are announced at the address they send from
+	port := binary.BigEndian.Uint16(req[96:98])
+	a := &announce{
+		peer:    *peer.New(addr.IP, port),
+		left:    int64(binary.BigEndian.Uint64(req[64:72])),
+		event:   event(binary.BigEndian.Uint32(req[80:84])),
+		numWant: int(int32(binary.BigEndian.Uint32(req[92:96]))),
+	}
+	copy(a.infoHash[:], req[16:36])
+	copy(a.peerID[:], req[36:56])
+
+	if port == 0 {
+		return udpError(transaction, "invalid port")
+	}
+
+	peers, seeders, leechers, err := t.announce(a)
+	if err != nil {
+		return udpError(transaction, err.Error())
+	}
+
+	buf := binary.BigEndian.AppendUint32(nil, actionAnnounce)
+	buf = binary.BigEndian.AppendUint32(buf, transaction)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(Interval.Seconds()))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(leechers))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(seeders))
+
+	// peers of the same family as the connection, 6 or 18 bytes each
+	ipv4 := addr.IP.To4() != nil
+	for _, p := range peers {
+		if p.peer.IsIPv4() == ipv4 {
+			buf = append(buf, p.peer.Serialize()...)
+		}
+	}
+
+	return buf
+}
+
+func (t *Tracker) handleUDPScrape(req []byte, transaction uint32) []byte {
+	var infoHashes [][20]byte
+	for offset := 16; offset+20 <= len(req) && len(infoHashes) < maxScrape; offset += 20 {
+		var infoHash [20]byte
+		copy(infoHash[:], req[offset:offset+20])
+		infoHashes = append(infoHashes, infoHash)
+	}
+	if len(infoHashes) == 0 {
+		return udpError(transaction, "no info hash to scrape")
+	}
+
+	stats, err := t.scrape(infoHashes)
+	if err != nil {
+		return udpError(transaction, err.Error())
+	}
+
+	buf := binary.BigEndian.AppendUint32(nil, actionScrape)
+	buf = binary.BigEndian.AppendUint32(buf, transaction)
+	for _, s := range stats {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(s.Seeders))
+		buf = binary.BigEndian.AppendUint32(buf, uint32(s.Completed))
+		buf = binary.BigEndian.AppendUint32(buf, uint32(s.Leechers))
+	}
+
+	return buf
+}
@@ -0,0 +1,658 @@
+package utp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// payload bytes per packet, small enough to avoid IP fragmentation
+	packetSize = 1200
+	// congestion window bounds and starting point, in bytes
+	minWindow     = packetSize
+	initialWindow = 4 * packetSize
+	// LEDBAT keeps the queuing delay we add at around this many microseconds
+	targetDelay = 100000
+	// the most the window grows in a round trip
+	maxWindowIncrease = 3000
+	// receive buffer we advertise
+	recvWindow = 1 << 20
+	// how far ahead of the next expected packet we keep out of order ones
+	maxReorder = 1024
+
+	initialTimeout = time.Second
+	minTimeout     = 500 * time.Millisecond
+	maxTimeout     = 30 * time.Second
+	maxRetransmits = 6
+	keepAlive      = 29 * time.Second
+	// how long a SYN we answered waits for the peer's first packet
+	synTimeout = 10 * time.Second
+	// how long a closed connection waits for its FIN to be acked
+	lingerTimeout = 10 * time.Second
+	tickInterval  = 50 * time.Millisecond
+)
+
+var (
+	ErrReset   = errors.New("utp: connection reset by peer")
+	ErrTimeout = errors.New("utp: connection timed out")
+)
+
+type connState int
+
+const (
+	// we sent a SYN and wait for the peer's STATE
+	stateSynSent connState = iota
+	// we answered a SYN and wait for the peer's first packet
+	stateSynRecv
+	stateConnected
+	// we sent our FIN and wait for it to be acked
+	stateFinSent
+	stateClosed
+)
+
+type outPacket struct {
+	typ     uint8
+	seqNr   uint16
+	payload []byte
+	sentAt  time.Time
+	// times sent, only packets sent once give rtt samples
+	transmissions int
+	// already resent because later packets were acked
+	fastResent bool
+}
+
+type inPacket struct {
+	payload []byte
+	fin     bool
+}
+
+// Conn is a uTP connection. It is a net.Conn, so everything built for TCP
+// peers works on it unchanged.
+type Conn struct {
+	socket *Socket
+	remote *net.UDPAddr
+	// ids we receive and send packets with
+	recvID uint16
+	sendID uint16
+
+	mu    sync.Mutex
+	cond  *sync.Cond
+	state connState
+	err   error
+	// Close was called
+	closing  bool
+	closedAt time.Time
+	opened   time.Time
+	done     chan struct{}
+
+	// sequence number of our next packet and the last one we got in order
+	seqNr uint16
+	ackNr uint16
+
+	// unacked packets in sequence order and their payload bytes
+	outbuf   []*outPacket
+	inflight int
+	// congestion window and the window the peer advertises
+	maxWindow  float64
+	peerWindow uint32
+	lastDecay  time.Time
+	dupAcks    int
+	lastAckNr  uint16
+
+	rtt    time.Duration
+	rttVar time.Duration
+	rto    time.Duration
+
+	// the peer's clock minus ours when its last packet arrived, echoed back
+	// so the peer can measure its delay
+	replyMicro uint32
+	// one way delays the peer measured for our packets, the base delay is
+	// the lowest over the last two minutes
+	currentDelay uint32
+	baseDelays   [2]uint32
+	delayMinute  int64
+
+	readBuf     bytes.Buffer
+	ooo         map[uint16]inPacket
+	finReceived bool
+	lastSent    time.Time
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func newConn(socket *Socket, remote *net.UDPAddr, recvID, sendID uint16, state connState) *Conn {
+	c := &Conn{
+		socket:     socket,
+		remote:     remote,
+		recvID:     recvID,
+		sendID:     sendID,
+		state:      state,
+		opened:     time.Now(),
+		done:       make(chan struct{}),
+		maxWindow:  initialWindow,
+		peerWindow: recvWindow,
+		rto:        initialTimeout,
+		baseDelays: [2]uint32{math.MaxUint32, math.MaxUint32},
+		ooo:        map[uint16]inPacket{},
+	}
+	c.cond = sync.NewCond(&c.mu)
+
+	go c.run()
+	return c
+}
+
+func (c *Conn) header(typ uint8, seqNr uint16) *header {
+	connID := c.sendID
+	if typ == stSyn {
+		connID = c.recvID
+	}
+
+	window := recvWindow - c.readBuf.Len()
+	if window < 0 {
+		window = 0
+	}
+
+	return &header{
+		typ:           typ,
+		connID:        connID,
+		timestamp:     now(),
+		timestampDiff: c.replyMicro,
+		wndSize:       uint32(window),
+		seqNr:         seqNr,
+		ackNr:         c.ackNr,
+	}
+}
+
+// queue sends a packet that takes a sequence number and keeps it until acked
+func (c *Conn) queue(typ uint8, payload []byte) {
+	p := &outPacket{typ: typ, seqNr: c.seqNr, payload: payload}
+	c.seqNr++
+
+	c.outbuf = append(c.outbuf, p)
+	c.inflight += len(payload)
+	c.transmit(p)
+}
+
+func (c *Conn) transmit(p *outPacket) {
+	p.sentAt = time.Now()
+	p.transmissions++
+	c.lastSent = p.sentAt
+
+	c.socket.writeTo(c.header(p.typ, p.seqNr).marshal(p.payload), c.remote)
+}
+
+// sendAck sends a STATE packet acking what arrived, with a selective ack
+// when packets are missing
+func (c *Conn) sendAck() {
+	h := c.header(stState, c.seqNr)
+	h.sack = c.sackMask()
+	c.lastSent = time.Now()
+
+	c.socket.writeTo(h.marshal(nil), c.remote)
+}
+
+func (c *Conn) sackMask() []byte {
+	if len(c.ooo) == 0 {
+		return nil
+	}
+
+	last := 0
+	for seqNr := range c.ooo {
+		if offset := int(seqNr - c.ackNr - 2); offset > last {
+			last = offset
+		}
+	}
+
+	// a multiple of 4 bytes, at most what fits the length byte
+	size := (last/32 + 1) * 4
+	if size > 128 {
+		size = 128
+	}
+
+	mask := make([]byte, size)
+	for seqNr := range c.ooo {
+		offset := int(seqNr - c.ackNr - 2)
+		if offset >= 0 && offset < size*8 {
+			mask[offset/8] |= 1 << (offset % 8)
+		}
+	}
+	return mask
+}
+
+// handle processes a packet the socket routed to this connection
+func (c *Conn) handle(h header, payload []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.state == stateClosed {
+		return
+	}
+
+	c.replyMicro = now() - h.timestamp
+	c.peerWindow = h.wndSize
+
+	if h.typ == stReset {
+		c.fail(ErrReset)
+		return
+	}
+
+	switch c.state {
+	case stateSynSent:
+		if h.typ != stState {
+			return
+		}
+		// the peer's first data packet takes the sequence number of this STATE
+		c.state = stateConnected
+		c.ackNr = h.seqNr - 1
+	case stateSynRecv:
+		if h.typ == stSyn {
+			// our STATE got lost, the peer sent its SYN again
+			c.sendAck()
+			return
+		}
+		c.state = stateConnected
+	}
+
+	if h.typ == stSyn {
+		return
+	}
+
+	if h.timestampDiff != 0 {
+		c.addDelaySample(h.timestampDiff)
+	}
+	c.processAck(h)
+
+	if h.typ == stData || h.typ == stFin {
+		c.receive(h, payload)
+	}
+
+	c.cond.Broadcast()
+}
+
+// processAck drops the packets the peer acked, cumulatively and through the
+// selective ack, resends the ones it skipped and adjusts the window
+func (c *Conn) processAck(h header) {
+	acked := 0
+	progressed := false
+
+	for len(c.outbuf) > 0 && !seqLess(h.ackNr, c.outbuf[0].seqNr) {
+		acked += c.acked(c.outbuf[0])
+		c.outbuf = c.outbuf[1:]
+		progressed = true
+	}
+
+	lost := false
+	if h.sack != nil {
+		remaining := c.outbuf[:0]
+		var sacked []uint16
+		for _, p := range c.outbuf {
+			offset := int(p.seqNr - h.ackNr - 2)
+			if offset >= 0 && offset < len(h.sack)*8 && h.sack[offset/8]&(1<<(offset%8)) != 0 {
+				acked += c.acked(p)
+				sacked = append(sacked, p.seqNr)
+				progressed = true
+				continue
+			}
+			remaining = append(remaining, p)
+		}
+		c.outbuf = remaining
+
+		// a packet is lost once three packets sent after it made it
+		for _, p := range c.outbuf {
+			after := 0
+			for _, seqNr := range sacked {
+				if seqLess(p.seqNr, seqNr) {
+					after++
+				}
+			}
+			if after >= 3 && !p.fastResent {
+				p.fastResent = true
+				c.transmit(p)
+				lost = true
+			}
+		}
+	}
+
+	if progressed {
+		c.dupAcks = 0
+	} else if h.typ == stState && h.ackNr == c.lastAckNr && len(c.outbuf) > 0 {
+		c.dupAcks++
+		if c.dupAcks == 3 && !c.outbuf[0].fastResent {
+			c.outbuf[0].fastResent = true
+			c.transmit(c.outbuf[0])
+			lost = true
+		}
+	}
+	c.lastAckNr = h.ackNr
+
+	if lost {
+		c.decay()
+	}
+	c.grow(acked)
+}
+
+// acked accounts for an acked packet and returns its payload size
+func (c *Conn) acked(p *outPacket) int {
+	c.inflight -= len(p.payload)
+
+	if p.transmissions == 1 {
+		sample := time.Since(p.sentAt)
+		if c.rtt == 0 {
+			c.rtt = sample
+			c.rttVar = sample / 2
+		} else {
+			diff := c.rtt - sample
+			if diff < 0 {
+				diff = -diff
+			}
+			c.rttVar += (diff - c.rttVar) / 4
+			c.rtt += (sample - c.rtt) / 8
+		}
+	}
+
+	if c.rtt != 0 {
+		c.rto = c.rtt + 4*c.rttVar
+		if c.rto < minTimeout {
+			c.rto = minTimeout
+		}
+	}
+
+	return len(p.payload)
+}
+
+func (c *Conn) addDelaySample(sample uint32) {
+	minute := time.Now().Unix() / 60
+	if minute != c.delayMinute {
+		c.delayMinute = minute
+		c.baseDelays[0], c.baseDelays[1] = c.baseDelays[1], sample
+	} else if sample < c.baseDelays[1] {
+		c.baseDelays[1] = sample
+	}
+
+	c.currentDelay = sample
+}
+
+// grow is the LEDBAT window update: the window opens while the queuing
+// delay we cause stays under the target and closes when it goes over
+func (c *Conn) grow(acked int) {
+	if acked == 0 {
+		return
+	}
+
+	offTarget := 1.0
+	if c.currentDelay != 0 {
+		base := c.baseDelays[0]
+		if c.baseDelays[1] < base {
+			base = c.baseDelays[1]
+		}
+
+		var ourDelay float64
+		if c.currentDelay > base {
+			ourDelay = float64(c.currentDelay - base)
+		}
+		offTarget = (targetDelay - ourDelay) / targetDelay
+	}
+
+	windowFactor := float64(acked) / math.Max(c.maxWindow, float64(acked))
+	c.maxWindow += maxWindowIncrease * offTarget * windowFactor
+	if c.maxWindow < minWindow {
+		c.maxWindow = minWindow
+	}
+}
+
+// decay halves the window on loss, at most once a round trip
+func (c *Conn) decay() {
+	if time.Since(c.lastDecay) < c.rtt {
+		return
+	}
+	c.lastDecay = time.Now()
+
+	c.maxWindow /= 2
+	if c.maxWindow < minWindow {
+		c.maxWindow = minWindow
+	}
+}
+
+// receive buffers a DATA or FIN packet and hands out what is now in order
+func (c *Conn) receive(h header, payload []byte) {
+	// already delivered, the ack must have been lost
+	if !seqLess(c.ackNr, h.seqNr) {
+		c.sendAck()
+		return
+	}
+	if h.seqNr-c.ackNr > maxReorder || c.finReceived || c.readBuf.Len() >= recvWindow {
+		return
+	}
+
+	c.ooo[h.seqNr] = inPacket{payload: payload, fin: h.typ == stFin}
+
+	for {
+		p, ok := c.ooo[c.ackNr+1]
+		if !ok {
+			break
+		}
+		delete(c.ooo, c.ackNr+1)
+		c.ackNr++
+
+		if p.fin {
+			c.finReceived = true
+			c.ooo = map[uint16]inPacket{}
+			break
+		}
+		c.readBuf.Write(p.payload)
+	}
+
+	c.sendAck()
+}
+
+func (c *Conn) run() {
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.tick()
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// tick resends timed out packets, gives up on peers that never followed
+// their SYN up, finishes closing and wakes up readers and writers so they
+// notice expired deadlines
+func (c *Conn) tick() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer c.cond.Broadcast()
+
+	if c.state == stateClosed {
+		return
+	}
+
+	timedOut := false
+	for _, p := range c.outbuf {
+		if time.Since(p.sentAt) <= c.rto {
+			continue
+		}
+		if p.transmissions > maxRetransmits {
+			c.fail(ErrTimeout)
+			return
+		}
+
+		c.transmit(p)
+		timedOut = true
+	}
+
+	if timedOut {
+		c.decay()
+		c.rto *= 2
+		if c.rto > maxTimeout {
+			c.rto = maxTimeout
+		}
+	}
+
+	switch {
+	case c.state == stateSynRecv && time.Since(c.opened) > synTimeout:
+		// the SYN was all we ever heard of the peer
+		c.fail(ErrTimeout)
+	case c.state == stateFinSent && len(c.outbuf) == 0:
+		c.teardown()
+	case c.closing && time.Since(c.closedAt) > lingerTimeout:
+		c.teardown()
+	case c.state == stateConnected && time.Since(c.lastSent) > keepAlive:
+		c.sendAck()
+	}
+}
+
+// fail ends the connection on an error every later call returns
+func (c *Conn) fail(err error) {
+	if c.err == nil {
+		c.err = err
+	}
+	c.teardown()
+}
+
+func (c *Conn) teardown() {
+	if c.state == stateClosed {
+		return
+	}
+
+	c.state = stateClosed
+	close(c.done)
+	c.socket.remove(c)
+	c.cond.Broadcast()
+}
+
+func expired(deadline time.Time) bool {
+	return !deadline.IsZero() && time.Now().After(deadline)
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for c.readBuf.Len() == 0 {
+		switch {
+		case c.finReceived:
+			return 0, io.EOF
+		case c.err != nil:
+			return 0, c.err
+		case c.closing || c.state == stateClosed:
+			return 0, net.ErrClosed
+		case expired(c.readDeadline):
+			return 0, os.ErrDeadlineExceeded
+		}
+		c.cond.Wait()
+	}
+
+	return c.readBuf.Read(b)
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	written := 0
+	for written < len(b) {
+		chunk := len(b) - written
+		if chunk > packetSize {
+			chunk = packetSize
+		}
+
+		for {
+			switch {
+			case c.err != nil:
+				return written, c.err
+			case c.closing || c.state == stateClosed:
+				return written, net.ErrClosed
+			case expired(c.writeDeadline):
+				return written, os.ErrDeadlineExceeded
+			}
+
+			window := int(c.maxWindow)
+			if int(c.peerWindow) < window {
+				window = int(c.peerWindow)
+			}
+			// with nothing in flight a packet always goes, so a closed
+			// window gets probed
+			if c.inflight == 0 || c.inflight+chunk <= window {
+				break
+			}
+			c.cond.Wait()
+		}
+
+		c.queue(stData, append([]byte{}, b[written:written+chunk]...))
+		written += chunk
+	}
+
+	return written, nil
+}
+
+// Close sends a FIN and lets the connection linger in the background
+// until the peer acks it
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closing {
+		return nil
+	}
+	c.closing = true
+	c.closedAt = time.Now()
+
+	switch c.state {
+	case stateSynRecv, stateConnected:
+		c.queue(stFin, nil)
+		c.state = stateFinSent
+	case stateSynSent:
+		c.teardown()
+	}
+
+	c.cond.Broadcast()
+	return nil
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.socket.Addr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.readDeadline = t
+	c.writeDeadline = t
+	c.cond.Broadcast()
+	return nil
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.readDeadline = t
+	c.cond.Broadcast()
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.writeDeadline = t
+	c.cond.Broadcast()
+	return nil
+}
@@ -0,0 +1,184 @@
+package utp
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lossyConn loses every 7th DATA packet written through it and holds every
+// 5th back until the next packet went out, so the other end gets it late
+type lossyConn struct {
+	net.PacketConn
+
+	mu       sync.Mutex
+	written  int
+	dropped  int
+	held     []byte
+	heldAddr net.Addr
+}
+
+func (l *lossyConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.written++
+	if h, _, err := unmarshal(b); err == nil && h.typ == stData {
+		switch {
+		case l.written%7 == 0:
+			l.dropped++
+			return len(b), nil
+		case l.written%5 == 0 && l.held == nil:
+			l.held, l.heldAddr = append([]byte{}, b...), addr
+			return len(b), nil
+		}
+	}
+
+	n, err := l.PacketConn.WriteTo(b, addr)
+	if l.held != nil {
+		l.PacketConn.WriteTo(l.held, l.heldAddr)
+		l.held = nil
+	}
+	return n, err
+}
+
+// connect opens two sockets on the loopback and a connection between
+// them, the dialing socket's packets go through wrap when it isn't nil
+func connect(t *testing.T, wrap func(net.PacketConn) net.PacketConn) (dialed, accepted net.Conn) {
+	listening, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listening.Close() })
+
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wrap != nil {
+		udp = wrap(udp)
+	}
+	dialing := NewSocket(udp)
+	t.Cleanup(func() { dialing.Close() })
+
+	dialed, err = dialing.Dial(listening.Addr().String(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err = listening.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dialed.SetDeadline(time.Now().Add(20 * time.Second))
+	accepted.SetDeadline(time.Now().Add(20 * time.Second))
+	return dialed, accepted
+}
+
+// transfer sends data from one end to the other and closes it, and
+// returns what arrived until the close
+func transfer(t *testing.T, from, to net.Conn, data []byte) []byte {
+	t.Helper()
+
+	go func() {
+		from.Write(data)
+		from.Close()
+	}()
+
+	got, err := io.ReadAll(to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestConn(t *testing.T) {
+	dialed, accepted := connect(t, nil)
+
+	if _, err := dialed.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(accepted, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("accepted %q, %v", buf, err)
+	}
+
+	// many packets' worth the other way, then the close comes through as
+	// the end of the stream
+	data := make([]byte, 64*packetSize+17)
+	rand.New(rand.NewSource(1)).Read(data)
+	if got := transfer(t, accepted, dialed, data); !bytes.Equal(got, data) {
+		t.Errorf("sent %d bytes, got %d different ones", len(data), len(got))
+	}
+
+	if _, err := accepted.Write([]byte("late")); err == nil {
+		t.Error("wrote to a closed connection")
+	}
+}
+
+func TestLossyConn(t *testing.T) {
+	var lossy *lossyConn
+	dialed, accepted := connect(t, func(conn net.PacketConn) net.PacketConn {
+		lossy = &lossyConn{PacketConn: conn}
+		return lossy
+	})
+
+	data := make([]byte, 100*packetSize)
+	rand.New(rand.NewSource(2)).Read(data)
+	got := transfer(t, dialed, accepted, data)
+
+	lossy.mu.Lock()
+	dropped := lossy.dropped
+	lossy.mu.Unlock()
+	if dropped == 0 {
+		t.Fatal("no packets were lost")
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("sent %d bytes, got %d different ones after losing %d packets",
+			len(data), len(got), dropped)
+	}
+}
+
+func TestSynTimeout(t *testing.T) {
+	socket, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socket.Close()
+
+	// a SYN and nothing after it
+	peer, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	syn := &header{typ: stSyn, connID: 100, timestamp: now(), seqNr: 1}
+	if _, err := peer.WriteTo(syn.marshal(nil), socket.Addr()); err != nil {
+		t.Fatal(err)
+	}
+
+	accepted, err := socket.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := accepted.(*Conn)
+	c.mu.Lock()
+	c.opened = time.Now().Add(-synTimeout)
+	c.mu.Unlock()
+
+	accepted.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := accepted.Read(make([]byte, 1)); err != ErrTimeout {
+		t.Errorf("read %v from a peer that never followed its SYN up", err)
+	}
+
+	socket.mu.Lock()
+	left := len(socket.conns)
+	socket.mu.Unlock()
+	if left != 0 {
+		t.Errorf("%d connections still kept", left)
+	}
+}
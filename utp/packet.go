@@ -0,0 +1,113 @@
+package utp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// packet types
+const (
+	stData  uint8 = 0
+	stFin   uint8 = 1
+	stState uint8 = 2
+	stReset uint8 = 3
+	stSyn   uint8 = 4
+)
+
+const (
+	version    = 1
+	headerSize = 20
+	// extension carrying the selective ack bitmask
+	extSack = 1
+)
+
+// header is the fixed part of every uTP packet, plus the selective ack
+// extension when there is one
+type header struct {
+	typ           uint8
+	connID        uint16
+	timestamp     uint32
+	timestampDiff uint32
+	wndSize       uint32
+	seqNr         uint16
+	ackNr         uint16
+	// bit i set means ackNr+2+i arrived, nil when there is no extension
+	sack []byte
+}
+
+func (h *header) marshal(payload []byte) []byte {
+	size := headerSize + len(payload)
+	if h.sack != nil {
+		size += 2 + len(h.sack)
+	}
+
+	buf := make([]byte, headerSize, size)
+	buf[0] = h.typ<<4 | version
+	if h.sack != nil {
+		buf[1] = extSack
+	}
+	binary.BigEndian.PutUint16(buf[2:], h.connID)
+	binary.BigEndian.PutUint32(buf[4:], h.timestamp)
+	binary.BigEndian.PutUint32(buf[8:], h.timestampDiff)
+	binary.BigEndian.PutUint32(buf[12:], h.wndSize)
+	binary.BigEndian.PutUint16(buf[16:], h.seqNr)
+	binary.BigEndian.PutUint16(buf[18:], h.ackNr)
+
+	if h.sack != nil {
+		buf = append(buf, 0, byte(len(h.sack)))
+		buf = append(buf, h.sack...)
+	}
+
+	return append(buf, payload...)
+}
+
+// isPacket tells uTP packets apart from other traffic that reaches the
+// socket, like DHT messages which always start with 'd'
+func isPacket(b []byte) bool {
+	return len(b) >= headerSize && b[0]&0x0f == version && b[0]>>4 <= stSyn
+}
+
+func unmarshal(b []byte) (header, []byte, error) {
+	var h header
+	if !isPacket(b) {
+		return h, nil, fmt.Errorf("utp: not a uTP packet")
+	}
+
+	h.typ = b[0] >> 4
+	h.connID = binary.BigEndian.Uint16(b[2:])
+	h.timestamp = binary.BigEndian.Uint32(b[4:])
+	h.timestampDiff = binary.BigEndian.Uint32(b[8:])
+	h.wndSize = binary.BigEndian.Uint32(b[12:])
+	h.seqNr = binary.BigEndian.Uint16(b[16:])
+	h.ackNr = binary.BigEndian.Uint16(b[18:])
+
+	// walk the extension chain, keeping only the ones we know
+	ext := b[1]
+	rest := b[headerSize:]
+	for ext != 0 {
+		if len(rest) < 2 || len(rest) < 2+int(rest[1]) {
+			return h, nil, fmt.Errorf("utp: truncated extension")
+		}
+
+		next, length := rest[0], int(rest[1])
+		if ext == extSack {
+			h.sack = append([]byte{}, rest[2:2+length]...)
+		}
+
+		ext = next
+		rest = rest[2+length:]
+	}
+
+	return h, rest, nil
+}
+
+// seqLess compares sequence numbers that wrap around at 65535
+func seqLess(a, b uint16) bool {
+	return int16(a-b) < 0
+}
+
+// now returns the microsecond timestamp packets carry
+func now() uint32 {
+	return uint32(time.Now().UnixMicro())
+}
@@ -0,0 +1,66 @@
+package utp
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestPacketRoundTrip(t *testing.T) {
+	headers := []header{
+		{typ: stSyn, connID: 7, timestamp: 1, seqNr: 1},
+		{typ: stData, connID: 8, timestamp: 2, timestampDiff: 3, wndSize: recvWindow, seqNr: 65535, ackNr: 9},
+		// packets 11, 12 and 44 arrived after the gap at 10
+		{typ: stState, connID: 8, seqNr: 2, ackNr: 9, sack: []byte{0x03, 0, 0, 0, 0x02, 0, 0, 0}},
+	}
+
+	for _, h := range headers {
+		payload := []byte("block")
+		if h.typ != stData {
+			payload = []byte{}
+		}
+
+		got, rest, err := unmarshal(h.marshal(payload))
+		if err != nil {
+			t.Fatalf("type %d: %v", h.typ, err)
+		}
+		if !reflect.DeepEqual(got, h) {
+			t.Errorf("type %d: sent %+v, got %+v", h.typ, h, got)
+		}
+		if !bytes.Equal(rest, payload) {
+			t.Errorf("type %d: sent payload %q, got %q", h.typ, payload, rest)
+		}
+	}
+}
+
+func TestUnmarshalRejects(t *testing.T) {
+	sacked := (&header{typ: stState, sack: []byte{1, 0, 0, 0}}).marshal(nil)
+
+	packets := map[string][]byte{
+		"a DHT message":       []byte("d1:ad2:id20:abcdefghij0123456789e1:q4:ping1:t2:aa1:y1:qe"),
+		"a short packet":      sacked[:headerSize-1],
+		"a truncated sack":    sacked[:len(sacked)-1],
+		"an unknown version":  append([]byte{stData<<4 | 2}, sacked[1:]...),
+		"an unknown type":     append([]byte{5<<4 | version}, sacked[1:]...),
+		"a missing extension": sacked[:headerSize],
+	}
+
+	for name, b := range packets {
+		if _, _, err := unmarshal(b); err == nil {
+			t.Errorf("%s was taken for a uTP packet", name)
+		}
+	}
+}
+
+func TestSackMask(t *testing.T) {
+	c := &Conn{ackNr: 65534, ooo: map[uint16]inPacket{}}
+	// the sequence numbers wrap past the gap at 65535
+	for _, seqNr := range []uint16{0, 1, 40} {
+		c.ooo[seqNr] = inPacket{}
+	}
+
+	want := []byte{0x03, 0, 0, 0, 0, 0x01, 0, 0}
+	if mask := c.sackMask(); !bytes.Equal(mask, want) {
+		t.Errorf("sack %x, want %x", mask, want)
+	}
+}
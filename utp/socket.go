@@ -0,0 +1,224 @@
+package utp
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type connKey struct {
+	addr string
+	id   uint16
+}
+
+// Socket runs uTP connections over a single UDP socket, telling them apart
+// by address and connection id. Packets that aren't uTP are dropped. A
+// Socket is a net.Listener for the connections peers open to us.
+type Socket struct {
+	conn net.PacketConn
+
+	mu    sync.Mutex
+	conns map[connKey]*Conn
+
+	accept    chan *Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+var defaultSocket atomic.Pointer[Socket]
+
+// Default returns the socket peers are dialed and accepted on, nil until
+// one is set
+func Default() *Socket {
+	return defaultSocket.Load()
+}
+
+func SetDefault(socket *Socket) {
+	defaultSocket.Store(socket)
+}
+
+// Listen opens a UDP socket on addr for uTP
+func Listen(addr string) (*Socket, error) {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewSocket(conn), nil
+}
+
+// NewSocket runs uTP on a socket that is already open
+func NewSocket(conn net.PacketConn) *Socket {
+	socket := &Socket{
+		conn:   conn,
+		conns:  map[connKey]*Conn{},
+		accept: make(chan *Conn, 16),
+		closed: make(chan struct{}),
+	}
+
+	go socket.read()
+	return socket
+}
+
+func (socket *Socket) writeTo(b []byte, addr *net.UDPAddr) {
+	socket.conn.WriteTo(b, addr)
+}
+
+func (socket *Socket) read() {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := socket.conn.ReadFrom(buf)
+		if err != nil {
+			socket.Close()
+			return
+		}
+
+		// payloads outlive the read buffer
+		h, payload, err := unmarshal(append([]byte{}, buf[:n]...))
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if err != nil || !ok {
+			continue
+		}
+
+		socket.dispatch(h, payload, udpAddr)
+	}
+}
+
+func (socket *Socket) dispatch(h header, payload []byte, addr *net.UDPAddr) {
+	socket.mu.Lock()
+
+	var c *Conn
+	if h.typ == stSyn {
+		// a connection made from this SYN already is looked up by the id we
+		// receive on, which is one more than the SYN's
+		c = socket.conns[connKey{addr.String(), h.connID + 1}]
+		if c == nil {
+			c = socket.incoming(h, addr)
+		}
+	} else {
+		c = socket.conns[connKey{addr.String(), h.connID}]
+	}
+
+	socket.mu.Unlock()
+
+	if c == nil {
+		if h.typ != stReset {
+			reset := &header{typ: stReset, connID: h.connID, timestamp: now(), ackNr: h.seqNr}
+			socket.writeTo(reset.marshal(nil), addr)
+		}
+		return
+	}
+
+	c.handle(h, payload)
+}
+
+// incoming makes a connection out of a SYN, nil when nobody would accept it
+func (socket *Socket) incoming(h header, addr *net.UDPAddr) *Conn {
+	select {
+	case <-socket.closed:
+		return nil
+	default:
+	}
+
+	// the read loop is the only sender, so the check holds
+	if len(socket.accept) == cap(socket.accept) {
+		return nil
+	}
+
+	c := newConn(socket, addr, h.connID+1, h.connID, stateSynRecv)
+	c.seqNr = uint16(rand.Intn(65536))
+	c.ackNr = h.seqNr
+
+	socket.conns[connKey{addr.String(), c.recvID}] = c
+	socket.accept <- c
+	return c
+}
+
+func (socket *Socket) remove(c *Conn) {
+	socket.mu.Lock()
+	defer socket.mu.Unlock()
+
+	key := connKey{c.remote.String(), c.recvID}
+	if socket.conns[key] == c {
+		delete(socket.conns, key)
+	}
+}
+
+// Dial opens a uTP connection to addr
+func (socket *Socket) Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	remote, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	socket.mu.Lock()
+	var c *Conn
+	for c == nil {
+		id := uint16(rand.Intn(65536))
+		if _, ok := socket.conns[connKey{remote.String(), id}]; !ok {
+			c = newConn(socket, remote, id, id+1, stateSynSent)
+			socket.conns[connKey{remote.String(), id}] = c
+		}
+	}
+	socket.mu.Unlock()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.seqNr = 1
+	c.queue(stSyn, nil)
+
+	deadline := time.Now().Add(timeout)
+	for c.state == stateSynSent && time.Now().Before(deadline) {
+		c.cond.Wait()
+	}
+
+	if c.state == stateSynSent {
+		c.fail(fmt.Errorf("utp: dial %s: timed out", addr))
+	}
+	if c.err != nil {
+		return nil, c.err
+	}
+
+	return c, nil
+}
+
+// Accept waits for a peer to connect to us
+func (socket *Socket) Accept() (net.Conn, error) {
+	select {
+	case c := <-socket.accept:
+		return c, nil
+	case <-socket.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close closes the socket and drops its connections without waiting for them
+func (socket *Socket) Close() error {
+	var err error
+	socket.closeOnce.Do(func() {
+		close(socket.closed)
+		err = socket.conn.Close()
+
+		socket.mu.Lock()
+		conns := []*Conn{}
+		for _, c := range socket.conns {
+			conns = append(conns, c)
+		}
+		socket.mu.Unlock()
+
+		for _, c := range conns {
+			c.mu.Lock()
+			c.fail(net.ErrClosed)
+			c.mu.Unlock()
+		}
+	})
+	return err
+}
+
+func (socket *Socket) Addr() net.Addr {
+	return socket.conn.LocalAddr()
+}